@@ -14,26 +14,108 @@ type Inbox struct {
 
 type Message struct {
 	Message   uuid.UUID `json:"id"`
-	Sender    string    `json:"sender"`
+	Sender    string    `json:"sender"` // not sent by current servers; see Claims.Sender
 	Timestamp int64     `json:"timestamp"`
-	Size      int       `json:"size"`     // encrypted size. used as a hint.
-	Metadata  []byte    `json:"metadata"` // encrypted metadata, contains unencrypted size.
-	Payload   []byte    `json:"payload"`  // note that this is empty for inbox lookups
-	Claims    []byte    `json:"claims"`   // server-sealed claims for this message, including sender
+	Expiry    int64     `json:"expiry,omitzero"`   // the message is deleted after this time, read or not.
+	Size      int       `json:"size"`              // encrypted size. used as a hint.
+	Metadata  []byte    `json:"metadata"`          // encrypted metadata, contains unencrypted size.
+	Payload   []byte    `json:"payload"`           // note that this is empty for inbox lookups
+	Claims    []byte    `json:"claims"`            // server-sealed claims for this message, including sender
+	Burn      bool      `json:"burn,omitzero"`     // the message is deleted when it's read.
+	Streamed  bool      `json:"streamed,omitzero"` // the payload must be fetched from message/{id}/stream
+
+	// PayloadKey is the key for a shared payload, wrapped for the recipient. See secrt.NewSharedStreamWriter.
+	PayloadKey []byte `json:"payloadKey,omitzero"`
 }
 
 type Metadata struct {
 	Description string `json:"description"`
 	Size        int    `json:"size"`
 	Filename    string `json:"filename"`
+
+	// Sender is the alias of the sender. The server only knows a hash of the alias, which
+	// it puts in the claims, so recipients check the alias against Claims.Sender.
+	Sender string `json:"sender,omitzero"`
+
+	// ContentType describes the payload, if it's known. Key/value secrets use one of the
+	// ContentType constants, which lets "secrt get --format" render them. Directories are
+	// sent as archives, with ContentTypeTar.
+	ContentType string `json:"contentType,omitzero"`
+
+	// Kind is KindRequest for a request for a secret, and KindReply for a reply to another
+	// message. It's empty for an ordinary secret.
+	Kind string `json:"kind,omitzero"`
+
+	// Request is the ID of a request. It's chosen by the requester, and copied into the reply
+	// so the requester can tell which request has been fulfilled.
+	Request uuid.UUID `json:"request,omitzero"`
+
+	// InReplyTo is the ID of the message that a reply answers.
+	InReplyTo uuid.UUID `json:"inReplyTo,omitzero"`
 }
 
+// Kinds of message.
+const (
+	KindRequest = "request"
+	KindReply   = "reply"
+)
+
+// Content types of key/value secrets.
+const (
+	ContentTypeDotenv = "text/x-dotenv"
+	ContentTypeJSON   = "application/json"
+	ContentTypeYAML   = "application/yaml"
+)
+
+// ContentTypeTar is the content type of a directory, which is sent as a tar archive.
+const ContentTypeTar = "application/x-tar"
+
 // SendRequest wraps encrypted metadata with the encrypted payload.
 // Metadata is returned for 'secrt ls', while the payload is returned
 // for 'secrt get'.
 type SendRequest struct {
 	Payload  []byte `json:"payload"`
-	Metadata []byte `json:"metadata"` // encrypted secret.Metadata (json)
+	Metadata []byte `json:"metadata"`      // encrypted secret.Metadata (json)
+	TTL      int64  `json:"ttl,omitzero"`  // requested lifetime in seconds; the server may reduce it.
+	Burn     bool   `json:"burn,omitzero"` // delete the message as soon as it's read.
+
+	// RecipientKey is the public key the message was encrypted for. If the recipient has since
+	// changed their key, the server rejects the message so it can be encrypted for the new key.
+	RecipientKey []byte `json:"recipientKey,omitzero"`
+
+	// Team is the alias of the team the message was sent to, if the recipient was chosen as a
+	// member of a team. If the recipient has since left the team, the server rejects the message.
+	Team string `json:"team,omitzero"`
+}
+
+// ServerAlias is the alias of the server's own peer identity. Messages from the server, such as
+// the welcome message, are sealed with the server's key and come from this alias. It can't be enrolled.
+const ServerAlias = "secrt"
+
+// EnvelopeHeader carries the base64-encoded SendRequest when the payload is streamed in the
+// request body. The SendRequest's payload must be empty.
+const EnvelopeHeader = "Secrt-Envelope"
+
+// SharedSendRequest sends a single streamed payload to several recipients. It's sent in the
+// Secrt-Envelope header, and the payload is the request body.
+type SharedSendRequest struct {
+	Recipients []*RecipientEnvelope `json:"recipients"`
+	TTL        int64                `json:"ttl,omitzero"`
+	Burn       bool                 `json:"burn,omitzero"`
+}
+
+// RecipientEnvelope contains the parts of a shared message that are encrypted for each recipient.
+type RecipientEnvelope struct {
+	Alias        string `json:"alias"`
+	RecipientKey []byte `json:"recipientKey,omitzero"`
+	Team         string `json:"team,omitzero"` // the team the recipient was chosen from; see SendRequest.Team
+	Metadata     []byte `json:"metadata"`      // encrypted secret.Metadata (json)
+	PayloadKey   []byte `json:"payloadKey"`    // the payload's key, wrapped for the recipient
+}
+
+// SharedSendResponse contains the ID of each message, in the same order as the recipients.
+type SharedSendResponse struct {
+	Messages []SendResponse `json:"messages"`
 }
 
 type Signature struct {
@@ -43,12 +125,81 @@ type Signature struct {
 
 // SendResponse is the message ID returned by the server after a share.
 type SendResponse struct {
-	ID uuid.UUID `json:"id"`
+	ID     uuid.UUID `json:"id"`
+	Expiry int64     `json:"expiry,omitzero"` // when the message will be deleted, if it's not read
 }
 
 type Peer struct {
-	Peer      string `json:"peer"`
+	Peer         string    `json:"peer"`
+	PublicKey    []byte    `json:"publicKey"`
+	PreviousKeys []PeerKey `json:"previousKeys,omitzero"` // keys the peer has rotated out, oldest first
+}
+
+// TeamPrefix starts the alias of a team, e.g. "team:sre". Teams are managed by the server, and a
+// message sent to a team is sent to each of its members.
+const TeamPrefix = "team:"
+
+// Team is a team and its current members. Peers who have been invited to the team aren't members
+// until they've joined it. Aliases are encrypted with the team key (see TeamKey), so the server
+// can't read them. TeamKey is the team key sealed for the peer who asked for the team.
+type Team struct {
+	Team    string       `json:"team"`  // the team's alias, including TeamPrefix
+	Owner   TeamMember   `json:"owner"` // the peer who manages the team
+	Members []TeamMember `json:"members"`
+	Invited []TeamMember `json:"invited,omitzero"` // peers who haven't joined yet
+	TeamKey []byte       `json:"teamKey"`
+}
+
+// TeamMember is a member of a team, with their current public key. AliasHash is the server's
+// hash of the member's alias (see AliasHash), which the decrypted alias must match.
+type TeamMember struct {
+	Alias     []byte `json:"alias"` // encrypted with the team key
+	AliasHash []byte `json:"aliasHash"`
+	PublicKey []byte `json:"publicKey"`
+}
+
+// TeamRequest invites peers to a team. The team is created if it doesn't exist, in which case the
+// owner has to be one of the members, so that they have a copy of the team key. Inviting a peer
+// again replaces their copy of the key, e.g. if they couldn't open it after replacing their key.
+type TeamRequest struct {
+	Members []TeamInvite `json:"members"`
+}
+
+// TeamInvite invites a peer to a team. Peer is only used to find the peer, and isn't stored.
+type TeamInvite struct {
+	Peer    string `json:"peer"`
+	Alias   []byte `json:"alias"`   // the peer's alias, encrypted with the team key
+	TeamKey []byte `json:"teamKey"` // the team key, sealed for the peer's public key
+}
+
+// TeamList lists the aliases of the teams a peer owns or belongs to, and the teams they've been
+// invited to join.
+type TeamList struct {
+	Teams       []string `json:"teams"`
+	Invitations []string `json:"invitations,omitzero"`
+}
+
+// PeerKey is a public key that a peer used before they replaced it with "secrt rekey".
+type PeerKey struct {
 	PublicKey []byte `json:"publicKey"`
+	Retired   int64  `json:"retired"` // when the key was replaced
+}
+
+// RekeyRequest replaces the public key of the authenticated peer. Each proof is a RekeyProof sealed
+// for the server's public key: OldKeyProof with the current private key, and NewKeyProof with the new
+// private key. Together they prove that the peer holds both keys. TeamKeys are the keys of the
+// peer's teams, sealed for the new key, so the peer can still read the teams' aliases.
+type RekeyRequest struct {
+	PublicKey   []byte            `json:"publicKey"`
+	OldKeyProof []byte            `json:"oldKeyProof"`
+	NewKeyProof []byte            `json:"newKeyProof"`
+	TeamKeys    map[string][]byte `json:"teamKeys,omitzero"` // team alias -> sealed team key
+}
+
+// RekeyProof is the content of the proofs in a RekeyRequest.
+type RekeyProof struct {
+	PublicKey []byte `json:"publicKey"` // the new public key
+	Timestamp int64  `json:"timestamp"`
 }
 
 type Challenge struct {
@@ -92,19 +243,99 @@ type EnrolmentResponse struct {
 type ActivationRequest struct {
 	Token string `json:"token"`
 	Code  int    `json:"code"`
+
+	// Alias is the alias that was enrolled. It's optional: if it's present (and correct), it's
+	// included in the authentication token, so that the server can log it.
+	Alias string `json:"alias,omitzero"`
 }
 
 type ActivationResponse struct {
 	Message string `json:"message"`
 	Token   []byte `json:"token"`
+	Expiry  int64  `json:"expiry,omitzero"` // when the token expires; zero if it doesn't
+
+	// Inviters are the alias hashes (see AliasHash) of the peers who invited the new peer.
+	Inviters [][]byte `json:"inviters,omitzero"`
+}
+
+// TokenResponse contains a new authentication token, returned when a token is refreshed,
+// or when a peer logs out of all their devices.
+type TokenResponse struct {
+	Token  []byte `json:"token"`
+	Expiry int64  `json:"expiry,omitzero"` // when the token expires; zero if it doesn't
+}
+
+// Event types sent by GET /inbox/watch, which streams new messages as Server-Sent Events.
+const (
+	WatchMessage = "message" // A new message; the data is the Message, without the payload
+	WatchTimeout = "timeout" // The watch has ended, and the client should reconnect
+)
+
+// Notification preferences, set with NotifyRequest.
+const (
+	NotifyNone  = "none"  // Don't send notifications
+	NotifyEmail = "email" // Email the peer when messages arrive
+)
+
+// NotifyRequest sets how the peer is told about new messages. Email notifications need the
+// peer's address, which the server stores (encrypted) only for peers who opt in. The address
+// must be the peer's alias.
+type NotifyRequest struct {
+	Notify  string `json:"notify"`
+	Address string `json:"address,omitzero"`
 }
 
 // Claims is server-sealed metadata containing identifying information about the sender and message.
+// The server doesn't store aliases, so the sender is identified by the hash of their alias
+// (see AliasHash). Messages sent by older servers have the sender's Alias instead.
 type Claims struct {
 	Message      uuid.UUID `json:"message"`
-	Alias        string    `json:"alias"`
+	Alias        string    `json:"alias,omitzero"`
+	Sender       []byte    `json:"sender,omitzero"`
 	PublicKey    []byte    `json:"publicKey"`
 	PayloadHash  []byte    `json:"payloadHash"`
 	MetadataHash []byte    `json:"metadataHash,omitzero"`
 	Timestamp    int64     `json:"timestamp"`
+	Expiry       int64     `json:"expiry,omitzero"`
+	Burn         bool      `json:"burn,omitzero"`
+}
+
+// Error codes sent by the server in the JSON body of an error response. Other errors use a code
+// derived from the HTTP status, e.g. "not_found" or "unauthorized".
+const (
+	ErrorChallengeExpired   = "challenge_expired"    // The enrolment challenge is too old; request a new one
+	ErrorInvalidChallenge   = "invalid_challenge"    // The enrolment challenge or its solution is invalid
+	ErrorInvalidActivation  = "invalid_activation"   // The activation token or code is wrong, or has expired
+	ErrorUnknownPeer        = "unknown_peer"         // The requested peer isn't enrolled on the server
+	ErrorUnknownRecipient   = "unknown_recipient"    // The recipient of a message isn't enrolled on the server
+	ErrorUnknownMessage     = "unknown_message"      // The message doesn't exist, or has expired
+	ErrorAmbiguousMessageID = "ambiguous_message_id" // The short message ID matches more than one message
+	ErrorPolicy             = "policy"               // The request exceeds a limit; the detail is a PolicyError
+	ErrorTokenExpired       = "token_expired"        // The authentication token is older than the server allows
+	ErrorTokenRevoked       = "token_revoked"        // The authentication token was revoked by "secrt logout"
+	ErrorRecipientKey       = "recipient_key"        // The recipient's public key has changed since the message was encrypted
+	ErrorInvalidProof       = "invalid_proof"        // A rekey request didn't prove possession of the keys
+	ErrorUnknownTeam        = "unknown_team"         // The requested team doesn't exist
+	ErrorTeamMember         = "team_member"          // The recipient isn't a member of the team the message was sent to
+)
+
+// Names of the limits that can be exceeded, reported in PolicyError.
+const (
+	PolicyDailyLimit      = "dailyLimit"
+	PolicyMaxPayloadSize  = "maxPayloadSize"
+	PolicyMaxMetadataSize = "maxMetadataSize"
+	PolicyInvites         = "invites"
+)
+
+// PolicyError is returned by the server (as the JSON body of the error response) when a request
+// is refused because it exceeds one of the limits of the peer's plan.
+type PolicyError struct {
+	Policy  string `json:"policy"`        // The limit that was exceeded, e.g. PolicyDailyLimit
+	Plan    string `json:"plan,omitzero"` // The peer's plan, if any
+	Limit   int64  `json:"limit"`         // The value of the limit
+	Message string `json:"message"`       // Human readable description of the problem
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/sha512"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 
 const challengeLength = 1024
 
+// ErrChallengeExpired is returned by ValidateResponse if the challenge is too old.
+var ErrChallengeExpired = errors.New("challenge expired")
+
 // NewChallenge generates a new, random challenge, encoded as a JSON object.
 func NewChallenge(complexity int, privateSignKey []byte) (*ChallengeRequest, error) {
 
@@ -78,7 +82,7 @@ func ValidateResponse(response *ChallengeResponse, publicSignKey []byte) error {
 
 	delta := time.Now().Unix() - challenge.Timestamp
 	if delta < 0 || delta > 30 {
-		return fmt.Errorf("challenge exprired")
+		return ErrChallengeExpired
 	}
 
 	hash := HashWithNonce(challenge.Challenge, response.Nonce)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 
 	"github.com/commandquery/secrt"
@@ -23,6 +24,7 @@ func CmdActivate(config *Config, endpoint *Endpoint, args []string) error {
 	activationRequest := &secrt.ActivationRequest{
 		Token: args[0],
 		Code:  code,
+		Alias: endpoint.Alias,
 	}
 
 	var activationResponse secrt.ActivationResponse
@@ -30,11 +32,17 @@ func CmdActivate(config *Config, endpoint *Endpoint, args []string) error {
 		return fmt.Errorf("unable to activate account: %w", err)
 	}
 
-	if err = endpoint.Vaults[0].vault.Set("authToken", activationResponse.Token); err != nil {
-		return fmt.Errorf("unable to store auth token: %w", err)
+	if err = endpoint.SetAuthToken(config, activationResponse.Token); err != nil {
+		return err
 	}
 
-	config.modified = true
+	for _, inviter := range activationResponse.Inviters {
+		endpoint.ExpectPeer(inviter)
+	}
+
+	if activationResponse.Message != "" {
+		fmt.Fprintln(os.Stderr, activationResponse.Message)
+	}
 
 	return nil
 }
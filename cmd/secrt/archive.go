@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/commandquery/secrt"
+)
+
+// archiveInput packs a directory into a tar archive, which is held in memory. File modes are
+// preserved, but owners aren't. Symlinks and special files can't be sent.
+func archiveInput(dir string) (io.ReadSeekCloser, *secrt.Metadata, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink, which can't be sent", name)
+		}
+
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return fmt.Errorf("%s isn't a regular file", name)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	if err == nil {
+		err = tw.Close()
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to archive %s: %w", dir, err)
+	}
+
+	metadata := &secrt.Metadata{
+		Filename:    filepath.Base(filepath.Clean(dir)),
+		Size:        buf.Len(),
+		ContentType: secrt.ContentTypeTar,
+	}
+
+	return memoryInput{bytes.NewReader(buf.Bytes())}, metadata, nil
+}
+
+// extractArchive extracts a tar archive into the directory, which is created if necessary. The
+// whole archive is checked before anything is written: entries must be files or directories inside
+// the directory, and existing files aren't overwritten unless force is set. Files are created
+// through an os.Root, so symlinks in the directory can't be used to escape it.
+func extractArchive(archive []byte, dir string, force bool) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	// Check every entry first.
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid archive: %w", err)
+		}
+
+		name, err := archiveName(header)
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg && !force {
+			if _, err = root.Lstat(name); err == nil {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", filepath.Join(dir, name))
+			}
+		}
+	}
+
+	tr = tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid archive: %w", err)
+		}
+
+		name, err := archiveName(header)
+		if err != nil {
+			return err
+		}
+
+		if err = mkdirAll(root, filepath.Dir(name)); err != nil {
+			return err
+		}
+
+		// Modes are preserved, but setuid and similar bits aren't.
+		mode := fs.FileMode(header.Mode) & fs.ModePerm
+
+		if header.Typeflag == tar.TypeDir {
+			if err = root.Mkdir(name, mode|0700); err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			continue
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+
+		f, err := root.OpenFile(name, flags, mode)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to extract %s: %w", name, err)
+		}
+	}
+}
+
+// saveArchive writes an archive that couldn't be extracted into a new file next to the directory,
+// and returns its name.
+func saveArchive(archive []byte, dir string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(filepath.Clean(dir)), "secrt-*.tar")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(archive)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// archiveName returns the local name of an archive entry, which must be a file or directory
+// inside the directory being extracted.
+func archiveName(header *tar.Header) (string, error) {
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+		return "", fmt.Errorf("%s isn't a regular file or directory", header.Name)
+	}
+
+	name := path.Clean(strings.TrimSuffix(header.Name, "/"))
+	if strings.Contains(header.Name, `\`) || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("%s is outside the target directory", header.Name)
+	}
+
+	return filepath.FromSlash(name), nil
+}
+
+// mkdirAll creates a directory inside the root, along with any missing parents.
+func mkdirAll(root *os.Root, dir string) error {
+	if dir == "." {
+		return nil
+	}
+
+	if err := mkdirAll(root, filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	if err := root.Mkdir(dir, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeArchive returns a tar archive containing the given headers. Regular files contain their name.
+func makeArchive(t *testing.T, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(header.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func file(name string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	archive := makeArchive(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "sub/", Mode: 0755},
+		file("a"),
+		file("sub/b"),
+		file("implicit/c"),
+	)
+
+	if err := extractArchive(archive, dir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "sub/b", "implicit/c"} {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != name {
+			t.Errorf("%s: expected %q, got %q", name, name, content)
+		}
+	}
+
+	// Existing files are only overwritten with --force.
+	if err := extractArchive(archive, dir, false); err == nil {
+		t.Error("expected existing files to be rejected")
+	}
+
+	if err := extractArchive(archive, dir, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExtractArchiveRejects(t *testing.T) {
+	tests := map[string][]*tar.Header{
+		"parent":       {file("../x")},
+		"nested":       {file("a/../../x")},
+		"absolute":     {file("/tmp/x")},
+		"backslash":    {file(`a\b`)},
+		"backslash up": {file(`..\x`)},
+		"symlink":      {{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/etc/passwd"}},
+		"hardlink":     {{Typeflag: tar.TypeLink, Name: "link", Linkname: "/etc/passwd"}},
+		"device":       {{Typeflag: tar.TypeChar, Name: "null", Devmajor: 1, Devminor: 3}},
+		"fifo":         {{Typeflag: tar.TypeFifo, Name: "fifo"}},
+		"late":         {file("ok"), file("../x")},
+		"late symlink": {file("ok"), {Typeflag: tar.TypeSymlink, Name: "link", Linkname: "ok"}},
+	}
+
+	for name, headers := range tests {
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "out")
+		if err := extractArchive(makeArchive(t, headers...), dir, true); err == nil {
+			t.Errorf("%s: expected the archive to be rejected", name)
+		}
+
+		// Nothing is written unless the whole archive is valid.
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) > 0 {
+			t.Errorf("%s: expected an empty directory, got %v, %v", name, entries, err)
+		}
+
+		if entries, err := os.ReadDir(parent); err != nil || len(entries) != 1 {
+			t.Errorf("%s: something was written outside the directory: %v, %v", name, entries, err)
+		}
+	}
+}
+
+func TestSaveArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	archive := makeArchive(t, file("a"))
+
+	saved, err := saveArchive(archive, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(saved) != filepath.Dir(dir) {
+		t.Errorf("expected %s to be next to %s", saved, dir)
+	}
+
+	content, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(content, archive) {
+		t.Error("saved archive doesn't match")
+	}
+
+	info, err := os.Stat(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("saved archive is readable by others: %v", info.Mode())
+	}
+}
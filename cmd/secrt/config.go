@@ -28,10 +28,23 @@ const (
 	VaultPlatform VaultType = "platform" // Platform vaule. Uses zalando/go-keyring.
 )
 
-// Peer contains information about other users.
+// Peer contains information about other users. A peer's key is pinned the first time it's seen,
+// and changes to it must be accepted (see "secrt peer accept-key").
 type Peer struct {
-	Alias     string `json:"alias"`
+	Alias          string    `json:"alias"`
+	PublicKey      []byte    `json:"publicKey"`
+	FirstSeen      int64     `json:"firstSeen,omitzero"`      // When the current key was pinned
+	Verified       int64     `json:"verified,omitzero"`       // When the user compared safety numbers; zero if never
+	PreviousKeys   []PeerKey `json:"previousKeys,omitzero"`   // Keys this peer used before, oldest first
+	PendingKey     []byte    `json:"pendingKey,omitzero"`     // A changed key that hasn't been accepted yet
+	PendingRotated bool      `json:"pendingRotated,omitzero"` // The server says the peer replaced the current key with "secrt rekey"
+}
+
+// PeerKey is a key that a peer used in the past.
+type PeerKey struct {
 	PublicKey []byte `json:"publicKey"`
+	Replaced  int64  `json:"replaced"` // When we stopped using the key
+	Rotated   bool   `json:"rotated"`  // The server reported that the peer rotated the key with "secrt rekey"
 }
 
 // ConfigVersion is current default version of the configuration file.
@@ -82,6 +95,22 @@ type Endpoint struct {
 	PublicKey []byte             `json:"publicKey"` // Public key for the private key
 	Peers     map[string]*Peer   `json:"peers"`     // Contains info about other users
 
+	// Groups are named lists of peer aliases. "@name" can be used in place of a peer ID.
+	Groups map[string][]string `json:"groups,omitzero"`
+
+	// TeamMembers are the members of each team that we've confirmed sending to. We're asked before
+	// sending to anyone who has joined a team since then.
+	TeamMembers map[string][]string `json:"teamMembers,omitzero"`
+
+	TokenIssued int64 `json:"tokenIssued,omitzero"` // When the auth token was issued, so it can be rotated
+
+	// Expected contains the alias hashes (see secrt.AliasHash) of peers we expect to hear from:
+	// peers we've invited, and peers who invited us. They're added without a warning.
+	Expected [][]byte `json:"expected,omitzero"`
+
+	// Requests are the requests for secrets we've sent, so that replies can be matched to them.
+	Requests []*Request `json:"requests,omitzero"`
+
 	// Any newly-added peers are added to this list so we can display them on exit.
 	newPeers []*Peer
 }
@@ -207,8 +236,7 @@ func NewVault(endpoint *Endpoint, storeType VaultType) (Vault, error) {
 	case VaultClear:
 		return NewClearVault(), nil
 	case VaultPassword:
-		// TODO
-		return nil, fmt.Errorf("unsupported key store type: %s", storeType)
+		return NewPasswordVault()
 	case VaultPlatform:
 		return NewPlatformSecureStore(endpoint)
 	default:
@@ -351,6 +379,15 @@ func (config *Config) Unmarshal(data []byte) error {
 					return err
 				}
 
+				key.vault = ks
+
+			case VaultPassword:
+				ks := &PasswordVault{}
+				err = ks.Unmarshal(key.Properties)
+				if err != nil {
+					return err
+				}
+
 				key.vault = ks
 			}
 		}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -11,7 +12,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
@@ -21,6 +24,7 @@ import (
 var ErrUnknownPeer error = errors.New("unknown peer")
 var ErrExistingEnrolment error = errors.New("already enrolled")
 var ErrSecretTooBig error = errors.New("secret too big")
+var ErrPeerKeyChanged error = errors.New("public key has been replaced; it might not belong to the peer")
 
 // Call sends a JSON object and receives a JSON response. It's a convenience method that
 // creates a JSONRequest and calls it. The intent is that most calls should use
@@ -33,7 +37,50 @@ func Call[S any, R any](endpoint *Endpoint, s *S, r *R, method string, path ...s
 		return fmt.Errorf("unable to set signature: %w", err)
 	}
 
-	return jtp.Call(method, endpoint.Path(path...), headers, s, r)
+	return callError(jtp.Call(method, endpoint.Path(path...), headers, s, r))
+}
+
+// Upload streams the body to the endpoint, and receives a JSON response. The envelope, which
+// describes the body, is sent in a header.
+func Upload[R any](endpoint *Endpoint, envelope any, body io.Reader, r *R, method string, path ...string) error {
+	headers, err := endpoint.GetAuthHeader()
+	if err != nil {
+		return fmt.Errorf("unable to set signature: %w", err)
+	}
+
+	envelopeJS, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("unable to marshal envelope: %w", err)
+	}
+
+	headers.Set(secrt.EnvelopeHeader, base64.StdEncoding.EncodeToString(envelopeJS))
+
+	return callError(jtp.Upload(method, endpoint.Path(path...), headers, body, r))
+}
+
+// Download returns a streamed response from the endpoint. The caller must close the stream.
+func Download(endpoint *Endpoint, method string, path ...string) (io.ReadCloser, error) {
+	headers, err := endpoint.GetAuthHeader()
+	if err != nil {
+		return nil, fmt.Errorf("unable to set signature: %w", err)
+	}
+
+	body, err := jtp.Download(method, endpoint.Path(path...), headers)
+	if err != nil {
+		return nil, callError(err)
+	}
+
+	return body, nil
+}
+
+// callError returns policy errors directly, since they explain exactly which limit was exceeded.
+func callError(err error) error {
+	var policyErr secrt.PolicyError
+	if jtp.DecodeBody(err, &policyErr) && policyErr.Policy != "" {
+		return &policyErr
+	}
+
+	return err
 }
 
 // Path returns a path URL relative to the endpoint.
@@ -56,6 +103,9 @@ func (endpoint *Endpoint) GetPeer(config *Config, alias string) (*Peer, error) {
 	if endpoint.Peers != nil {
 		entry, ok := endpoint.Peers[alias]
 		if ok {
+			if entry.PendingKey != nil {
+				return nil, entry.keyChangedError()
+			}
 			return entry, nil
 		}
 	}
@@ -73,8 +123,8 @@ func (endpoint *Endpoint) GetPeer(config *Config, alias string) (*Peer, error) {
 	return newPeer, nil
 }
 
-func (endpoint *Endpoint) AddPeer(alias string) (*Peer, error) {
-
+// fetchPeer retrieves a peer's public key, and any keys they have rotated out, from the server.
+func (endpoint *Endpoint) fetchPeer(alias string) (*secrt.Peer, error) {
 	var peerResp secrt.Peer
 	if err := Call(endpoint, jtp.Nil, &peerResp, "GET", "peer", alias); err != nil {
 		return nil, fmt.Errorf("unable to get peer %s: %w", alias, err)
@@ -88,16 +138,81 @@ func (endpoint *Endpoint) AddPeer(alias string) (*Peer, error) {
 		return nil, fmt.Errorf("received wrong peer id: %s (expected %s)", peerResp.Peer, alias)
 	}
 
+	return &peerResp, nil
+}
+
+func (endpoint *Endpoint) AddPeer(alias string) (*Peer, error) {
+
+	peerResp, err := endpoint.fetchPeer(alias)
+	if err != nil {
+		return nil, err
+	}
+
 	peer := &Peer{
 		Alias:     alias,
 		PublicKey: peerResp.PublicKey,
+		FirstSeen: time.Now().Unix(),
 	}
 
 	endpoint.Peers[alias] = peer
-	endpoint.newPeers = append(endpoint.newPeers, peer)
+
+	// Peers we invited, or who invited us, aren't a surprise.
+	aliasHash := secrt.AliasHash(endpoint.ServerKey, alias)
+	if i := slices.IndexFunc(endpoint.Expected, func(h []byte) bool { return bytes.Equal(h, aliasHash) }); i >= 0 {
+		endpoint.Expected = slices.Delete(endpoint.Expected, i, i+1)
+	} else {
+		endpoint.newPeers = append(endpoint.newPeers, peer)
+	}
+
 	return peer, nil
 }
 
+// ExpectPeer records that we expect to hear from the peer with the given alias hash.
+func (endpoint *Endpoint) ExpectPeer(aliasHash []byte) {
+	if !slices.ContainsFunc(endpoint.Expected, func(h []byte) bool { return bytes.Equal(h, aliasHash) }) {
+		endpoint.Expected = append(endpoint.Expected, aliasHash)
+	}
+}
+
+// RefreshPeer fetches the current public key of a known peer. If it has changed, the new key is
+// recorded as pending, and ErrPeerKeyChanged is returned: the user has to accept it with
+// "secrt peer accept-key" before it's used, even if the server says the peer rotated it with
+// "secrt rekey", since the server could be lying.
+// The config is saved, so the pending key is remembered even though the command fails.
+func (endpoint *Endpoint) RefreshPeer(config *Config, alias string) (*Peer, error) {
+	peer, ok := endpoint.Peers[alias]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, alias)
+	}
+
+	peerResp, err := endpoint.fetchPeer(alias)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(peer.PublicKey, peerResp.PublicKey) {
+		return peer, nil
+	}
+
+	config.modified = true
+	peer.PendingKey = peerResp.PublicKey
+	peer.PendingRotated = reportedRotation(peer.PublicKey, peerResp)
+	if err = config.Save(); err != nil {
+		return nil, err
+	}
+
+	return nil, peer.keyChangedError()
+}
+
+// reportedRotation returns true if the server lists key as one of the peer's previous keys, which
+// means the peer replaced it with "secrt rekey". It's only shown to the user: the server could
+// claim a rotation for a key that it replaced itself.
+func reportedRotation(key []byte, peerResp *secrt.Peer) bool {
+	return slices.ContainsFunc(peerResp.PreviousKeys, func(previous secrt.PeerKey) bool {
+		return bytes.Equal(previous.PublicKey, key)
+	})
+}
+
 func (endpoint *Endpoint) PrintNewPeers() {
 	if endpoint.newPeers == nil {
 		return
@@ -131,34 +246,90 @@ func (endpoint *Endpoint) GetAuthHeader() (http.Header, error) {
 	return header, nil
 }
 
-// readInput reads a byte slice from a file or stdin. If the filename is "", read from stdin.
-// Returns the byte array as well as file metadata.
-func readInput(filename string) ([]byte, *secrt.Metadata, error) {
+// openInput opens a file or stdin for reading. If the filename is "", read from stdin.
+// Returns the input, which can be rewound so it can be sent to several peers, as well as the
+// file metadata. Regular files are streamed, but pipes (and other inputs that can't be
+// rewound) are read into memory.
+func openInput(filename string) (io.ReadSeekCloser, *secrt.Metadata, error) {
 	metadata := &secrt.Metadata{}
 
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		return archiveInput(filename)
+	}
+
 	// Use a filename, or just stdin?
-	var reader io.Reader
+	file := os.Stdin
 	if filename != "" {
-		file, err := os.Open(filename)
-		if err != nil {
+		var err error
+		if file, err = os.Open(filename); err != nil {
 			return nil, nil, err
 		}
 
-		defer file.Close()
 		metadata.Filename = filepath.Base(file.Name())
-		reader = file
-	} else {
-		metadata.Filename = ""
-		reader = os.Stdin
+		metadata.ContentType = contentType(filename)
 	}
 
-	cleartext, err := io.ReadAll(reader)
+	info, err := file.Stat()
+	if err == nil && info.Mode().IsRegular() {
+		metadata.Size = int(info.Size())
+		return file, metadata, nil
+	}
+
+	defer file.Close()
+
+	cleartext, err := io.ReadAll(file)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	metadata.Size = len(cleartext)
-	return cleartext, metadata, nil
+	return memoryInput{bytes.NewReader(cleartext)}, metadata, nil
+}
+
+// memoryInput is an input that has been read into memory.
+type memoryInput struct {
+	*bytes.Reader
+}
+
+func (memoryInput) Close() error {
+	return nil
+}
+
+// SetSecretValue stores a value in every vault, unsealing them if necessary. It tries all the
+// vaults, even if some fail, and reports which of them couldn't be updated, because the vaults no
+// longer agree.
+func (endpoint *Endpoint) SetSecretValue(key string, value []byte) error {
+	if len(endpoint.Vaults) == 0 {
+		return fmt.Errorf("no vaults found")
+	}
+
+	var errs []error
+	updated := 0
+	for _, envelope := range endpoint.Vaults {
+		if envelope.vault == nil {
+			continue
+		}
+
+		if !envelope.vault.IsUnsealed() {
+			if err := envelope.vault.Unseal(); err != nil {
+				errs = append(errs, fmt.Errorf("unable to unseal %s vault: %w", envelope.VaultType, err))
+				continue
+			}
+		}
+
+		if err := envelope.vault.Set(key, value); err != nil {
+			errs = append(errs, fmt.Errorf("unable to set %s in %s vault: %w", key, envelope.VaultType, err))
+			continue
+		}
+
+		updated++
+	}
+
+	if len(errs) > 0 && updated > 0 {
+		return fmt.Errorf("%s was only stored in %d of %d vaults: %w", key, updated, updated+len(errs), errors.Join(errs...))
+	}
+
+	return errors.Join(errs...)
 }
 
 func (endpoint *Endpoint) GetSecretValue(key string) ([]byte, error) {
@@ -184,21 +355,40 @@ func (endpoint *Endpoint) GetVault() (Vault, error) {
 		}
 	}
 
-	// Try to unseal the first vault.
-	envelope := endpoint.Vaults[0]
+	// Try to unseal each vault in turn. For example, the platform keystore might not be
+	// available over SSH, but a password vault would be.
+	var errs []error
+	for _, envelope := range endpoint.Vaults {
+		if envelope.vault == nil {
+			continue
+		}
 
-	if envelope.vault != nil {
 		if err := envelope.vault.Unseal(); err != nil {
-			return nil, fmt.Errorf("unable to unseal vault: %w", err)
+			errs = append(errs, fmt.Errorf("unable to unseal %s vault: %w", envelope.VaultType, err))
+			continue
 		}
 
 		return envelope.vault, nil
 	}
 
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
 	return nil, fmt.Errorf("no vault found")
 }
 
 func (endpoint *Endpoint) Encrypt(plaintext []byte, peerKey []byte) ([]byte, error) {
+	privateKey, err := endpoint.GetSecretValue("privateKey")
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(plaintext, peerKey, privateKey)
+}
+
+// seal encrypts a message for the given peer, using the given private key.
+func seal(plaintext []byte, peerKey []byte, privateKey []byte) ([]byte, error) {
 	// You must use a different nonce for each message you encrypt with the
 	// same key. Since the nonce here is 192 bits long, a random value
 	// provides a sufficiently small probability of collisions.
@@ -214,13 +404,55 @@ func (endpoint *Endpoint) Encrypt(plaintext []byte, peerKey []byte) ([]byte, err
 	// Append the nonce, which is a fixed length (24 bytes).
 	ciphertext = append(ciphertext, nonce[:]...)
 
+	// Encrypt the message itself and append to the nonce + public key
+	return box.Seal(ciphertext, plaintext, &nonce, secrt.To32(peerKey), secrt.To32(privateKey)), nil
+}
+
+// EncryptStream returns a writer that encrypts a stream for the given peer, and writes the
+// ciphertext to w. The writer must be closed to complete the stream.
+func (endpoint *Endpoint) EncryptStream(w io.Writer, peerKey []byte) (io.WriteCloser, error) {
 	privateKey, err := endpoint.GetSecretValue("privateKey")
 	if err != nil {
 		return nil, err
 	}
 
-	// Encrypt the message itself and append to the nonce + public key
-	return box.Seal(ciphertext, plaintext, &nonce, secrt.To32(peerKey), secrt.To32(privateKey)), nil
+	return secrt.NewStreamWriter(w, peerKey, privateKey)
+}
+
+// DecryptStream returns a reader that decrypts a stream sent by the given peer.
+func (endpoint *Endpoint) DecryptStream(r io.Reader, peerKey []byte) (io.Reader, error) {
+	privateKey, err := endpoint.GetSecretValue("privateKey")
+	if err != nil {
+		return nil, err
+	}
+
+	return secrt.NewStreamReader(r, peerKey, privateKey)
+}
+
+// SealStreamKey wraps the key of a shared stream for the given peer.
+func (endpoint *Endpoint) SealStreamKey(key *secrt.StreamKey, peerKey []byte) ([]byte, error) {
+	privateKey, err := endpoint.GetSecretValue("privateKey")
+	if err != nil {
+		return nil, err
+	}
+
+	return key.Seal(peerKey, privateKey)
+}
+
+// DecryptSharedStream returns a reader that decrypts a shared stream sent by the given peer,
+// using the key that the peer wrapped for us.
+func (endpoint *Endpoint) DecryptSharedStream(r io.Reader, sealedKey []byte, peerKey []byte) (io.Reader, error) {
+	privateKey, err := endpoint.GetSecretValue("privateKey")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := secrt.OpenStreamKey(sealedKey, peerKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrt.NewSharedStreamReader(r, key)
 }
 
 func (endpoint *Endpoint) DecryptPeer(config *Config, alias string, ciphertext []byte) ([]byte, error) {
@@ -301,3 +533,34 @@ func (endpoint *Endpoint) GetClaims(config *Config, cryptclaims []byte) (*secrt.
 
 	return &claims, nil
 }
+
+// FromServer reports whether a message was sent by the server itself, rather than by a peer.
+// Only the server can seal claims with its own key and alias, so these messages are trusted.
+func (endpoint *Endpoint) FromServer(claims *secrt.Claims) bool {
+	return bytes.Equal(claims.PublicKey, endpoint.ServerKey) &&
+		bytes.Equal(claims.Sender, secrt.AliasHash(endpoint.ServerKey, secrt.ServerAlias))
+}
+
+// GetSender returns the alias of the sender of a message. The server doesn't know the sender's
+// alias, so the sender puts it in the encrypted metadata, and the server puts the hash of the
+// sender's alias in the claims. The alias is only returned if they match. Older servers put the
+// alias itself in the claims.
+func (endpoint *Endpoint) GetSender(claims *secrt.Claims, metadata *secrt.Metadata) (string, error) {
+	if endpoint.FromServer(claims) {
+		return secrt.ServerAlias, nil
+	}
+
+	if claims.Alias != "" {
+		return claims.Alias, nil
+	}
+
+	if metadata.Sender == "" {
+		return "", fmt.Errorf("message metadata does not identify the sender")
+	}
+
+	if !bytes.Equal(secrt.AliasHash(endpoint.ServerKey, metadata.Sender), claims.Sender) {
+		return "", fmt.Errorf("sender claim does not match message metadata")
+	}
+
+	return metadata.Sender, nil
+}
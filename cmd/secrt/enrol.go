@@ -18,9 +18,9 @@ import (
 // the server will send an encrypted verification email containing a link and a code.
 // The user has to enter the code in order to complete enrolment.
 //
-// On the client side, enrolment happens in two steps. The first step sends a validation
-// code to the peer. The second step long-polls until the requested peer becomes active.
-// Both steps require a hashcash challenge to be solved.
+// On the client side, enrolment happens in two steps. The first step, which requires a
+// hashcash challenge to be solved, sends a validation code to the peer. The second step
+// is "secrt activate", which sends the code back to the server.
 func (endpoint *Endpoint) enrol() error {
 
 	challengeRequest, err := endpoint.GetChallenge()
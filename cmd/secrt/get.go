@@ -3,9 +3,14 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
@@ -13,10 +18,17 @@ import (
 
 // CmdGet gets a secret. You can use either the short, 8-character UUID, or the full UUID
 // If there's more than one secret with the same short ID, the server will send us an error.
+// Key/value secrets can be rendered in other formats with --format, or a single value can be
+// extracted with --key. Directories are extracted with -x.
 func CmdGet(config *Config, endpoint *Endpoint, args []string) error {
 
 	flags := flag.NewFlagSet("get", flag.ContinueOnError)
 	targetFilename := flags.String("o", "", "output to the given filename")
+	format := flags.String("format", FormatRaw, "output format: raw, export, envfile, k8s or json")
+	key := flags.String("key", "", "output the value of a single key")
+	name := flags.String("name", "", "the name of the Kubernetes Secret (default: derived from the message)")
+	extract := flags.String("x", "", "extract a directory into the given directory")
+	force := flags.Bool("force", false, "overwrite existing files when extracting")
 	if err := flags.Parse(args); err != nil {
 		return fmt.Errorf("unable to parse flags: %w", err)
 	}
@@ -26,62 +38,287 @@ func CmdGet(config *Config, endpoint *Endpoint, args []string) error {
 		return fmt.Errorf("message ID not specified")
 	}
 
-	var message secrt.Message
-	if err := Call(endpoint, jtp.Nil, &message, "GET", "message", args[0]); err != nil {
-		return fmt.Errorf("unable to get message %s: %w", args[0], err)
+	// Check the format first, since reading a burn-after-reading message deletes it.
+	if !slices.Contains([]string{FormatRaw, FormatExport, FormatEnvFile, FormatK8s, FormatJSON}, *format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if *name != "" {
+		if err := checkK8sName(*name); err != nil {
+			return err
+		}
+	}
+
+	if *extract != "" {
+		if *targetFilename != "" || *format != FormatRaw || *key != "" {
+			return fmt.Errorf("-x can't be used with -o, --format or --key")
+		}
+
+		var archive bytes.Buffer
+		msg, err := getMessage(config, endpoint, args[0], &archive)
+		if err != nil {
+			return err
+		}
+
+		if msg.Metadata.ContentType != secrt.ContentTypeTar {
+			return fmt.Errorf("message %s isn't a directory", msg.Message.Message)
+		}
+
+		err = extractArchive(archive.Bytes(), *extract, *force)
+		if err != nil && msg.Claims.Burn {
+			// The message has gone from the server, so keep the archive where it can be recovered.
+			saved, serr := saveArchive(archive.Bytes(), *extract)
+			if serr != nil {
+				return fmt.Errorf("%w; message %s was deleted from the server when it was read, and it couldn't be saved, so it has been lost: %w", err, msg.Message.Message, serr)
+			}
+			return fmt.Errorf("%w; message %s has been deleted from the server, so it was saved in %s", err, msg.Message.Message, saved)
+		}
+
+		return err
+	}
+
+	// The output file is written to a temporary file, which only replaces it once the message
+	// has been verified, so a failed get never destroys an existing file.
+	var target = os.Stdout
+	if *targetFilename != "" {
+		var err error
+		target, err = os.CreateTemp(filepath.Dir(*targetFilename), "."+filepath.Base(*targetFilename)+".*")
+		if err != nil {
+			return fmt.Errorf("unable to create output file %s: %w", *targetFilename, err)
+		}
+	}
+
+	defer target.Close()
+
+	// Key/value secrets have to be parsed before they're written.
+	var payload bytes.Buffer
+	var output io.Writer = target
+	if *format != FormatRaw || *key != "" {
+		output = &payload
+	}
+
+	msg, err := getMessage(config, endpoint, args[0], output)
+
+	var renderErr error
+	if err == nil && output == &payload {
+		var rendered bytes.Buffer
+		if renderErr = renderMessage(&rendered, msg, payload.Bytes(), *format, *key, *name); renderErr == nil {
+			_, err = target.Write(rendered.Bytes())
+		} else if !msg.Claims.Burn {
+			err = renderErr
+		} else if _, err = target.Write(payload.Bytes()); err == nil {
+			// The message has gone from the server, so rather than lose it, write it as it was sent.
+			renderErr = fmt.Errorf("%w; message %s has been deleted from the server, so it was written as it was sent", renderErr, msg.Message.Message)
+		}
+	}
+
+	if *targetFilename != "" {
+		if err == nil {
+			err = target.Close()
+		}
+
+		// Don't leave a partial secret lying around.
+		if err != nil {
+			_ = os.Remove(target.Name())
+			return err
+		}
+
+		if err = os.Rename(target.Name(), *targetFilename); err != nil {
+			return fmt.Errorf("message saved in %s, but it couldn't be renamed: %w", target.Name(), err)
+		}
 	}
 
-	claims, err := endpoint.GetClaims(config, message.Claims)
 	if err != nil {
-		return fmt.Errorf("unable to get claims: %w", err)
+		return err
+	}
+
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if msg.Claims.Burn {
+		fmt.Fprintf(os.Stderr, "message %s has been deleted from the server\n", msg.Message.Message)
+	}
+
+	if msg.Metadata.Kind == secrt.KindRequest {
+		fmt.Fprintf(os.Stderr, "%s is asking for a secret; send it with \"secrt reply %s [file]\"\n", msg.Sender, msg.Message.Message)
 	}
 
-	// Verify that the claimed public key matches the published public key
-	// for the given peer. The public key is cached, which results in the peer
-	// being added to the user's config, if it doesn't already exist.
-	// GetPeer is gated by AcceptPeers, so this stops an unknown peer's
-	// message from being readable. Note that the "ls" command doesn't do these
-	// checks.
-	peer, err := endpoint.GetPeer(config, claims.Alias)
+	return nil
+}
+
+// renderMessage writes a key/value secret in the given format, or the value of a single key.
+func renderMessage(target io.Writer, msg *received, payload []byte, format string, key string, name string) error {
+	kv, err := parseKV(payload, "", msg.Metadata)
 	if err != nil {
-		return fmt.Errorf("unable to get peer %s: %w", claims.Alias, err)
+		return fmt.Errorf("unable to parse message %s: %w", msg.Message.Message, err)
 	}
 
-	if !bytes.Equal(peer.PublicKey, claims.PublicKey) {
-		return fmt.Errorf("message claim does not match public key")
+	if key != "" {
+		i := slices.IndexFunc(kv, func(entry keyValue) bool { return entry.Name == key })
+		if i < 0 {
+			return fmt.Errorf("key %s not found in message %s", key, msg.Message.Message)
+		}
+
+		_, err = fmt.Fprintln(target, kv[i].Value)
+		return err
 	}
 
-	cleartext, err := endpoint.Decrypt(config, claims.PublicKey, message.Payload)
+	// Kubernetes names are derived from the filename, or the message ID.
+	if name == "" {
+		name = strings.ToLower(strings.TrimSuffix(msg.Metadata.Filename, filepath.Ext(msg.Metadata.Filename)))
+		name = strings.Trim(k8sInvalid.ReplaceAllString(name, "-"), "-")
+		if name == "" {
+			name = "secrt-" + msg.Message.Message.String()[:8]
+		}
+	}
+
+	return renderKV(target, kv, format, name)
+}
+
+// received is a message that has been downloaded and verified by getMessage.
+type received struct {
+	Message  *secrt.Message
+	Claims   *secrt.Claims
+	Metadata *secrt.Metadata
+	Sender   string // the verified alias of the sender
+}
+
+// getMessage downloads the message with the given ID, verifies its claims and sender, and writes the
+// decrypted payload to the target.
+func getMessage(config *Config, endpoint *Endpoint, id string, target io.Writer) (*received, error) {
+	var message secrt.Message
+	if err := Call(endpoint, jtp.Nil, &message, "GET", "message", id); err != nil {
+		return nil, fmt.Errorf("unable to get message %s: %w", id, err)
+	}
+
+	msg, err := verifyMessage(config, endpoint, &message)
 	if err != nil {
-		return fmt.Errorf("unable to decrypt message: %w", err)
+		return nil, err
+	}
+
+	if message.Streamed {
+		err = getStream(endpoint, msg.Claims, &message, target)
+	} else {
+		err = getPayload(endpoint, config, msg.Claims, &message, target)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// verifyMessage checks the claims of a message, and decrypts its metadata. The sender's alias in the
+// metadata is checked against the claims, and the sender's key against their pinned key.
+func verifyMessage(config *Config, endpoint *Endpoint, message *secrt.Message) (*received, error) {
+	claims, err := endpoint.GetClaims(config, message.Claims)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get claims: %w", err)
 	}
 
 	// Verify that the claim contains hashes that match the actual payload and metadata.
 	// Since the claim is signed by the server but the message data is sent by a peer,
 	// this is intended to ensure that server-generated claims can't be replayed.
-	payloadHash := sha256.Sum256(message.Payload)
-	if !bytes.Equal(payloadHash[:], claims.PayloadHash) {
-		return fmt.Errorf("payload claim does not match message payload")
-	}
-
 	metadataHash := sha256.Sum256(message.Metadata)
 	if !bytes.Equal(metadataHash[:], claims.MetadataHash) {
-		return fmt.Errorf("metadata claim does not match message metadata")
+		return nil, fmt.Errorf("metadata claim does not match message metadata")
 	}
 
-	var target = os.Stdout
-	if *targetFilename != "" {
-		target, err = os.OpenFile(*targetFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	// The sender's alias is in the metadata, and is checked against the hash in the claims.
+	metajs, err := endpoint.Decrypt(config, claims.PublicKey, message.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt metadata: %w", err)
+	}
+
+	var metadata secrt.Metadata
+	if err = json.Unmarshal(metajs, &metadata); err != nil {
+		return nil, fmt.Errorf("unable to parse metadata: %w", err)
+	}
+
+	sender, err := endpoint.GetSender(claims, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify sender: %w", err)
+	}
+
+	// Messages from the server itself (such as the welcome message) don't come from a peer.
+	if !endpoint.FromServer(claims) {
+		// Verify that the claimed public key matches the published public key
+		// for the given peer. The public key is cached, which results in the peer
+		// being added to the user's config, if it doesn't already exist.
+		// GetPeer is gated by AcceptPeers, so this stops an unknown peer's
+		// message from being readable. Note that the "ls" command doesn't do these
+		// checks.
+		peer, err := endpoint.GetPeer(config, sender)
 		if err != nil {
-			return fmt.Errorf("unable to open output file %s: %w", *targetFilename, err)
+			return nil, fmt.Errorf("unable to get peer %s: %w", sender, err)
+		}
+
+		// If the sender's key doesn't match the pinned key, the sender might have changed their key
+		// since we last saw it, or the message might have been sent before we accepted their new key.
+		if !bytes.Equal(peer.PublicKey, claims.PublicKey) && !peer.HadKey(claims.PublicKey, claims.Timestamp) {
+			if peer, err = endpoint.RefreshPeer(config, sender); err != nil {
+				return nil, fmt.Errorf("unable to check public key for %s: %w", sender, err)
+			}
+
+			if !bytes.Equal(peer.PublicKey, claims.PublicKey) {
+				return nil, fmt.Errorf("message claim does not match public key")
+			}
 		}
 	}
 
-	defer target.Close()
+	return &received{Message: message, Claims: claims, Metadata: &metadata, Sender: sender}, nil
+}
+
+// getPayload decrypts a payload that was sent with the message, and writes it to the target.
+func getPayload(endpoint *Endpoint, config *Config, claims *secrt.Claims, message *secrt.Message, target io.Writer) error {
+	payloadHash := sha256.Sum256(message.Payload)
+	if !bytes.Equal(payloadHash[:], claims.PayloadHash) {
+		return fmt.Errorf("payload claim does not match message payload")
+	}
+
+	cleartext, err := endpoint.Decrypt(config, claims.PublicKey, message.Payload)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt message: %w", err)
+	}
 
 	_, err = target.Write(cleartext)
+	return err
+}
+
+// getStream downloads a streamed payload, and decrypts it into the target as it arrives. Each
+// chunk is authenticated before it's written, but the payload claim can only be checked at the end,
+// so when the target is stdout, the payload has been printed by the time an error is returned.
+// Callers that need a verified payload should write to a buffer or a temporary file.
+func getStream(endpoint *Endpoint, claims *secrt.Claims, message *secrt.Message, target io.Writer) error {
+	id := message.Message.String()
+	body, err := Download(endpoint, "GET", "message", id, "stream")
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to get message %s: %w", id, err)
+	}
+
+	defer body.Close()
+
+	// Shared payloads were sent to several peers, and the key is sent separately.
+	hash := sha256.New()
+	var stream io.Reader
+	if len(message.PayloadKey) > 0 {
+		stream, err = endpoint.DecryptSharedStream(io.TeeReader(body, hash), message.PayloadKey, claims.PublicKey)
+	} else {
+		stream, err = endpoint.DecryptStream(io.TeeReader(body, hash), claims.PublicKey)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to decrypt message: %w", err)
+	}
+
+	if _, err = io.Copy(target, stream); err != nil {
+		return fmt.Errorf("unable to decrypt message: %w", err)
+	}
+
+	if !bytes.Equal(hash.Sum(nil), claims.PayloadHash) {
+		return fmt.Errorf("payload claim does not match message payload")
 	}
 
 	return nil
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/commandquery/secrt"
+)
+
+// groupRegexp matches the names of groups, which are used as @name in place of a peer ID.
+var groupRegexp = regexp.MustCompile(`^[A-Za-z0-9][-_.A-Za-z0-9]*$`)
+
+func CmdGroup(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secrt group {add | ls | rm}")
+	}
+
+	switch args[0] {
+	case "add":
+		return CmdGroupAdd(config, endpoint, args[1:])
+	case "rm":
+		return CmdGroupRm(config, endpoint, args[1:])
+	case "ls":
+		return CmdGroupLs(config, endpoint, args[1:])
+	default:
+		return fmt.Errorf("usage: secrt group {add | ls | rm}")
+	}
+}
+
+// CmdGroupAdd adds peers to a group, creating it if necessary. The peers are fetched with GetPeer,
+// so they're subject to AcceptPeers, just as they would be when sending to them.
+func CmdGroupAdd(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: secrt group add {name} {alias} ...")
+	}
+
+	name := strings.TrimPrefix(args[0], "@")
+	if !groupRegexp.MatchString(name) {
+		return fmt.Errorf("invalid group name %q", args[0])
+	}
+
+	members := endpoint.Groups[name]
+	for _, alias := range args[1:] {
+		if !peerRegexp.MatchString(alias) {
+			return fmt.Errorf("invalid peer %q", alias)
+		}
+
+		if _, err := endpoint.GetPeer(config, alias); err != nil {
+			return fmt.Errorf("unable to get peer: %w", err)
+		}
+
+		if !slices.Contains(members, alias) {
+			members = append(members, alias)
+		}
+	}
+
+	if endpoint.Groups == nil {
+		endpoint.Groups = make(map[string][]string)
+	}
+
+	endpoint.Groups[name] = members
+	config.modified = true
+	return nil
+}
+
+// CmdGroupRm removes peers from a group, or the whole group if no peers are given. A group is
+// removed when its last member is.
+func CmdGroupRm(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secrt group rm {name} [alias ...]")
+	}
+
+	name := strings.TrimPrefix(args[0], "@")
+	members, ok := endpoint.Groups[name]
+	if !ok {
+		return fmt.Errorf("group %s not found", name)
+	}
+
+	for _, alias := range args[1:] {
+		i := slices.Index(members, alias)
+		if i < 0 {
+			return fmt.Errorf("%s isn't in group %s", alias, name)
+		}
+		members = slices.Delete(members, i, i+1)
+	}
+
+	if len(args) == 1 || len(members) == 0 {
+		delete(endpoint.Groups, name)
+	} else {
+		endpoint.Groups[name] = members
+	}
+
+	config.modified = true
+	return nil
+}
+
+// CmdGroupLs lists the groups and their members.
+func CmdGroupLs(config *Config, endpoint *Endpoint, args []string) error {
+	for _, name := range slices.Sorted(maps.Keys(endpoint.Groups)) {
+		fmt.Printf("@%s %s\n", name, strings.Join(endpoint.Groups[name], " "))
+	}
+	return nil
+}
+
+// isRecipient returns true if the argument is a peer ID, a group or a team. Since @name and team:name
+// are also valid filenames, they're only taken to be a group or team if there's no such file, so a
+// file that was meant to be sent is never mistaken for a recipient. "./@name" is always a file.
+func isRecipient(arg string) bool {
+	if peerRegexp.MatchString(arg) {
+		return true
+	}
+
+	name, ok := strings.CutPrefix(arg, "@")
+	if !ok {
+		name, ok = strings.CutPrefix(arg, secrt.TeamPrefix)
+	}
+
+	if !ok || !groupRegexp.MatchString(name) {
+		return false
+	}
+
+	_, err := os.Lstat(arg)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// ExpandRecipients replaces each group (@name) in a list of recipients with its members, and each
+// team (team:name) with its current members, apart from ourselves. New members of a team have to be
+// confirmed (see confirmTeam). Peers are only listed once, even if they're in several groups. The
+// returned map gives the team that each team member was chosen from, so the server can check that
+// they're still a member.
+func (endpoint *Endpoint) ExpandRecipients(config *Config, recipients []string) ([]string, map[string]string, error) {
+	var aliases []string
+	teams := make(map[string]string)
+
+	for _, recipient := range recipients {
+		members := []string{recipient}
+
+		if name, ok := strings.CutPrefix(recipient, "@"); ok {
+			if members, ok = endpoint.Groups[name]; !ok {
+				return nil, nil, fmt.Errorf("group %s not found", name)
+			}
+		}
+
+		if strings.HasPrefix(recipient, secrt.TeamPrefix) {
+			team, err := endpoint.GetTeam(recipient)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if err = endpoint.confirmTeam(config, team); err != nil {
+				return nil, nil, err
+			}
+
+			members = nil
+			for _, member := range team.Members {
+				if member.Peer != endpoint.Alias {
+					members = append(members, member.Peer)
+					teams[member.Peer] = team.Team
+				}
+			}
+		}
+
+		for _, alias := range members {
+			if !slices.Contains(aliases, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+
+	return aliases, teams, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIsRecipient(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"@file", "team:file"} {
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]bool{
+		"bob@example.com": true,
+		"@ops":            true,
+		"team:sre":        true,
+		"@file":           false,
+		"team:file":       false,
+		"./@ops":          false,
+		"@":               false,
+		"@../etc/passwd":  false,
+		"team:":           false,
+		"secret.txt":      false,
+	}
+
+	for arg, want := range tests {
+		if got := isRecipient(arg); got != want {
+			t.Errorf("%s: expected %v, got %v", arg, want, got)
+		}
+	}
+}
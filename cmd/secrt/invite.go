@@ -2,11 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
 )
 
+// CmdInvite asks the server to email an invitation to the given address. When the invitee
+// joins, neither of you is warned about the other being a new peer.
 func CmdInvite(config *Config, endpoint *Endpoint, args []string) error {
 
 	flags := flag.NewFlagSet("invite", flag.ContinueOnError)
@@ -19,5 +22,11 @@ func CmdInvite(config *Config, endpoint *Endpoint, args []string) error {
 		secrt.Usage("secret invite user@domain")
 	}
 
-	return Call(endpoint, jtp.Nil, jtp.Nil, "POST", "invite", args[0])
+	if err := Call(endpoint, jtp.Nil, jtp.Nil, "POST", "invite", args[0]); err != nil {
+		return fmt.Errorf("unable to invite %s: %w", args[0], err)
+	}
+
+	endpoint.ExpectPeer(secrt.AliasHash(endpoint.ServerKey, args[0]))
+	fmt.Printf("invited %s\n", args[0])
+	return nil
 }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/commandquery/secrt"
+)
+
+// Formats of key/value secrets. Secrets are read in dotenv, JSON or YAML format, and
+// "secrt get --format" writes them in JSON, or one of the output-only formats.
+const (
+	FormatDotenv  = "dotenv"
+	FormatJSON    = "json"
+	FormatYAML    = "yaml"
+	FormatRaw     = "raw"     // the payload, as it was sent
+	FormatExport  = "export"  // shell export lines
+	FormatEnvFile = "envfile" // a docker --env-file
+	FormatK8s     = "k8s"     // a Kubernetes Secret manifest
+)
+
+// envName matches the names of the variables in a key/value secret.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// k8sName matches the names of Kubernetes objects, and k8sInvalid matches the characters that
+// can't be used in them.
+var k8sName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+var k8sInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// keyValue is an entry in a key/value secret.
+type keyValue struct {
+	Name  string
+	Value string
+}
+
+// parseKV parses a key/value secret in the given format. If the format is empty, it's taken from the
+// content type in the metadata, or guessed from the payload.
+func parseKV(data []byte, format string, metadata *secrt.Metadata) ([]keyValue, error) {
+	if format == "" {
+		switch metadata.ContentType {
+		case secrt.ContentTypeDotenv:
+			format = FormatDotenv
+		case secrt.ContentTypeJSON:
+			format = FormatJSON
+		case secrt.ContentTypeYAML:
+			format = FormatYAML
+		default:
+			format = guessFormat(data)
+		}
+	}
+
+	switch format {
+	case FormatDotenv:
+		return parseDotenv(data)
+	case FormatJSON:
+		return parseJSONKV(data)
+	case FormatYAML:
+		return parseYAMLKV(data)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// guessFormat returns the format of a key/value secret that has no content type.
+func guessFormat(data []byte) string {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return FormatJSON
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, _, _ := strings.Cut(line, "=")
+		if envName.MatchString(strings.TrimSpace(strings.TrimPrefix(name, "export "))) {
+			return FormatDotenv
+		}
+
+		return FormatYAML
+	}
+
+	return FormatDotenv
+}
+
+// env returns the entries in the form used by exec.Cmd.Env.
+func env(kv []keyValue) []string {
+	result := make([]string, 0, len(kv))
+	for _, entry := range kv {
+		result = append(result, entry.Name+"="+entry.Value)
+	}
+	return result
+}
+
+// parseDotenv parses NAME=value lines. Blank lines and comments are ignored, and "export" is allowed
+// before the name. Values can be quoted: single-quoted values are used as-is, and double-quoted
+// values can contain \n, \", and \\ escapes.
+func parseDotenv(data []byte) ([]keyValue, error) {
+	return parseLines(data, "=", "expected NAME=value", dotenvValue)
+}
+
+// parseYAMLKV parses the "NAME: value" lines of a flat YAML mapping. Nested values aren't supported.
+func parseYAMLKV(data []byte) ([]keyValue, error) {
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return nil, fmt.Errorf("line %d: nested values aren't supported", n+1)
+		}
+	}
+
+	return parseLines(data, ":", "expected NAME: value", yamlValue)
+}
+
+func parseLines(data []byte, separator string, expected string, unquote func(string) (string, error)) ([]keyValue, error) {
+	var kv []keyValue
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, separator)
+		name = strings.TrimSpace(name)
+		if !ok || !envName.MatchString(name) {
+			return nil, fmt.Errorf("line %d: %s", n, expected)
+		}
+
+		value, err := unquote(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		kv = append(kv, keyValue{Name: name, Value: value})
+	}
+
+	return kv, scanner.Err()
+}
+
+// dotenvValue removes the quotes from a value. Unquoted values end at a comment.
+func dotenvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '\'':
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quote")
+		}
+		return value[1 : end+1], nil
+
+	case '"':
+		var result strings.Builder
+		for i := 1; i < len(value); i++ {
+			switch c := value[i]; c {
+			case '"':
+				return result.String(), nil
+			case '\\':
+				i++
+				if i == len(value) {
+					return "", fmt.Errorf("unterminated quote")
+				}
+				switch value[i] {
+				case 'n':
+					result.WriteByte('\n')
+				case 't':
+					result.WriteByte('\t')
+				default:
+					result.WriteByte(value[i])
+				}
+			default:
+				result.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated quote")
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+
+	return value, nil
+}
+
+// yamlValue is like dotenvValue, except that a quote in a single-quoted value is doubled.
+// Block scalars, flow collections, anchors and aliases aren't supported.
+func yamlValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if strings.ContainsRune("|>[{&*", rune(value[0])) {
+		return "", fmt.Errorf("only plain and quoted values are supported")
+	}
+
+	if value[0] != '\'' {
+		return dotenvValue(value)
+	}
+
+	var result strings.Builder
+	for i := 1; i < len(value); i++ {
+		if value[i] == '\'' {
+			if i+1 < len(value) && value[i+1] == '\'' {
+				result.WriteByte('\'')
+				i++
+				continue
+			}
+			return result.String(), nil
+		}
+		result.WriteByte(value[i])
+	}
+
+	return "", fmt.Errorf("unterminated quote")
+}
+
+// parseJSONKV parses a JSON object. Numbers and booleans are converted to strings. Nested objects
+// and arrays aren't allowed.
+func parseJSONKV(data []byte) ([]keyValue, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	var kv []keyValue
+	for _, name := range slices.Sorted(maps.Keys(object)) {
+		raw := object[name]
+		if !envName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name %q", name)
+		}
+
+		var value any
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case string:
+			kv = append(kv, keyValue{Name: name, Value: v})
+		case float64, bool:
+			kv = append(kv, keyValue{Name: name, Value: string(raw)})
+		case nil:
+			kv = append(kv, keyValue{Name: name})
+		default:
+			return nil, fmt.Errorf("value of %s must be a string, number or boolean", name)
+		}
+	}
+
+	return kv, nil
+}
+
+// marshalKV returns the entries as a JSON object.
+func marshalKV(kv []keyValue) ([]byte, error) {
+	object := make(map[string]string, len(kv))
+	for _, entry := range kv {
+		object[entry.Name] = entry.Value
+	}
+
+	return json.Marshal(object)
+}
+
+// kvInput returns the entries as a JSON payload.
+func kvInput(kv []keyValue) (io.ReadSeekCloser, *secrt.Metadata, error) {
+	payload, err := marshalKV(kv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := &secrt.Metadata{Size: len(payload), ContentType: secrt.ContentTypeJSON}
+	return memoryInput{bytes.NewReader(payload)}, metadata, nil
+}
+
+// contentType returns the content type of a key/value file, based on its name, or "" if it
+// isn't one.
+func contentType(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".env":
+		return secrt.ContentTypeDotenv
+	case ".json":
+		return secrt.ContentTypeJSON
+	case ".yaml", ".yml":
+		return secrt.ContentTypeYAML
+	}
+
+	return ""
+}
+
+// renderKV writes the entries in the given output format. name is the name of a Kubernetes Secret.
+func renderKV(w io.Writer, kv []keyValue, format string, name string) error {
+	switch format {
+	case FormatExport:
+		for _, entry := range kv {
+			// Single quotes protect everything except single quotes.
+			fmt.Fprintf(w, "export %s='%s'\n", entry.Name, strings.ReplaceAll(entry.Value, "'", `'\''`))
+		}
+
+	case FormatEnvFile:
+		// Docker reads values literally, up to the end of the line.
+		for _, entry := range kv {
+			if strings.ContainsAny(entry.Value, "\r\n") {
+				return fmt.Errorf("the value of %s contains a newline, which can't be used in an env file", entry.Name)
+			}
+			fmt.Fprintf(w, "%s=%s\n", entry.Name, entry.Value)
+		}
+
+	case FormatK8s:
+		if err := checkK8sName(name); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: %s\ntype: Opaque\ndata:\n", name)
+		for _, entry := range kv {
+			fmt.Fprintf(w, "  %s: %s\n", entry.Name, base64.StdEncoding.EncodeToString([]byte(entry.Value)))
+		}
+
+	case FormatJSON:
+		js, err := marshalKV(kv)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", js)
+
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	return nil
+}
+
+// checkK8sName returns an error if name can't be used as the name of a Kubernetes Secret.
+func checkK8sName(name string) error {
+	if !k8sName.MatchString(name) || len(name) > 253 {
+		return fmt.Errorf("invalid Kubernetes name %q", name)
+	}
+	return nil
+}
+
+// kvFlag collects NAME=value flags.
+type kvFlag []keyValue
+
+func (f *kvFlag) String() string {
+	return fmt.Sprintf("%d values", len(*f))
+}
+
+func (f *kvFlag) Set(value string) error {
+	name, value, ok := strings.Cut(value, "=")
+	if !ok || !envName.MatchString(name) {
+		return fmt.Errorf("expected NAME=value")
+	}
+
+	*f = append(*f, keyValue{Name: name, Value: value})
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []keyValue
+		err   bool
+	}{
+		{input: "A=1\nB=two", want: []keyValue{{"A", "1"}, {"B", "two"}}},
+		{input: "# comment\n\nexport A=1", want: []keyValue{{"A", "1"}}},
+		{input: "A = spaced ", want: []keyValue{{"A", "spaced"}}},
+		{input: "A=value # comment", want: []keyValue{{"A", "value"}}},
+		{input: "A=value#not-a-comment", want: []keyValue{{"A", "value#not-a-comment"}}},
+		{input: "A=", want: []keyValue{{"A", ""}}},
+		{input: `A='it''s'`, want: []keyValue{{"A", "it"}}},
+		{input: `A='a\nb # c'`, want: []keyValue{{"A", `a\nb # c`}}},
+		{input: `A="a\nb\t\"c\"\\"`, want: []keyValue{{"A", "a\nb\t\"c\"\\"}}},
+		{input: `A="a=b" # comment`, want: []keyValue{{"A", "a=b"}}},
+		{input: `A="unterminated`, err: true},
+		{input: `A="unterminated\"`, err: true},
+		{input: `A='unterminated`, err: true},
+		{input: "no equals", err: true},
+		{input: "1A=1", err: true},
+		{input: "A-B=1", err: true},
+	}
+
+	for _, test := range tests {
+		kv, err := parseDotenv([]byte(test.input))
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.input, kv)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+		} else if !slices.Equal(kv, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.input, test.want, kv)
+		}
+	}
+}
+
+func TestYAMLValue(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   bool
+	}{
+		{input: "", want: ""},
+		{input: "plain", want: "plain"},
+		{input: "plain # comment", want: "plain"},
+		{input: "'single'", want: "single"},
+		{input: "'it''s'", want: "it's"},
+		{input: "''''", want: "'"},
+		{input: `'a\n'`, want: `a\n`},
+		{input: `"a\nb"`, want: "a\nb"},
+		{input: "'unterminated", err: true},
+		{input: "'unterminated''", err: true},
+		{input: "|", err: true},
+		{input: ">", err: true},
+		{input: "[1, 2]", err: true},
+		{input: "{a: 1}", err: true},
+		{input: "&anchor value", err: true},
+		{input: "*alias", err: true},
+	}
+
+	for _, test := range tests {
+		value, err := yamlValue(test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.input, value)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+		} else if value != test.want {
+			t.Errorf("%q: expected %q, got %q", test.input, test.want, value)
+		}
+	}
+}
+
+func TestParseJSONKV(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []keyValue
+		err   bool
+	}{
+		{input: `{}`, want: nil},
+		{input: `{"B": "two", "A": "one"}`, want: []keyValue{{"A", "one"}, {"B", "two"}}},
+		{input: `{"N": 1.50, "T": true, "Z": null}`, want: []keyValue{{"N", "1.50"}, {"T", "true"}, {"Z", ""}}},
+		{input: `{"A": "line\nbreak"}`, want: []keyValue{{"A", "line\nbreak"}}},
+		{input: `{"A": {"B": "c"}}`, err: true},
+		{input: `{"A": ["b"]}`, err: true},
+		{input: `{"not valid": "x"}`, err: true},
+		{input: `["A"]`, err: true},
+		{input: `{"A": `, err: true},
+	}
+
+	for _, test := range tests {
+		kv, err := parseJSONKV([]byte(test.input))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.input, kv)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+		} else if !slices.Equal(kv, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.input, test.want, kv)
+		}
+	}
+}
+
+func TestRenderKV(t *testing.T) {
+	tests := []struct {
+		kv     []keyValue
+		format string
+		name   string
+		want   string
+		err    bool
+	}{
+		{
+			kv:     []keyValue{{"A", "plain"}, {"B", "it's $HOME `x` \"y\""}},
+			format: FormatExport,
+			want:   "export A='plain'\nexport B='it'\\''s $HOME `x` \"y\"'\n",
+		},
+		{
+			kv:     []keyValue{{"A", "multi\nline"}},
+			format: FormatExport,
+			want:   "export A='multi\nline'\n",
+		},
+		{
+			kv:     []keyValue{{"A", "a b 'c' \"d\" # e"}},
+			format: FormatEnvFile,
+			want:   "A=a b 'c' \"d\" # e\n",
+		},
+		{
+			kv:     []keyValue{{"A", "multi\nline"}},
+			format: FormatEnvFile,
+			err:    true,
+		},
+		{
+			kv:     []keyValue{{"A", "carriage\rreturn"}},
+			format: FormatEnvFile,
+			err:    true,
+		},
+		{
+			kv:     []keyValue{{"A", "multi\nline"}},
+			format: FormatK8s,
+			name:   "my-secret",
+			want:   "apiVersion: v1\nkind: Secret\nmetadata:\n  name: my-secret\ntype: Opaque\ndata:\n  A: bXVsdGkKbGluZQ==\n",
+		},
+		{
+			kv:     []keyValue{{"A", "x"}},
+			format: FormatK8s,
+			name:   "My_Secret",
+			err:    true,
+		},
+		{
+			kv:     []keyValue{{"A", "x"}},
+			format: FormatK8s,
+			name:   "secret\nkind: ConfigMap",
+			err:    true,
+		},
+		{
+			kv:     []keyValue{{"A", "x"}},
+			format: FormatK8s,
+			name:   strings.Repeat("a", 254),
+			err:    true,
+		},
+		{
+			kv:     []keyValue{{"B", "\"quoted\"\n"}, {"A", "1"}},
+			format: FormatJSON,
+			want:   "{\"A\":\"1\",\"B\":\"\\\"quoted\\\"\\n\"}\n",
+		},
+		{
+			kv:     []keyValue{{"A", "x"}},
+			format: FormatRaw,
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		err := renderKV(&output, test.kv, test.format, test.name)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s %v: expected an error, got %q", test.format, test.kv, output.String())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %v: %v", test.format, test.kv, err)
+		} else if output.String() != test.want {
+			t.Errorf("%s %v: expected %q, got %q", test.format, test.kv, test.want, output.String())
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	secrt "github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
 )
 
 // We use the inbox message and metadata to generate a List entry which is then
@@ -17,11 +18,23 @@ import (
 type lsEntry struct {
 	ID              string
 	Timestamp       time.Time
+	Expires         time.Time `json:",omitzero"`
 	Sender          string
 	Filename        string
 	Description     string
 	FileDescription string
 	Size            int
+	Burn            bool
+	Notice          bool      `json:",omitzero"` // sent by the server, rather than a peer
+	Kind            string    `json:",omitzero"` // secrt.KindRequest or secrt.KindReply
+	Request         uuid.UUID `json:",omitzero"` // the ID of the request, for requests and their replies
+	InReplyTo       uuid.UUID `json:",omitzero"` // the message a reply answers
+}
+
+// lsOutput is the output of "ls --json".
+type lsOutput struct {
+	Messages []*lsEntry
+	Requests []*Request // requests we've sent, and their replies
 }
 
 // CmdLs lists the secrets waiting on the server.
@@ -40,13 +53,21 @@ func CmdLs(config *Config, endpoint *Endpoint, args []string) error {
 		return err
 	}
 
+	entries := make([]*lsEntry, 0, len(inbox.Messages))
+	for _, msg := range inbox.Messages {
+		entries = append(entries, getLsEntry(config, endpoint, &msg))
+	}
+
+	endpoint.matchReplies(config, entries)
+
 	if *jsFormat {
-		return printJSInbox(config, endpoint, inbox)
+		return json.NewEncoder(os.Stdout).Encode(&lsOutput{Messages: entries, Requests: endpoint.Requests})
 	}
 
 	// If longformat was requested.
 	if *longFormat {
-		printLongInbox(config, endpoint, inbox)
+		printLongInbox(entries)
+		printRequests(endpoint.Requests, true)
 		return nil
 	}
 
@@ -56,13 +77,15 @@ func CmdLs(config *Config, endpoint *Endpoint, args []string) error {
 	for _, msg := range inbox.Messages {
 		prefix := msg.Message.String()[:8]
 		if prefixMap[prefix] {
-			printLongInbox(config, endpoint, inbox)
+			printLongInbox(entries)
+			printRequests(endpoint.Requests, true)
 			return nil
 		}
 		prefixMap[prefix] = true
 	}
 
-	printShortInbox(config, endpoint, inbox)
+	printShortInbox(entries)
+	printRequests(endpoint.Requests, false)
 	return nil
 }
 
@@ -74,6 +97,11 @@ func getLsEntry(config *Config, endpoint *Endpoint, msg *secrt.Message) *lsEntry
 		Sender:          msg.Sender,
 		FileDescription: "",
 		Size:            msg.Size,
+		Burn:            msg.Burn,
+	}
+
+	if msg.Expiry != 0 {
+		entry.Expires = time.Unix(msg.Expiry, 0).Local()
 	}
 
 	var metadata secrt.Metadata
@@ -97,7 +125,18 @@ func getLsEntry(config *Config, endpoint *Endpoint, msg *secrt.Message) *lsEntry
 	entry.Size = metadata.Size
 	entry.Filename = metadata.Filename
 	entry.Description = metadata.Description
-	entry.Sender = claims.Alias
+	entry.Kind = metadata.Kind
+	entry.Request = metadata.Request
+	entry.InReplyTo = metadata.InReplyTo
+
+	if entry.Sender, err = endpoint.GetSender(claims, &metadata); err != nil {
+		entry.Sender = "(unverified sender)"
+	}
+
+	if endpoint.FromServer(claims) {
+		entry.Notice = true
+		entry.Sender = "(server notice)"
+	}
 
 	if metadata.Description != "" {
 		entry.FileDescription = fmt.Sprintf("%s (%s)", metadata.Filename, metadata.Description)
@@ -105,29 +144,28 @@ func getLsEntry(config *Config, endpoint *Endpoint, msg *secrt.Message) *lsEntry
 		entry.FileDescription = fmt.Sprintf("%s", metadata.Filename)
 	}
 
-	return entry
-}
-
-func printJSInbox(config *Config, endpoint *Endpoint, inbox secrt.Inbox) error {
-	lsEntries := make([]*lsEntry, 0, len(inbox.Messages))
+	switch metadata.Kind {
+	case secrt.KindRequest:
+		entry.FileDescription += " [request]"
+	case secrt.KindReply:
+		entry.FileDescription += fmt.Sprintf(" [reply to %s]", metadata.InReplyTo.String()[:8])
+	}
 
-	for _, msg := range inbox.Messages {
-		lsEntries = append(lsEntries, getLsEntry(config, endpoint, &msg))
+	if msg.Burn {
+		entry.FileDescription += " [burn after reading]"
 	}
 
-	return json.NewEncoder(os.Stdout).Encode(lsEntries)
+	return entry
 }
 
-func printShortInbox(config *Config, endpoint *Endpoint, inbox secrt.Inbox) {
+func printShortInbox(entries []*lsEntry) {
 
 	now := time.Now()
 	var ts string
 
 	fmt.Printf("%-8s %-24.24s %6s %-10s %s\n", "ID", "Peer", "Size", "Sent", "Description")
 
-	for _, msg := range inbox.Messages {
-		lsEntry := getLsEntry(config, endpoint, &msg)
-
+	for _, lsEntry := range entries {
 		if lsEntry.Timestamp.Year() == now.Year() && lsEntry.Timestamp.YearDay() == now.YearDay() {
 			ts = lsEntry.Timestamp.Format("15:04:05")
 		} else {
@@ -138,12 +176,34 @@ func printShortInbox(config *Config, endpoint *Endpoint, inbox secrt.Inbox) {
 	}
 }
 
-func printLongInbox(config *Config, endpoint *Endpoint, inbox secrt.Inbox) {
+func printLongInbox(entries []*lsEntry) {
 	fmt.Printf("%-36s %-24.24s %6s %-19s %s\n", "ID", "Peer", "Size", "Sent", "Description")
 
-	for _, msg := range inbox.Messages {
-		lsEntry := getLsEntry(config, endpoint, &msg)
+	for _, lsEntry := range entries {
 		ts := lsEntry.Timestamp.Format("2006-01-02 15:04:05")
 		fmt.Printf("%36s %-24.24s %6d %-19s %s\n", lsEntry.ID, lsEntry.Sender, lsEntry.Size, ts, lsEntry.FileDescription)
 	}
 }
+
+// printRequests lists the requests we've sent, and whether they've been fulfilled.
+func printRequests(requests []*Request, long bool) {
+	if len(requests) == 0 {
+		return
+	}
+
+	width := 8
+	if long {
+		width = 36
+	}
+
+	fmt.Printf("\n%-*s %-24.24s %-*s %s\n", width, "Request", "Peer", width+8, "Status", "Description")
+
+	for _, request := range requests {
+		status := "pending"
+		if request.Reply != uuid.Nil {
+			status = "replied " + request.Reply.String()[:width]
+		}
+
+		fmt.Printf("%-*s %-24.24s %-*s %s\n", width, request.Message.String()[:width], request.Peer, width+8, status, request.Description)
+	}
+}
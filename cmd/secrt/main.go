@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/commandquery/secrt"
 )
@@ -73,6 +75,11 @@ func main() {
 		return
 	}
 
+	// Tokens expire, so commands that talk to the server rotate the token from time to time.
+	if slices.Contains([]string{"send", "ls", "get", "peer", "group", "team", "rm", "invite", "run", "request", "reply"}, command) {
+		endpoint.RotateToken(config)
+	}
+
 	switch command {
 	case "enrol":
 		err = CmdEnrol(config, args)
@@ -89,6 +96,18 @@ func main() {
 			err = config.Save()
 		}
 
+	case "request":
+		err = CmdRequest(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
+	case "reply":
+		err = CmdReply(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
 	case "ls":
 		err = CmdLs(config, endpoint, args)
 		if err == nil {
@@ -107,14 +126,44 @@ func main() {
 			err = config.Save()
 		}
 
+	case "group":
+		err = CmdGroup(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
+	case "team":
+		err = CmdTeam(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
 	case "rm":
 		err = CmdRm(config, endpoint, args)
 
+	case "run":
+		err = CmdRun(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
+	case "watch":
+		err = CmdWatch(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
 	case "set":
 		if len(args) != 1 {
 			secrt.Usage()
 		}
 
+		// Notifications are a server-side setting.
+		if notify, ok := strings.CutPrefix(args[0], "notify="); ok {
+			err = CmdNotify(endpoint, notify)
+			break
+		}
+
 		err = config.Set(args[0])
 		if err == nil {
 			err = config.Save()
@@ -122,6 +171,9 @@ func main() {
 
 	case "invite":
 		err = CmdInvite(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
 
 	case "activate":
 		err = CmdActivate(config, endpoint, args)
@@ -129,6 +181,30 @@ func main() {
 			err = config.Save()
 		}
 
+	case "refresh":
+		err = CmdRefresh(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
+	case "vault":
+		err = CmdVault(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
+	case "rekey":
+		err = CmdRekey(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
+	case "logout":
+		err = CmdLogout(config, endpoint, args)
+		if err == nil {
+			err = config.Save()
+		}
+
 	case "genkey":
 		CmdGenKey()
 
@@ -145,5 +221,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	// "secrt run" exits with the status of the command it ran.
+	if code, ok := exitCode(err); ok {
+		_ = config.Save()
+		os.Exit(code)
+	}
+
 	secrt.Exit(1, err)
 }
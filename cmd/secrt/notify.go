@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// CmdNotify tells the server how to let us know about new messages. The setting is stored on
+// the server rather than in the config, so it applies to all our devices.
+func CmdNotify(endpoint *Endpoint, notify string) error {
+	request := &secrt.NotifyRequest{Notify: notify}
+	if notify == secrt.NotifyEmail {
+		request.Address = endpoint.Alias
+	}
+
+	if err := Call(endpoint, request, jtp.Nil, "POST", "notify"); err != nil {
+		return fmt.Errorf("unable to set notifications: %w", err)
+	}
+
+	switch notify {
+	case secrt.NotifyEmail:
+		fmt.Printf("new messages will be emailed to %s\n", endpoint.Alias)
+	case secrt.NotifyNone:
+		fmt.Println("notifications disabled")
+	}
+
+	return nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 )
 
 func CmdPeer(config *Config, endpoint *Endpoint, args []string) error {
 	if len(args) == 0 {
-		return fmt.Errorf("usage: secrt peer {add | ls | rm}")
+		return fmt.Errorf("usage: secrt peer {add | ls | rm | verify | accept-key}")
 	}
 
 	switch args[0] {
@@ -17,8 +22,12 @@ func CmdPeer(config *Config, endpoint *Endpoint, args []string) error {
 		return CmdPeerRm(config, endpoint, args[1:])
 	case "ls":
 		return CmdPeerLs(config, endpoint, args[1:])
+	case "verify":
+		return CmdPeerVerify(config, endpoint, args[1:])
+	case "accept-key":
+		return CmdPeerAcceptKey(config, endpoint, args[1:])
 	default:
-		return fmt.Errorf("usage: secrt peer {add | ls | rm}")
+		return fmt.Errorf("usage: secrt peer {add | ls | rm | verify | accept-key}")
 	}
 }
 
@@ -56,7 +65,201 @@ func CmdPeerRm(config *Config, endpoint *Endpoint, args []string) error {
 func CmdPeerLs(config *Config, endpoint *Endpoint, args []string) error {
 	for email, peer := range endpoint.Peers {
 		p64 := base64.StdEncoding.EncodeToString(peer.PublicKey)
-		fmt.Println(email, p64)
+		fmt.Println(email, p64, peer.Status())
 	}
 	return nil
 }
+
+// CmdPeerVerify displays the safety number for a peer, so the user can compare it with the number
+// shown on the peer's device. If the peer has a pending key change, the number is for the new key.
+// If the user confirms that the numbers match, the key is marked as verified (and accepted).
+//
+// The peer's number can also be given as an argument (spaces are ignored), in which case it's
+// compared without asking; this is how scripts verify a peer.
+func CmdPeerVerify(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("usage: secrt peer verify {alias} [number]")
+	}
+
+	alias := args[0]
+	peer, ok := endpoint.Peers[alias]
+	if !ok {
+		return fmt.Errorf("peer %s not found", alias)
+	}
+
+	key := peer.PublicKey
+	if peer.PendingKey != nil {
+		key = peer.PendingKey
+		fmt.Printf("%s's key has changed. This is the safety number for the new key.\n\n", alias)
+	}
+
+	number := SafetyNumber(endpoint.Alias, endpoint.PublicKey, alias, key)
+	fmt.Printf("Safety number for %s and %s:\n\n", endpoint.Alias, alias)
+	fmt.Println(number)
+
+	if len(args) == 2 {
+		if !sameSafetyNumber(number, args[1]) {
+			return fmt.Errorf("the safety number for %s doesn't match; the key might not belong to %s", alias, alias)
+		}
+	} else {
+		fmt.Printf("Compare it with the number shown by 'secrt peer verify %s' on %s's device.\n\n", endpoint.Alias, alias)
+
+		if !Confirm("Do the numbers match?") {
+			return nil
+		}
+	}
+
+	if peer.PendingKey != nil {
+		peer.replaceKey(peer.PendingKey, peer.PendingRotated)
+	}
+
+	peer.Verified = time.Now().Unix()
+	config.modified = true
+	fmt.Printf("%s is verified\n", alias)
+	return nil
+}
+
+// CmdPeerAcceptKey accepts a change to a peer's key. If no change is pending, the key is fetched from
+// the server, in case it has changed. The new key isn't verified, even if the server says the peer
+// rotated it, since only the user can decide to trust it.
+func CmdPeerAcceptKey(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: secrt peer accept-key {alias}")
+	}
+
+	alias := args[0]
+	peer, ok := endpoint.Peers[alias]
+	if !ok {
+		return fmt.Errorf("peer %s not found", alias)
+	}
+
+	if peer.PendingKey == nil {
+		peerResp, err := endpoint.fetchPeer(alias)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(peerResp.PublicKey, peer.PublicKey) {
+			return fmt.Errorf("the key for %s hasn't changed", alias)
+		}
+
+		peer.PendingKey = peerResp.PublicKey
+		peer.PendingRotated = reportedRotation(peer.PublicKey, peerResp)
+	}
+
+	peer.replaceKey(peer.PendingKey, peer.PendingRotated)
+	config.modified = true
+
+	fmt.Fprintf(os.Stderr, "accepted the new key for %s; use 'secrt peer verify %s' to verify it\n", alias, alias)
+	return nil
+}
+
+// Status describes how far the peer's key is trusted.
+func (peer *Peer) Status() string {
+	switch {
+	case peer.PendingKey != nil && peer.PendingRotated:
+		return "key-rotated"
+	case peer.PendingKey != nil:
+		return "key-changed"
+	case peer.Verified != 0:
+		return "verified"
+	default:
+		return "unverified"
+	}
+}
+
+// HadKey returns true if the peer was using the given key when a message was sent at the given
+// time (a Unix timestamp). Keys we've replaced aren't accepted for messages sent after that.
+func (peer *Peer) HadKey(key []byte, sent int64) bool {
+	for _, previous := range peer.PreviousKeys {
+		if bytes.Equal(previous.PublicKey, key) && sent <= previous.Replaced {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceKey makes key the peer's current key, and resets its verification status. rotated records
+// that the server said the peer rotated the old key.
+func (peer *Peer) replaceKey(key []byte, rotated bool) {
+	now := time.Now().Unix()
+
+	peer.PreviousKeys = append(peer.PreviousKeys, PeerKey{
+		PublicKey: peer.PublicKey,
+		Replaced:  now,
+		Rotated:   rotated,
+	})
+
+	peer.PublicKey = key
+	peer.PendingKey = nil
+	peer.PendingRotated = false
+	peer.FirstSeen = now
+	peer.Verified = 0
+}
+
+func (peer *Peer) keyChangedError() error {
+	if peer.PendingRotated {
+		return fmt.Errorf("%w: the server says %s rotated their key, but it can't prove it. Compare safety numbers using 'secrt peer verify %s', or accept the new key with 'secrt peer accept-key %s'",
+			ErrPeerKeyChanged, peer.Alias, peer.Alias, peer.Alias)
+	}
+
+	return fmt.Errorf("%w: %s. Compare safety numbers using 'secrt peer verify %s', or accept the new key with 'secrt peer accept-key %s'",
+		ErrPeerKeyChanged, peer.Alias, peer.Alias, peer.Alias)
+}
+
+// SafetyNumber returns a number that two peers can compare, e.g. over the phone, to check that each
+// has the other's key. Both peers compute the same number.
+func SafetyNumber(aliasA string, keyA []byte, aliasB string, keyB []byte) string {
+	a := fingerprint(aliasA, keyA)
+	b := fingerprint(aliasB, keyB)
+	if a > b {
+		a, b = b, a
+	}
+
+	// 60 digits, in three rows of four groups of five digits.
+	digits := a + b
+	var sb strings.Builder
+	for i := 0; i < len(digits); i += 5 {
+		if i%20 == 0 {
+			sb.WriteString("    ")
+		}
+
+		sb.WriteString(digits[i : i+5])
+
+		if i%20 == 15 {
+			sb.WriteString("\n")
+		} else {
+			sb.WriteString(" ")
+		}
+	}
+
+	return sb.String()
+}
+
+// sameSafetyNumber returns true if a safety number typed by the user matches the expected number.
+// Whitespace is ignored, since the number is displayed in groups.
+func sameSafetyNumber(expected string, typed string) bool {
+	return strings.Join(strings.Fields(expected), "") == strings.Join(strings.Fields(typed), "")
+}
+
+// fingerprint returns 30 decimal digits derived from an alias and a public key.
+func fingerprint(alias string, key []byte) string {
+	hash := sha512.New()
+	hash.Write([]byte("secrt fingerprint\x00"))
+	hash.Write([]byte(strings.ToLower(alias)))
+	hash.Write([]byte{0})
+	hash.Write(key)
+	sum := hash.Sum(nil)
+
+	// Each 5 byte chunk of the hash becomes 5 digits.
+	var sb strings.Builder
+	for i := 0; i < 30; i += 5 {
+		var chunk uint64
+		for _, b := range sum[i : i+5] {
+			chunk = chunk<<8 | uint64(b)
+		}
+		fmt.Fprintf(&sb, "%05d", chunk%100000)
+	}
+
+	return sb.String()
+}
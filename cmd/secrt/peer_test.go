@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func newKey(t *testing.T) (public []byte, private []byte) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub[:], priv[:]
+}
+
+func TestSafetyNumber(t *testing.T) {
+	aliceKey, _ := newKey(t)
+	bobKey, _ := newKey(t)
+
+	number := SafetyNumber("alice@example.com", aliceKey, "bob@example.com", bobKey)
+	if number != SafetyNumber("bob@example.com", bobKey, "alice@example.com", aliceKey) {
+		t.Error("peers see different safety numbers")
+	}
+
+	if digits := strings.Join(strings.Fields(number), ""); len(digits) != 60 {
+		t.Errorf("expected 60 digits, got %q", digits)
+	}
+
+	otherKey, _ := newKey(t)
+	if number == SafetyNumber("alice@example.com", aliceKey, "bob@example.com", otherKey) {
+		t.Error("safety number doesn't depend on the key")
+	}
+
+	if !sameSafetyNumber(number, strings.ReplaceAll(number, " ", "")) {
+		t.Error("spacing should be ignored")
+	}
+}
+
+func testEndpoint(t *testing.T) (*Endpoint, *Peer) {
+	publicKey, _ := newKey(t)
+	peerKey, _ := newKey(t)
+	peer := &Peer{Alias: "bob@example.com", PublicKey: peerKey}
+
+	return &Endpoint{
+		Alias:     "alice@example.com",
+		PublicKey: publicKey,
+		Peers:     map[string]*Peer{peer.Alias: peer},
+	}, peer
+}
+
+func TestPeerVerify(t *testing.T) {
+	config := &Config{}
+	endpoint, peer := testEndpoint(t)
+
+	if err := CmdPeerVerify(config, endpoint, []string{peer.Alias, strings.Repeat("1", 60)}); err == nil {
+		t.Fatal("expected the wrong number to be rejected")
+	}
+
+	if peer.Verified != 0 {
+		t.Fatal("peer was verified with the wrong number")
+	}
+
+	number := SafetyNumber(peer.Alias, peer.PublicKey, endpoint.Alias, endpoint.PublicKey)
+	if err := CmdPeerVerify(config, endpoint, []string{peer.Alias, number}); err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Verified == 0 || !config.modified {
+		t.Fatal("peer wasn't verified")
+	}
+
+	// Verifying a pending key accepts it.
+	pendingKey, _ := newKey(t)
+	peer.PendingKey = pendingKey
+	number = SafetyNumber(peer.Alias, pendingKey, endpoint.Alias, endpoint.PublicKey)
+	if err := CmdPeerVerify(config, endpoint, []string{peer.Alias, number}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(peer.PublicKey, pendingKey) || peer.PendingKey != nil || peer.Verified == 0 {
+		t.Fatalf("pending key wasn't accepted: %+v", peer)
+	}
+}
+
+func TestPeerAcceptKey(t *testing.T) {
+	config := &Config{}
+	endpoint, peer := testEndpoint(t)
+	oldKey := peer.PublicKey
+	peer.Verified = time.Now().Unix()
+
+	pendingKey, _ := newKey(t)
+	peer.PendingKey = pendingKey
+	peer.PendingRotated = true
+
+	if _, err := endpoint.GetPeer(config, peer.Alias); !errors.Is(err, ErrPeerKeyChanged) {
+		t.Fatalf("expected key changed error, got %v", err)
+	}
+
+	if err := CmdPeerAcceptKey(config, endpoint, []string{peer.Alias}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(peer.PublicKey, pendingKey) || peer.PendingKey != nil || peer.Verified != 0 {
+		t.Fatalf("expected the new key to be accepted, unverified: %+v", peer)
+	}
+
+	if len(peer.PreviousKeys) != 1 || !bytes.Equal(peer.PreviousKeys[0].PublicKey, oldKey) || !peer.PreviousKeys[0].Rotated {
+		t.Fatalf("expected the old key to be kept: %+v", peer.PreviousKeys)
+	}
+
+	// The old key is only accepted for messages sent before it was replaced.
+	replaced := peer.PreviousKeys[0].Replaced
+	if !peer.HadKey(oldKey, replaced-60) {
+		t.Error("old key should be accepted for older messages")
+	}
+
+	if peer.HadKey(oldKey, replaced+60) {
+		t.Error("old key should be rejected for newer messages")
+	}
+}
+
+func TestReportedRotation(t *testing.T) {
+	key1, _ := newKey(t)
+	key2, _ := newKey(t)
+	key3, _ := newKey(t)
+
+	peer := &secrt.Peer{
+		PublicKey:    key3,
+		PreviousKeys: []secrt.PeerKey{{PublicKey: key1}, {PublicKey: key2}},
+	}
+
+	if !reportedRotation(key1, peer) || !reportedRotation(key2, peer) {
+		t.Error("expected a reported rotation")
+	}
+
+	unknownKey, _ := newKey(t)
+	if reportedRotation(unknownKey, peer) {
+		t.Error("a key that the server didn't list was reported as rotated")
+	}
+}
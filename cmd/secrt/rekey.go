@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// CmdRekey replaces the endpoint's key pair. The server is sent proof that we hold both the old and
+// the new private keys, and it keeps a record of the old key so that peers can tell the key was
+// rotated. Peers still have to accept the new key with "secrt peer accept-key".
+//
+// Messages that are waiting in the inbox were encrypted for the old key, and can't be read once
+// the key is replaced, so rekey refuses to run unless the inbox is empty or --force is given.
+//
+// The new private key is saved in every vault before the server is told about it, and only
+// replaces the old key once the server has accepted it. If the rotation is interrupted after
+// that, running rekey again finishes it.
+func CmdRekey(config *Config, endpoint *Endpoint, args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	force := flags.Bool("force", false, "replace the key even if there are unread messages")
+	if err := flags.Parse(args); err != nil {
+		secrt.Usage("secrt rekey [--force]")
+	}
+
+	if flags.NArg() != 0 {
+		secrt.Usage("secrt rekey [--force]")
+	}
+
+	finished, err := endpoint.resumeRekey(config)
+	if err != nil || finished {
+		return err
+	}
+
+	if !*force {
+		var inbox secrt.Inbox
+		err := Call(endpoint, jtp.Nil, &inbox, "GET", "inbox")
+		if err != nil && !errors.Is(err, jtp.ErrNoContent) {
+			return fmt.Errorf("unable to check inbox: %w", err)
+		}
+
+		if len(inbox.Messages) > 0 {
+			return fmt.Errorf("you have %d unread messages, which can't be read after the key is replaced; read them first, or use --force", len(inbox.Messages))
+		}
+	}
+
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	// Save the new key before the server is told about it, so it can't be lost.
+	if err = endpoint.SetSecretValue(newPrivateKey, private[:]); err != nil {
+		return fmt.Errorf("unable to store new private key: %w", err)
+	}
+
+	config.modified = true
+	if err = config.Save(); err != nil {
+		return fmt.Errorf("unable to store new private key: %w", err)
+	}
+
+	proof, err := json.Marshal(&secrt.RekeyProof{
+		PublicKey: public[:],
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to marshal proof: %w", err)
+	}
+
+	request := &secrt.RekeyRequest{PublicKey: public[:]}
+
+	if request.TeamKeys, err = endpoint.resealTeamKeys(public[:]); err != nil {
+		return err
+	}
+
+	if request.OldKeyProof, err = endpoint.Encrypt(proof, endpoint.ServerKey); err != nil {
+		return fmt.Errorf("unable to seal proof: %w", err)
+	}
+
+	if request.NewKeyProof, err = seal(proof, endpoint.ServerKey, private[:]); err != nil {
+		return fmt.Errorf("unable to seal proof: %w", err)
+	}
+
+	if err = Call(endpoint, request, &secrt.Peer{}, "POST", "rekey"); err != nil {
+		return fmt.Errorf("unable to replace key: %w", err)
+	}
+
+	if err = endpoint.commitKey(config, public[:], private[:]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "your key has been replaced")
+	return nil
+}
+
+// resealTeamKeys returns the keys of our teams, sealed for the new public key, so that we can still
+// read the teams' aliases. Invitations we haven't accepted can't be resealed, since we can't see the
+// team until we've joined it.
+func (endpoint *Endpoint) resealTeamKeys(publicKey []byte) (map[string][]byte, error) {
+	var teams secrt.TeamList
+	if err := Call(endpoint, jtp.Nil, &teams, "GET", "team"); err != nil {
+		return nil, fmt.Errorf("unable to list teams: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(teams.Teams))
+	for _, name := range teams.Teams {
+		team, err := endpoint.GetTeam(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+
+		if keys[name], err = team.key.Seal(publicKey); err != nil {
+			return nil, fmt.Errorf("unable to seal team key for %s: %w", name, err)
+		}
+	}
+
+	for _, name := range teams.Invitations {
+		fmt.Fprintf(os.Stderr, "you'll need to be invited to %s again after your key is replaced\n", name)
+	}
+
+	return keys, nil
+}
+
+// newPrivateKey is the name of the vault value that holds a new private key until the server has
+// accepted it.
+const newPrivateKey = "newPrivateKey"
+
+// resumeRekey finishes a key rotation that was interrupted after the new key was saved. If the
+// server has the new key, it replaces the private key, and resumeRekey returns true. Otherwise,
+// the rotation never happened, and the new key is discarded.
+func (endpoint *Endpoint) resumeRekey(config *Config) (bool, error) {
+	private, err := endpoint.GetSecretValue(newPrivateKey)
+	if err != nil {
+		return false, fmt.Errorf("unable to read new private key: %w", err)
+	}
+
+	if len(private) == 0 {
+		return false, nil
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return false, fmt.Errorf("invalid new private key: %w", err)
+	}
+
+	var peer secrt.Peer
+	if err = Call(endpoint, jtp.Nil, &peer, "GET", "peer", endpoint.Alias); err != nil {
+		return false, fmt.Errorf("unable to check public key: %w", err)
+	}
+
+	if !bytes.Equal(peer.PublicKey, public) {
+		if err = endpoint.SetSecretValue(newPrivateKey, nil); err != nil {
+			return false, fmt.Errorf("unable to discard new private key: %w", err)
+		}
+		config.modified = true
+		return false, nil
+	}
+
+	if err = endpoint.commitKey(config, public, private); err != nil {
+		return false, err
+	}
+
+	fmt.Fprintln(os.Stderr, "an interrupted rekey has been finished; your key has been replaced")
+	return true, nil
+}
+
+// commitKey replaces the private key with the new key, once the server has accepted it.
+func (endpoint *Endpoint) commitKey(config *Config, public []byte, private []byte) error {
+	if err := endpoint.SetSecretValue("privateKey", private); err != nil {
+		return fmt.Errorf("the server has your new key, but it couldn't be stored (run secrt rekey again to finish): %w", err)
+	}
+
+	endpoint.PublicKey = public
+	config.modified = true
+
+	if err := endpoint.SetSecretValue(newPrivateKey, nil); err != nil {
+		return fmt.Errorf("unable to discard new private key: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+)
+
+// Request is a request for a secret that we've sent to a peer. Requests are kept until the peer's
+// reply has been removed from the inbox, or until the request expires without a reply.
+type Request struct {
+	ID          uuid.UUID `json:"id"`               // Request ID, which the peer copies into their reply
+	Peer        string    `json:"peer"`             // Alias of the peer that was asked
+	Message     uuid.UUID `json:"message"`          // ID of the request message
+	Description string    `json:"description"`      // What was asked for
+	Sent        int64     `json:"sent"`             // When the request was sent
+	Expires     int64     `json:"expires,omitzero"` // When the request message expires, after which it can't be answered
+	Reply       uuid.UUID `json:"reply,omitzero"`   // ID of the reply, once it has arrived
+}
+
+// CmdRequest asks peers to send a secret. The request is a message with no payload, which the
+// peers answer with "secrt reply".
+func CmdRequest(config *Config, endpoint *Endpoint, args []string) error {
+	usage := "secrt request -d description [--ttl duration] <peerID> ..."
+
+	flags := flag.NewFlagSet("request", flag.ContinueOnError)
+	description := flags.String("d", "", "describe the secret you need")
+	ttl := flags.Duration("ttl", 0, "delete the request after this long, even if it hasn't been read")
+
+	recipients, err := parseArgs(flags, args)
+	if err != nil || len(recipients) == 0 || *description == "" {
+		secrt.Usage(usage)
+	}
+
+	for _, recipient := range recipients {
+		if !isRecipient(recipient) {
+			return fmt.Errorf("invalid peer %q", recipient)
+		}
+	}
+
+	if *ttl < 0 {
+		return fmt.Errorf("invalid ttl: %s", *ttl)
+	}
+
+	metadata := &secrt.Metadata{
+		Description: *description,
+		Kind:        secrt.KindRequest,
+		Request:     uuid.New(),
+	}
+
+	// The request is recorded for each peer it was sent to, even if some couldn't be sent it.
+	aliases, responses, err := sendToRecipients(config, endpoint, memoryInput{bytes.NewReader(nil)}, metadata, recipients, *ttl, false)
+	for i, response := range responses {
+		endpoint.Requests = append(endpoint.Requests, &Request{
+			ID:          metadata.Request,
+			Peer:        aliases[i],
+			Message:     response.ID,
+			Description: *description,
+			Sent:        time.Now().Unix(),
+			Expires:     response.Expiry,
+		})
+	}
+
+	config.modified = true
+
+	reportSent(aliases, responses, *ttl)
+	return err
+}
+
+// CmdReply sends a secret to the sender of a message. If the message is a request, the reply
+// carries the request ID, so the sender can see that their request has been fulfilled.
+func CmdReply(config *Config, endpoint *Endpoint, args []string) error {
+	usage := "secrt reply [-d description] [--ttl duration] [--burn] [--kv NAME=value ...] <msgid> [file]"
+
+	flags := flag.NewFlagSet("reply", flag.ContinueOnError)
+	description := flags.String("d", "", "include a description (default: the description of the request)")
+	ttl := flags.Duration("ttl", 0, "delete the message after this long, even if it hasn't been read")
+	burn := flags.Bool("burn", false, "delete the message as soon as it's read")
+	var kv kvFlag
+	flags.Var(&kv, "kv", "send NAME=value as part of a key/value secret; can be repeated")
+
+	positional, err := parseArgs(flags, args)
+	if err != nil || len(positional) == 0 || len(positional) > 2 {
+		secrt.Usage(usage)
+	}
+
+	if *ttl < 0 {
+		return fmt.Errorf("invalid ttl: %s", *ttl)
+	}
+
+	message, err := findInboxMessage(endpoint, positional[0])
+	if err != nil {
+		return err
+	}
+
+	original, err := verifyMessage(config, endpoint, message)
+	if err != nil {
+		return err
+	}
+
+	if endpoint.FromServer(original.Claims) {
+		return fmt.Errorf("server notices can't be replied to")
+	}
+
+	var input io.ReadSeekCloser
+	var metadata *secrt.Metadata
+
+	switch {
+	case len(kv) > 0 && len(positional) > 1:
+		return fmt.Errorf("a file can't be sent with --kv")
+	case len(kv) > 0:
+		input, metadata, err = kvInput(kv)
+	case len(positional) > 1:
+		input, metadata, err = openInput(positional[1])
+	default:
+		input, metadata, err = openInput("")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer input.Close()
+
+	metadata.Description = *description
+	if metadata.Description == "" && original.Metadata.Kind == secrt.KindRequest {
+		metadata.Description = original.Metadata.Description
+	}
+
+	metadata.Kind = secrt.KindReply
+	metadata.InReplyTo = message.Message
+	metadata.Request = original.Metadata.Request
+
+	aliases, responses, err := sendMessage(config, endpoint, input, metadata, []string{original.Sender}, nil, *ttl, *burn)
+	if err != nil {
+		return err
+	}
+
+	reportSent(aliases, responses, *ttl)
+	return nil
+}
+
+// findInboxMessage returns the message in the inbox with the given ID, or the given prefix of
+// its ID. The message has metadata and claims, but no payload.
+func findInboxMessage(endpoint *Endpoint, id string) (*secrt.Message, error) {
+	var inbox secrt.Inbox
+	if err := Call(endpoint, jtp.Nil, &inbox, "GET", "inbox"); err != nil {
+		return nil, err
+	}
+
+	var found *secrt.Message
+	for i, msg := range inbox.Messages {
+		if !strings.HasPrefix(msg.Message.String(), strings.ToLower(id)) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("message ID %s is ambiguous", id)
+		}
+
+		found = &inbox.Messages[i]
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+
+	return found, nil
+}
+
+// matchReplies records the replies in the inbox against the requests we've sent. A reply only
+// fulfils a request if it comes from the peer who was asked. Fulfilled requests are forgotten once
+// their reply has been removed from the inbox, and unfulfilled requests once they've expired.
+func (endpoint *Endpoint) matchReplies(config *Config, entries []*lsEntry) {
+	now := time.Now().Unix()
+	inInbox := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		inInbox[entry.ID] = true
+	}
+
+	requests := endpoint.Requests[:0]
+	for _, request := range endpoint.Requests {
+		if request.Reply == uuid.Nil {
+			for _, entry := range entries {
+				if entry.Kind == secrt.KindReply && entry.Request == request.ID && entry.Sender == request.Peer {
+					request.Reply = uuid.MustParse(entry.ID)
+					config.modified = true
+					break
+				}
+			}
+
+			// A reply that was sent before the request expired would already be in the inbox.
+			if request.Reply == uuid.Nil && request.Expires != 0 && request.Expires < now {
+				config.modified = true
+				continue
+			}
+		} else if !inInbox[request.Reply.String()] {
+			config.modified = true
+			continue
+		}
+
+		requests = append(requests, request)
+	}
+
+	endpoint.Requests = requests
+}
+
+// parseArgs parses flags that appear before or after the positional arguments, and returns the
+// positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
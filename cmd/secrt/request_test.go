@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/google/uuid"
+)
+
+func TestMatchReplies(t *testing.T) {
+	now := time.Now().Unix()
+	pending := &Request{ID: uuid.New(), Peer: "bob@example.com", Expires: now + 3600}
+	expired := &Request{ID: uuid.New(), Peer: "bob@example.com", Expires: now - 1}
+	answered := &Request{ID: uuid.New(), Peer: "bob@example.com", Expires: now - 1}
+	removed := &Request{ID: uuid.New(), Peer: "bob@example.com", Reply: uuid.New()}
+	impostor := &Request{ID: uuid.New(), Peer: "bob@example.com", Expires: now + 3600}
+
+	reply := uuid.New()
+	entries := []*lsEntry{
+		{ID: reply.String(), Sender: "bob@example.com", Kind: secrt.KindReply, Request: answered.ID},
+		{ID: uuid.NewString(), Sender: "eve@example.com", Kind: secrt.KindReply, Request: impostor.ID},
+	}
+
+	config := &Config{}
+	endpoint := &Endpoint{Requests: []*Request{pending, expired, answered, removed, impostor}}
+	endpoint.matchReplies(config, entries)
+
+	if !slices.Equal(endpoint.Requests, []*Request{pending, answered, impostor}) {
+		t.Fatalf("unexpected requests: %+v", endpoint.Requests)
+	}
+
+	if answered.Reply != reply {
+		t.Error("reply wasn't matched")
+	}
+
+	if impostor.Reply != uuid.Nil {
+		t.Error("a reply from another peer was matched")
+	}
+
+	if !config.modified {
+		t.Error("config wasn't saved")
+	}
+
+	// Once the reply is removed, the request is forgotten.
+	endpoint.matchReplies(config, nil)
+	if !slices.Equal(endpoint.Requests, []*Request{pending, impostor}) {
+		t.Fatalf("unexpected requests: %+v", endpoint.Requests)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// CmdRun runs a command with the variables in a secret added to its environment. The secret is
+// decrypted in memory, and is never written to disk. With --rm, the message is deleted once the
+// command succeeds, so it can be run again if the command fails.
+func CmdRun(config *Config, endpoint *Endpoint, args []string) error {
+	usage := "secrt run --from <msgid> [--format dotenv|json|yaml] [--rm] -- command [args ...]"
+
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	from := flags.String("from", "", "the message containing the variables")
+	format := flags.String("format", "", "the format of the message: dotenv, json or yaml (default: the message's content type)")
+	remove := flags.Bool("rm", false, "delete the message once the command succeeds")
+	if err := flags.Parse(args); err != nil || *from == "" || flags.NArg() == 0 {
+		secrt.Usage(usage)
+	}
+
+	// Check the format first, since reading a burn-after-reading message deletes it.
+	if !slices.Contains([]string{"", FormatDotenv, FormatJSON, FormatYAML}, *format) {
+		secrt.Usage(usage)
+	}
+
+	var payload bytes.Buffer
+	msg, err := getMessage(config, endpoint, *from, &payload)
+	if err != nil {
+		return err
+	}
+
+	kv, err := parseKV(payload.Bytes(), *format, msg.Metadata)
+	if err != nil {
+		if msg.Claims.Burn {
+			return fmt.Errorf("message %s was deleted from the server when it was read, but it couldn't be parsed, so the secret has been lost; ask %s to send it again: %w",
+				msg.Message.Message, msg.Sender, err)
+		}
+		return fmt.Errorf("unable to parse message %s: %w", msg.Message.Message, err)
+	}
+
+	command := flags.Args()
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env(kv)...)
+
+	if err = cmd.Run(); err != nil {
+		return err
+	}
+
+	// Burnt messages have already gone.
+	if *remove && !msg.Claims.Burn {
+		if err = Call(endpoint, jtp.Nil, jtp.Nil, "DELETE", "message", msg.Message.Message.String()); err != nil {
+			return fmt.Errorf("unable to remove message: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// exitCode returns the exit code of a command run by "secrt run", if err is its exit status.
+func exitCode(err error) (int, bool) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), true
+	}
+
+	return 0, false
+}
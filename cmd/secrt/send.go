@@ -5,9 +5,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
+	"time"
 
 	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
 )
 
 var peerRegexp = regexp.MustCompile(`^[^@\s\\]+@[^@\s]+\.[^@\s]+$`)
@@ -17,18 +21,22 @@ func CmdSend(config *Config, endpoint *Endpoint, args []string) error {
 
 	flags := flag.NewFlagSet("send", flag.ContinueOnError)
 	description := flags.String("d", "", "include a description")
+	ttl := flags.Duration("ttl", 0, "delete the message after this long, even if it hasn't been read")
+	burn := flags.Bool("burn", false, "delete the message as soon as it's read")
+	var kv kvFlag
+	flags.Var(&kv, "kv", "send NAME=value as part of a key/value secret; can be repeated")
 
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
 
-	var aliases []string
+	var recipients []string
 	var selectedFile string
 
-	// Extract all the peer IDs from the arguments.
+	// Extract all the peer IDs and groups from the arguments.
 	for _, arg := range flags.Args() {
-		if peerRegexp.MatchString(arg) {
-			aliases = append(aliases, arg)
+		if isRecipient(arg) {
+			recipients = append(recipients, arg)
 		} else {
 			if selectedFile != "" {
 				return fmt.Errorf("at most one file can be specified")
@@ -37,67 +45,297 @@ func CmdSend(config *Config, endpoint *Endpoint, args []string) error {
 		}
 	}
 
-	if len(aliases) == 0 {
+	if len(recipients) == 0 {
 		return fmt.Errorf("no peers specified")
 	}
 
-	plaintext, metadata, err := readInput(selectedFile)
+	if *ttl < 0 {
+		return fmt.Errorf("invalid ttl: %s", *ttl)
+	}
+
+	var input io.ReadSeekCloser
+	var metadata *secrt.Metadata
+	var err error
+
+	if len(kv) > 0 {
+		if selectedFile != "" {
+			return fmt.Errorf("a file can't be sent with --kv")
+		}
+
+		input, metadata, err = kvInput(kv)
+	} else {
+		input, metadata, err = openInput(selectedFile)
+	}
+
 	if err != nil {
 		return err
 	}
 
+	defer input.Close()
+
 	metadata.Description = *description
 
+	// If some of the peers couldn't be sent the message, the others still get it.
+	aliases, responses, err := sendToRecipients(config, endpoint, input, metadata, recipients, *ttl, *burn)
+	reportSent(aliases, responses, *ttl)
+	return err
+}
+
+// sendToRecipients expands groups and teams in the recipients, and sends the message to each peer.
+// If a team's membership changes while the message is being sent, the server rejects the message,
+// and it's sent again to the team's new members. It returns the peers that the message was sent to,
+// which might be some of them even if an error is returned.
+func sendToRecipients(config *Config, endpoint *Endpoint, input io.ReadSeeker, metadata *secrt.Metadata, recipients []string, ttl time.Duration, burn bool) ([]string, []secrt.SendResponse, error) {
+	for retried := false; ; retried = true {
+		aliases, teams, err := endpoint.ExpandRecipients(config, recipients)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(aliases) == 0 {
+			return nil, nil, fmt.Errorf("no peers specified")
+		}
+
+		sent, responses, err := sendMessage(config, endpoint, input, metadata, aliases, teams, ttl, burn)
+
+		var httpErr *jtp.HTTPError
+		if !retried && errors.As(err, &httpErr) && httpErr.Code == secrt.ErrorTeamMember {
+			continue
+		}
+
+		return sent, responses, err
+	}
+}
+
+// reportSent prints the ID of each message. The server caps the lifetime of messages, so let the
+// sender know if it's shorter than requested.
+func reportSent(aliases []string, responses []secrt.SendResponse, ttl time.Duration) {
+	for i, response := range responses {
+		fmt.Printf("%s\n", response.ID.String())
+
+		if ttl > 0 && response.Expiry != 0 {
+			expiry := time.Unix(response.Expiry, 0)
+			if time.Until(expiry) < ttl-time.Minute {
+				fmt.Fprintf(os.Stderr, "warning: message to %s will expire at %s\n", aliases[i], expiry.Local().Format("2006-01-02 15:04:05"))
+			}
+		}
+	}
+}
+
+// sendMessage sends the input and its metadata to the peers, and returns the peers it was sent to,
+// with the server's response for each. teams maps the peers who were chosen as members of a team to
+// the team's alias. If a peer's key has changed, and the new key can't be used, the message is still
+// sent to the other peers, and the error for that peer is returned along with their responses.
+func sendMessage(config *Config, endpoint *Endpoint, input io.ReadSeeker, metadata *secrt.Metadata, aliases []string, teams map[string]string, ttl time.Duration, burn bool) ([]string, []secrt.SendResponse, error) {
+	metadata.Sender = endpoint.Alias
+
 	// Do a pass to ensure that all peers are known. This lets us fail early if we don't
 	// accept new peers, or if there's a typo.
 	for _, alias := range aliases {
-		_, err = endpoint.GetPeer(config, alias)
-		if err != nil {
-			return fmt.Errorf("unable to get peer: %w", err)
+		if _, err := endpoint.GetPeer(config, alias); err != nil {
+			return nil, nil, fmt.Errorf("unable to get peer: %w", err)
 		}
 	}
 
 	// Now we have the plaintext message and metadata; we need to encrypt them both into an StorageEnvelope.
 	clearmeta, err := json.Marshal(metadata)
 	if err != nil {
-		return fmt.Errorf("unable to marshal metadata: %w", err)
+		return nil, nil, fmt.Errorf("unable to marshal metadata: %w", err)
 	}
 
-	// Now do another pass that actually sends the message.
-	var sendErrors []error
-	var sendRequests []secrt.SendRequest
+	// A secret for several peers is encrypted and uploaded once, and the key is wrapped for each peer.
+	if len(aliases) > 1 {
+		var response secrt.SharedSendResponse
+		sent, err := sendShared(config, endpoint, input, clearmeta, aliases, teams, int64(ttl.Seconds()), burn, &response)
+		return sent, response.Messages, err
+	}
 
-	for _, alias := range aliases {
-		peer, err := endpoint.GetPeer(config, alias)
-		if err != nil {
-			return fmt.Errorf("unable to get peer: %w", err)
+	// envelope creates the request for a single peer. The payload itself is streamed by uploadStream.
+	envelope := func(peer *Peer) (*secrt.SendRequest, error) {
+		var err error
+		request := &secrt.SendRequest{
+			TTL:          int64(ttl.Seconds()),
+			Burn:         burn,
+			RecipientKey: peer.PublicKey,
+			Team:         teams[aliases[0]],
 		}
 
-		request := secrt.SendRequest{}
-
 		request.Metadata, err = endpoint.Encrypt(clearmeta, peer.PublicKey)
 		if err != nil {
-			return fmt.Errorf("unable to encrypt metadata: %w", err)
+			return nil, fmt.Errorf("unable to encrypt metadata: %w", err)
 		}
 
-		request.Payload, err = endpoint.Encrypt(plaintext, peer.PublicKey)
+		return request, nil
+	}
+
+	// upload encrypts the input for a single peer as it's sent to the server.
+	upload := func(alias string, peer *Peer, response *secrt.SendResponse) error {
+		request, err := envelope(peer)
 		if err != nil {
-			return fmt.Errorf("unable to encrypt payload: %w", err)
+			return err
 		}
 
-		sendRequests = append(sendRequests, request)
+		encrypt := func(w io.Writer) (io.WriteCloser, error) {
+			return endpoint.EncryptStream(w, peer.PublicKey)
+		}
+
+		return uploadStream(endpoint, input, encrypt, request, response, "message", alias, "stream")
 	}
 
-	for i, request := range sendRequests {
-		var sendResponse secrt.SendResponse
+	alias := aliases[0]
+	peer, err := endpoint.GetPeer(config, alias)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get peer: %w", err)
+	}
 
-		err = Call(endpoint, &request, &sendResponse, "POST", "message", aliases[i])
-		if err != nil {
-			sendErrors = append(sendErrors, err)
-		} else {
-			fmt.Printf("%s\n", sendResponse.ID.String())
+	var sendResponse secrt.SendResponse
+	err = upload(alias, peer, &sendResponse)
+
+	// If the peer has changed their key, record the new key. It can't be used until it's been
+	// accepted, so the message isn't sent.
+	var httpErr *jtp.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Code == secrt.ErrorRecipientKey {
+		if _, refreshErr := endpoint.RefreshPeer(config, alias); refreshErr != nil {
+			err = refreshErr
+		}
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aliases, []secrt.SendResponse{sendResponse}, nil
+}
+
+// sendShared sends the input to several peers. The input is encrypted and uploaded once, and
+// its key is wrapped for each peer. It returns the peers that the message was sent to: if some of
+// the peers' keys have changed, and the new keys can't be used, it's sent to the others, and the
+// errors for those peers are returned.
+func sendShared(config *Config, endpoint *Endpoint, input io.ReadSeeker, clearmeta []byte, aliases []string, teams map[string]string, ttl int64, burn bool, response *secrt.SharedSendResponse) ([]string, error) {
+	key, err := secrt.NewStreamKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// envelope creates the request, which contains the metadata and key for each peer.
+	envelope := func(aliases []string, peers []*Peer) (*secrt.SharedSendRequest, error) {
+		var err error
+		request := &secrt.SharedSendRequest{TTL: ttl, Burn: burn}
+
+		for i, peer := range peers {
+			recipient := &secrt.RecipientEnvelope{
+				Alias:        aliases[i],
+				RecipientKey: peer.PublicKey,
+				Team:         teams[aliases[i]],
+			}
+
+			if recipient.Metadata, err = endpoint.Encrypt(clearmeta, peer.PublicKey); err != nil {
+				return nil, fmt.Errorf("unable to encrypt metadata: %w", err)
+			}
+
+			if recipient.PayloadKey, err = endpoint.SealStreamKey(key, peer.PublicKey); err != nil {
+				return nil, fmt.Errorf("unable to encrypt key: %w", err)
+			}
+
+			request.Recipients = append(request.Recipients, recipient)
+		}
+
+		return request, nil
+	}
+
+	encrypt := func(w io.Writer) (io.WriteCloser, error) {
+		return secrt.NewSharedStreamWriter(w, key)
+	}
+
+	peers := make([]*Peer, len(aliases))
+	for i, alias := range aliases {
+		if peers[i], err = endpoint.GetPeer(config, alias); err != nil {
+			return nil, fmt.Errorf("unable to get peer: %w", err)
+		}
+	}
+
+	request, err := envelope(aliases, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = uploadStream(endpoint, input, encrypt, request, response, "message")
+
+	// If any of the peers have changed their keys, record the new keys. They can't be used until
+	// they've been accepted, so those peers are left out, and the message is sent to the others.
+	var skipped []error
+	var httpErr *jtp.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Code == secrt.ErrorRecipientKey {
+		var refreshedAliases []string
+		var refreshedPeers []*Peer
+
+		for _, alias := range aliases {
+			peer, err := endpoint.RefreshPeer(config, alias)
+			if err != nil {
+				skipped = append(skipped, err)
+				continue
+			}
+
+			refreshedAliases = append(refreshedAliases, alias)
+			refreshedPeers = append(refreshedPeers, peer)
+		}
+
+		if len(refreshedAliases) == 0 {
+			return nil, errors.Join(skipped...)
+		}
+
+		// None of the keys have changed, so sending again would fail in the same way.
+		if len(skipped) == 0 {
+			return nil, err
+		}
+
+		aliases = refreshedAliases
+		if request, err = envelope(aliases, refreshedPeers); err != nil {
+			return nil, err
 		}
+
+		err = uploadStream(endpoint, input, encrypt, request, response, "message")
+	}
+
+	if err != nil {
+		return nil, errors.Join(append(skipped, err)...)
+	}
+
+	if len(response.Messages) != len(aliases) {
+		return nil, fmt.Errorf("expected %d messages, but the server sent %d", len(aliases), len(response.Messages))
 	}
 
-	return errors.Join(sendErrors...)
+	return aliases, errors.Join(skipped...)
+}
+
+// uploadStream encrypts the input as it's sent to the server.
+func uploadStream[R any](endpoint *Endpoint, input io.ReadSeeker, encrypt func(io.Writer) (io.WriteCloser, error), envelope any, response *R, path ...string) error {
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to rewind input: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		stream, err := encrypt(pw)
+		if err == nil {
+			if _, err = io.Copy(stream, input); err == nil {
+				err = stream.Close()
+			}
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	err := Upload(endpoint, envelope, pr, response, "POST", path...)
+
+	// The server might reject the message before reading all of it, so make sure
+	// the encryption goroutine has finished with the input.
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+
+	return err
 }
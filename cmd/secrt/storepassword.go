@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Argon2id parameters for new password vaults. The parameters are stored in the vault, so they
+// can be increased later without breaking existing vaults.
+const (
+	passwordTime    = 3
+	passwordMemory  = 64 * 1024 // KiB
+	passwordThreads = 4
+)
+
+// PassphraseEnv names an environment variable that contains the passphrase for password vaults.
+// It's intended for automation, where there's nobody to type the passphrase.
+const PassphraseEnv = "SECRT_PASSPHRASE"
+
+// PasswordVault is a vault that encrypts its values with a key derived from a passphrase, using argon2id.
+// It's useful for devices that don't have a platform keystore, such as headless Linux servers.
+type PasswordVault struct {
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Sealed  []byte `json:"sealed"` // The values, encrypted with secretbox. The nonce is prepended.
+
+	key    *[32]byte // Derived key, only set when the vault is unsealed.
+	values Map64     // Unsealed values, never marshalled/unmarshalled
+}
+
+// NewPasswordVault creates an empty password vault, protected by a new passphrase.
+func NewPasswordVault() (*PasswordVault, error) {
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		entered := ReadPassword("New passphrase: ")
+		if len(entered) == 0 {
+			return nil, fmt.Errorf("a passphrase is required (or set %s)", PassphraseEnv)
+		}
+
+		if !bytes.Equal(entered, ReadPassword("Repeat passphrase: ")) {
+			return nil, fmt.Errorf("passphrases don't match")
+		}
+
+		passphrase = string(entered)
+	}
+
+	vault := &PasswordVault{
+		Salt:    make([]byte, 16),
+		Time:    passwordTime,
+		Memory:  passwordMemory,
+		Threads: passwordThreads,
+		values:  make(Map64),
+	}
+
+	if _, err := rand.Read(vault.Salt); err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %w", err)
+	}
+
+	vault.key = vault.deriveKey([]byte(passphrase))
+
+	if err := vault.seal(); err != nil {
+		return nil, err
+	}
+
+	return vault, nil
+}
+
+func (s *PasswordVault) deriveKey(passphrase []byte) *[32]byte {
+	var key [32]byte
+	copy(key[:], argon2.IDKey(passphrase, s.Salt, s.Time, s.Memory, s.Threads, 32))
+	return &key
+}
+
+// seal encrypts the values into s.Sealed.
+func (s *PasswordVault) seal() error {
+	js, err := json.Marshal(s.values)
+	if err != nil {
+		return fmt.Errorf("unable to marshal values: %w", err)
+	}
+
+	var nonce [24]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	s.Sealed = secretbox.Seal(nonce[:], js, &nonce, s.key)
+	return nil
+}
+
+func (s *PasswordVault) Type() VaultType {
+	return VaultPassword
+}
+
+func (s *PasswordVault) IsUnsealed() bool {
+	return s.values != nil
+}
+
+// Unseal derives the key from the passphrase, which is read from SECRT_PASSPHRASE or the terminal,
+// and decrypts the values.
+func (s *PasswordVault) Unseal() error {
+	passphrase := []byte(os.Getenv(PassphraseEnv))
+	if len(passphrase) == 0 {
+		passphrase = ReadPassword("Passphrase: ")
+		if len(passphrase) == 0 {
+			return fmt.Errorf("a passphrase is required (or set %s)", PassphraseEnv)
+		}
+	}
+
+	if len(s.Sealed) < 24 {
+		return fmt.Errorf("invalid password vault")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], s.Sealed[:24])
+
+	key := s.deriveKey(passphrase)
+	js, ok := secretbox.Open(nil, s.Sealed[24:], &nonce, key)
+	if !ok {
+		return fmt.Errorf("incorrect passphrase")
+	}
+
+	var values Map64
+	if err := json.Unmarshal(js, &values); err != nil {
+		return fmt.Errorf("unable to unmarshal password vault: %w", err)
+	}
+
+	s.key = key
+	s.values = values
+	return nil
+}
+
+func (s *PasswordVault) Get(key string) ([]byte, error) {
+	if s.values == nil {
+		return nil, fmt.Errorf("vault is sealed")
+	}
+	return s.values[key], nil
+}
+
+func (s *PasswordVault) Set(key string, value []byte) error {
+	if s.values == nil {
+		return fmt.Errorf("vault is sealed")
+	}
+
+	s.values[key] = value
+	return s.seal()
+}
+
+func (s *PasswordVault) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (s *PasswordVault) Unmarshal(bytes []byte) error {
+	return json.Unmarshal(bytes, s)
+}
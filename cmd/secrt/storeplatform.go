@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/zalando/go-keyring"
@@ -80,6 +81,16 @@ func (s *PlatformVault) Set(key string, value []byte) error {
 	return nil
 }
 
+// Delete removes the vault's values from the platform store.
+func (s *PlatformVault) Delete() error {
+	if err := keyring.Delete(s.Service, s.User); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("unable to delete from platform store: %w", err)
+	}
+
+	s.values = nil
+	return nil
+}
+
 func (s *PlatformVault) Marshal() ([]byte, error) {
 	return json.Marshal(s)
 }
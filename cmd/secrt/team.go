@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// CmdTeam manages teams. Teams are like groups, but they're kept on the server, so everyone who
+// sends to a team sees the same members. Only the team's owner can change its members, and peers
+// have to join a team before they're members.
+func CmdTeam(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secrt team {add | join | confirm | ls | rm}")
+	}
+
+	switch args[0] {
+	case "add":
+		return CmdTeamAdd(config, endpoint, args[1:])
+	case "join":
+		return CmdTeamJoin(config, endpoint, args[1:])
+	case "confirm":
+		return CmdTeamConfirm(config, endpoint, args[1:])
+	case "rm":
+		return CmdTeamRm(config, endpoint, args[1:])
+	case "ls":
+		return CmdTeamLs(config, endpoint, args[1:])
+	default:
+		return fmt.Errorf("usage: secrt team {add | join | confirm | ls | rm}")
+	}
+}
+
+// CmdTeamAdd invites peers to a team, creating it if necessary. Whoever creates a team owns it, and
+// creates the team key. Each peer is sent a copy of the key, sealed with the key we have for them.
+func CmdTeamAdd(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: secrt team add {team} {alias} ...")
+	}
+
+	for _, alias := range args[1:] {
+		if !peerRegexp.MatchString(alias) {
+			return fmt.Errorf("invalid peer %q", alias)
+		}
+	}
+
+	request := &secrt.TeamRequest{}
+
+	var key *secrt.TeamKey
+	team, err := endpoint.GetTeam(args[0])
+	var httpErr *jtp.HTTPError
+	switch {
+	case errors.As(err, &httpErr) && httpErr.Code == secrt.ErrorUnknownTeam:
+		if key, err = secrt.NewTeamKey(); err != nil {
+			return err
+		}
+
+		invite, err := teamInvite(key, endpoint.Alias, endpoint.PublicKey)
+		if err != nil {
+			return err
+		}
+		request.Members = append(request.Members, invite)
+
+	case err != nil:
+		return err
+
+	default:
+		key = team.key
+	}
+
+	for _, alias := range args[1:] {
+		peer, err := endpoint.GetPeer(config, alias)
+		if err != nil {
+			return err
+		}
+
+		invite, err := teamInvite(key, alias, peer.PublicKey)
+		if err != nil {
+			return err
+		}
+		request.Members = append(request.Members, invite)
+	}
+
+	var response secrt.Team
+	if err = Call(endpoint, request, &response, "POST", "team", teamName(args[0])); err != nil {
+		return fmt.Errorf("unable to add to team: %w", err)
+	}
+
+	if team, err = endpoint.openTeam(&response); err != nil {
+		return err
+	}
+
+	printTeam(team)
+	return nil
+}
+
+// teamInvite returns an invitation for the peer, with their alias encrypted with the team key, and
+// the team key sealed for them.
+func teamInvite(key *secrt.TeamKey, alias string, publicKey []byte) (secrt.TeamInvite, error) {
+	encrypted, err := key.EncryptAlias(alias)
+	if err != nil {
+		return secrt.TeamInvite{}, err
+	}
+
+	sealed, err := key.Seal(publicKey)
+	if err != nil {
+		return secrt.TeamInvite{}, fmt.Errorf("unable to seal team key for %s: %w", alias, err)
+	}
+
+	return secrt.TeamInvite{Peer: alias, Alias: encrypted, TeamKey: sealed}, nil
+}
+
+// CmdTeamJoin accepts an invitation to join a team.
+func CmdTeamJoin(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: secrt team join {team}")
+	}
+
+	var response secrt.Team
+	if err := Call(endpoint, jtp.Nil, &response, "POST", "team", teamName(args[0]), "join"); err != nil {
+		return fmt.Errorf("unable to join team: %w", err)
+	}
+
+	team, err := endpoint.openTeam(&response)
+	if err != nil {
+		return err
+	}
+
+	printTeam(team)
+	return nil
+}
+
+// CmdTeamConfirm lists the current members of a team, and confirms that messages can be sent to
+// them, without asking.
+func CmdTeamConfirm(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: secrt team confirm {team}")
+	}
+
+	team, err := endpoint.GetTeam(args[0])
+	if err != nil {
+		return err
+	}
+
+	printTeam(team)
+	endpoint.rememberTeam(config, team)
+	return nil
+}
+
+// CmdTeamRm removes peers from a team, or deletes the whole team if no peers are given. Members can
+// remove themselves; otherwise, only the owner can change the team.
+func CmdTeamRm(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secrt team rm {team} [alias ...]")
+	}
+
+	name := teamName(args[0])
+
+	if len(args) == 1 {
+		if err := Call(endpoint, jtp.Nil, jtp.Nil, "DELETE", "team", name); err != nil {
+			return fmt.Errorf("unable to delete team: %w", err)
+		}
+		return nil
+	}
+
+	for _, alias := range args[1:] {
+		var team secrt.Team
+		if err := Call(endpoint, jtp.Nil, &team, "DELETE", "team", name, "member", alias); err != nil {
+			return fmt.Errorf("unable to remove %s from team: %w", alias, err)
+		}
+	}
+
+	return nil
+}
+
+// CmdTeamLs lists the teams we own or belong to, or the members of the given team.
+func CmdTeamLs(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) > 0 {
+		team, err := endpoint.GetTeam(args[0])
+		if err != nil {
+			return err
+		}
+
+		printTeam(team)
+		return nil
+	}
+
+	var teams secrt.TeamList
+	if err := Call(endpoint, jtp.Nil, &teams, "GET", "team"); err != nil {
+		return fmt.Errorf("unable to list teams: %w", err)
+	}
+
+	for _, team := range teams.Teams {
+		fmt.Println(team)
+	}
+
+	for _, team := range teams.Invitations {
+		fmt.Printf("%s (invited; join with \"secrt team join %s\")\n", team, team)
+	}
+
+	return nil
+}
+
+// Team is a team whose aliases have been decrypted with the team key.
+type Team struct {
+	Team    string
+	Owner   string
+	Members []TeamMember
+	Invited []string
+	key     *secrt.TeamKey
+}
+
+// TeamMember is a member of a team, with their current public key.
+type TeamMember struct {
+	Peer      string
+	PublicKey []byte
+}
+
+// GetTeam returns the current members of a team. Membership is never cached, so that messages aren't
+// sent to peers who have been removed from the team.
+func (endpoint *Endpoint) GetTeam(name string) (*Team, error) {
+	var response secrt.Team
+	if err := Call(endpoint, jtp.Nil, &response, "GET", "team", teamName(name)); err != nil {
+		return nil, fmt.Errorf("unable to get team %s: %w", name, err)
+	}
+
+	return endpoint.openTeam(&response)
+}
+
+// openTeam opens our copy of the team key, and decrypts the aliases of the team's members. Each
+// alias has to match the alias hash that the server has for the member, so that the team's owner
+// can't show us the wrong alias for a member.
+func (endpoint *Endpoint) openTeam(response *secrt.Team) (*Team, error) {
+	privateKey, err := endpoint.GetSecretValue("privateKey")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := secrt.OpenTeamKey(response.TeamKey, endpoint.PublicKey, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s; ask its owner to invite you again", err, response.Team)
+	}
+
+	alias := func(member *secrt.TeamMember) (string, error) {
+		alias, err := key.DecryptAlias(member.Alias)
+		if err != nil {
+			return "", fmt.Errorf("unable to read a member of %s: %w", response.Team, err)
+		}
+
+		if !bytes.Equal(secrt.AliasHash(endpoint.ServerKey, alias), member.AliasHash) {
+			return "", fmt.Errorf("the alias %s in %s doesn't belong to that member", alias, response.Team)
+		}
+
+		return alias, nil
+	}
+
+	team := &Team{Team: response.Team, key: key}
+	if team.Owner, err = alias(&response.Owner); err != nil {
+		return nil, err
+	}
+
+	for _, member := range response.Members {
+		peer, err := alias(&member)
+		if err != nil {
+			return nil, err
+		}
+		team.Members = append(team.Members, TeamMember{Peer: peer, PublicKey: member.PublicKey})
+	}
+
+	for _, member := range response.Invited {
+		peer, err := alias(&member)
+		if err != nil {
+			return nil, err
+		}
+		team.Invited = append(team.Invited, peer)
+	}
+
+	return team, nil
+}
+
+// confirmTeam asks before sending to members of a team who have joined since we last confirmed its
+// members, since the team's owner can invite anyone. Teams we own don't need to be confirmed.
+func (endpoint *Endpoint) confirmTeam(config *Config, team *Team) error {
+	if team.Owner == endpoint.Alias {
+		return nil
+	}
+
+	var added []string
+	for _, member := range team.Members {
+		if member.Peer != endpoint.Alias && !slices.Contains(endpoint.TeamMembers[team.Team], member.Peer) {
+			added = append(added, member.Peer)
+		}
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%s (owner %s) has members you haven't sent to before:\n", team.Team, team.Owner)
+	for _, alias := range added {
+		fmt.Fprintf(os.Stderr, "    %s\n", alias)
+	}
+
+	if !Confirm("Send to them?") {
+		return fmt.Errorf("the new members of %s weren't confirmed; check them with \"secrt team confirm %s\"", team.Team, team.Team)
+	}
+
+	endpoint.rememberTeam(config, team)
+	return nil
+}
+
+// rememberTeam records the current members of a team, so we aren't asked about them again.
+func (endpoint *Endpoint) rememberTeam(config *Config, team *Team) {
+	if endpoint.TeamMembers == nil {
+		endpoint.TeamMembers = make(map[string][]string)
+	}
+
+	members := make([]string, 0, len(team.Members))
+	for _, member := range team.Members {
+		members = append(members, member.Peer)
+	}
+
+	endpoint.TeamMembers[team.Team] = members
+	config.modified = true
+}
+
+// teamName returns the name of a team, without the team prefix.
+func teamName(name string) string {
+	return strings.TrimPrefix(name, secrt.TeamPrefix)
+}
+
+func printTeam(team *Team) {
+	fmt.Printf("%s (owner %s)\n", team.Team, team.Owner)
+	for _, member := range team.Members {
+		fmt.Printf("    %s\n", member.Peer)
+	}
+
+	for _, alias := range team.Invited {
+		fmt.Printf("    %s (invited)\n", alias)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/commandquery/secrt"
+)
+
+func TestConfirmTeam(t *testing.T) {
+	config := &Config{}
+	endpoint := &Endpoint{Alias: "alice@example.com"}
+	team := &Team{
+		Team:    "team:sre",
+		Owner:   "bob@example.com",
+		Members: []TeamMember{{Peer: "bob@example.com"}, {Peer: "alice@example.com"}},
+	}
+
+	// Without a terminal, new members can't be confirmed by asking.
+	stdin, _, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *os.File) { os.Stdin = saved }(os.Stdin)
+	os.Stdin = stdin
+
+	if err := endpoint.confirmTeam(config, team); err == nil {
+		t.Fatal("expected new members to need confirmation")
+	}
+
+	endpoint.rememberTeam(config, team)
+	if err := endpoint.confirmTeam(config, team); err != nil {
+		t.Fatal(err)
+	}
+
+	if !config.modified {
+		t.Error("confirmed members weren't saved")
+	}
+
+	// Someone joins.
+	team.Members = append(team.Members, TeamMember{Peer: "mallory@example.com"})
+	if err := endpoint.confirmTeam(config, team); err == nil {
+		t.Fatal("expected a new member to need confirmation")
+	}
+
+	// Members who leave have to be confirmed again if they come back.
+	team.Members = team.Members[:2]
+	endpoint.rememberTeam(config, team)
+	team.Members = append(team.Members, TeamMember{Peer: "mallory@example.com"})
+	if err := endpoint.confirmTeam(config, team); err == nil {
+		t.Fatal("expected a returning member to need confirmation")
+	}
+
+	// Owners chose the members themselves.
+	team.Owner = endpoint.Alias
+	if err := endpoint.confirmTeam(config, team); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenTeam(t *testing.T) {
+	publicKey, privateKey := newKey(t)
+	serverKey, _ := newKey(t)
+	vault := NewClearVault()
+	if err := vault.Set("privateKey", privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := &Endpoint{
+		Alias:     "alice@example.com",
+		PublicKey: publicKey,
+		ServerKey: serverKey,
+		Vaults:    []*StorageEnvelope{{VaultType: VaultClear, vault: vault}},
+	}
+
+	key, err := secrt.NewTeamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member := func(alias string) secrt.TeamMember {
+		encrypted, err := key.EncryptAlias(alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secrt.TeamMember{Alias: encrypted, AliasHash: secrt.AliasHash(serverKey, alias)}
+	}
+
+	sealed, err := key.Seal(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := &secrt.Team{
+		Team:    "team:sre",
+		Owner:   member("bob@example.com"),
+		Members: []secrt.TeamMember{member("bob@example.com"), member("alice@example.com")},
+		Invited: []secrt.TeamMember{member("carol@example.com")},
+		TeamKey: sealed,
+	}
+
+	team, err := endpoint.openTeam(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if team.Owner != "bob@example.com" || len(team.Members) != 2 || team.Members[1].Peer != "alice@example.com" || team.Invited[0] != "carol@example.com" {
+		t.Fatalf("unexpected team: %+v", team)
+	}
+
+	// The owner can't give a member someone else's alias.
+	response.Members[1].Alias = member("mallory@example.com").Alias
+	if _, err = endpoint.openTeam(response); err == nil {
+		t.Fatal("expected an alias that doesn't match its hash to be rejected")
+	}
+
+	// A key that was sealed for someone else can't be opened.
+	otherKey, _ := newKey(t)
+	if response.TeamKey, err = key.Seal(otherKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = endpoint.openTeam(response); !errors.Is(err, secrt.ErrTeamKey) {
+		t.Fatalf("expected the team key not to open, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// tokenRotation is how often the authentication token is replaced. The server rejects tokens
+// that are older than SECRT_MAX_TOKEN_AGE, so tokens are rotated well before that.
+const tokenRotation = 24 * time.Hour
+
+// SetAuthToken stores a new authentication token for the endpoint.
+func (endpoint *Endpoint) SetAuthToken(config *Config, token []byte) error {
+	if err := endpoint.SetSecretValue("authToken", token); err != nil {
+		return fmt.Errorf("unable to store auth token: %w", err)
+	}
+
+	endpoint.TokenIssued = time.Now().Unix()
+	config.modified = true
+	return nil
+}
+
+// RefreshToken replaces the endpoint's authentication token with a new one.
+func (endpoint *Endpoint) RefreshToken(config *Config) error {
+	var tokenResponse secrt.TokenResponse
+	if err := Call(endpoint, jtp.Nil, &tokenResponse, "POST", "token"); err != nil {
+		return fmt.Errorf("unable to refresh token: %w", err)
+	}
+
+	return endpoint.SetAuthToken(config, tokenResponse.Token)
+}
+
+// RotateToken refreshes the authentication token if it hasn't been refreshed recently, and saves it.
+// Failures are reported, but aren't fatal: the current token might still work.
+func (endpoint *Endpoint) RotateToken(config *Config) {
+	if time.Since(time.Unix(endpoint.TokenIssued, 0)) < tokenRotation {
+		return
+	}
+
+	err := endpoint.RefreshToken(config)
+	if err == nil {
+		err = config.Save()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// CmdRefresh replaces the authentication token for the endpoint.
+func CmdRefresh(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 0 {
+		secrt.Usage("secrt refresh")
+	}
+
+	return endpoint.RefreshToken(config)
+}
+
+// CmdLogout revokes the authentication tokens of all the peer's devices. This device receives a new token.
+func CmdLogout(config *Config, endpoint *Endpoint, args []string) error {
+	flags := flag.NewFlagSet("logout", flag.ContinueOnError)
+	allDevices := flags.Bool("all-devices", false, "revoke the tokens of all devices")
+	if err := flags.Parse(args); err != nil {
+		secrt.Usage("secrt logout --all-devices")
+	}
+
+	if flags.NArg() != 0 || !*allDevices {
+		secrt.Usage("secrt logout --all-devices")
+	}
+
+	var tokenResponse secrt.TokenResponse
+	if err := Call(endpoint, jtp.Nil, &tokenResponse, "POST", "logout"); err != nil {
+		return fmt.Errorf("unable to log out: %w", err)
+	}
+
+	if err := endpoint.SetAuthToken(config, tokenResponse.Token); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "all other devices have been logged out")
+	return nil
+}
@@ -12,7 +12,8 @@ func Confirm(prompt string) bool {
 		return false
 	}
 
-	fmt.Printf("%s [y/n] ", prompt)
+	// Prompts go to stderr, so they aren't mixed with output that's being captured.
+	fmt.Fprintf(os.Stderr, "%s [y/n] ", prompt)
 
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
@@ -25,7 +26,7 @@ func Confirm(prompt string) bool {
 		return false
 	}
 
-	fmt.Println() // newline after keypress
+	fmt.Fprintln(os.Stderr) // newline after keypress
 
 	return b[0] == 'y' || b[0] == 'Y'
 }
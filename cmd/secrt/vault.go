@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// vaultKeys are the names of the values that are kept in vaults.
+var vaultKeys = []string{"privateKey", "authToken", newPrivateKey}
+
+func CmdVault(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secrt vault {ls | add | rm | migrate}")
+	}
+
+	switch args[0] {
+	case "ls":
+		return CmdVaultLs(config, endpoint, args[1:])
+	case "add":
+		return CmdVaultAdd(config, endpoint, args[1:])
+	case "rm":
+		return CmdVaultRm(config, endpoint, args[1:])
+	case "migrate":
+		return CmdVaultMigrate(config, endpoint, args[1:])
+	default:
+		return fmt.Errorf("usage: secrt vault {ls | add | rm | migrate}")
+	}
+}
+
+func CmdVaultLs(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: secrt vault ls")
+	}
+
+	for _, envelope := range endpoint.Vaults {
+		status := "sealed"
+		if envelope.vault != nil && envelope.vault.IsUnsealed() {
+			status = "unsealed"
+		}
+		fmt.Println(envelope.VaultType, status)
+	}
+
+	return nil
+}
+
+// CmdVaultAdd creates a new vault, and copies the endpoint's secrets into it from an existing vault.
+func CmdVaultAdd(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: secrt vault add {type}")
+	}
+
+	source, err := endpoint.GetVault()
+	if err != nil {
+		return err
+	}
+
+	return endpoint.addVault(config, source, VaultType(args[0]))
+}
+
+// CmdVaultRm removes a vault. The last vault can't be removed, because it holds the private key.
+func CmdVaultRm(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: secrt vault rm {type}")
+	}
+
+	return endpoint.removeVault(config, VaultType(args[0]))
+}
+
+// CmdVaultMigrate moves the endpoint's secrets from one type of vault to another.
+func CmdVaultMigrate(config *Config, endpoint *Endpoint, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: secrt vault migrate {from} {to}")
+	}
+
+	from := endpoint.findVault(VaultType(args[0]))
+	if from == nil {
+		return fmt.Errorf("no %s vault found", args[0])
+	}
+
+	if !from.vault.IsUnsealed() {
+		if err := from.vault.Unseal(); err != nil {
+			return fmt.Errorf("unable to unseal %s vault: %w", from.VaultType, err)
+		}
+	}
+
+	if err := endpoint.addVault(config, from.vault, VaultType(args[1])); err != nil {
+		return err
+	}
+
+	// Save the new vault before the old one is deleted, so the secrets are never only in memory.
+	if err := config.Save(); err != nil {
+		return err
+	}
+
+	return endpoint.removeVault(config, from.VaultType)
+}
+
+// findVault returns the endpoint's vault of the given type, or nil.
+func (endpoint *Endpoint) findVault(vaultType VaultType) *StorageEnvelope {
+	for _, envelope := range endpoint.Vaults {
+		if envelope.VaultType == vaultType && envelope.vault != nil {
+			return envelope
+		}
+	}
+	return nil
+}
+
+// addVault creates a new vault of the given type, and copies the secrets from the source vault.
+func (endpoint *Endpoint) addVault(config *Config, source Vault, vaultType VaultType) error {
+	if endpoint.findVault(vaultType) != nil {
+		return fmt.Errorf("there is already a %s vault", vaultType)
+	}
+
+	vault, err := NewVault(endpoint, vaultType)
+	if err != nil {
+		return fmt.Errorf("unable to create %s vault: %w", vaultType, err)
+	}
+
+	for _, key := range vaultKeys {
+		value, err := source.Get(key)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", key, err)
+		}
+
+		if value == nil {
+			continue
+		}
+
+		if err = vault.Set(key, value); err != nil {
+			return fmt.Errorf("unable to store %s: %w", key, err)
+		}
+	}
+
+	endpoint.Vaults = append(endpoint.Vaults, &StorageEnvelope{VaultType: vaultType, vault: vault})
+	config.modified = true
+	return nil
+}
+
+// removeVault removes the vault of the given type. If the vault stores its values outside
+// the config (e.g. the platform keystore), they're deleted once the config without the vault
+// has been saved.
+func (endpoint *Endpoint) removeVault(config *Config, vaultType VaultType) error {
+	envelope := endpoint.findVault(vaultType)
+	if envelope == nil {
+		return fmt.Errorf("no %s vault found", vaultType)
+	}
+
+	if len(endpoint.Vaults) == 1 {
+		return fmt.Errorf("unable to remove the only vault")
+	}
+
+	endpoint.Vaults = slices.DeleteFunc(endpoint.Vaults, func(e *StorageEnvelope) bool {
+		return e == envelope
+	})
+
+	config.modified = true
+	if err := config.Save(); err != nil {
+		return err
+	}
+
+	if deleter, ok := envelope.vault.(interface{ Delete() error }); ok {
+		if err := deleter.Delete(); err != nil {
+			return fmt.Errorf("the %s vault has been removed, but its secrets couldn't be deleted: %w", vaultType, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+)
+
+// errWatchDone stops reading events once --once has seen a message.
+var errWatchDone = errors.New("done")
+
+// maxWatchRetry is the longest time to wait before reconnecting after an error.
+const maxWatchRetry = time.Minute
+
+// CmdWatch waits for new messages, and prints each one as it arrives. With --exec, the command is
+// run for each message instead, with the details of the message in the environment. With --once,
+// it stops after the first message.
+//
+// The server only streams messages that arrive while we're connected, so the inbox is listed each
+// time we reconnect, and any messages that arrived in between are reported then.
+func CmdWatch(config *Config, endpoint *Endpoint, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	command := flags.String("exec", "", "command to run for each message")
+	once := flags.Bool("once", false, "exit after the first message")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		secrt.Usage("secrt watch [--once] [--exec command]")
+	}
+
+	w := &watcher{config: config, endpoint: endpoint, command: *command, once: *once}
+
+	// Messages that are already waiting aren't reported.
+	if err := w.replay(false); err != nil {
+		return err
+	}
+
+	retry := time.Second
+
+	for {
+		endpoint.RotateToken(config)
+
+		err := w.watch()
+		if errors.Is(err, errWatchDone) {
+			return nil
+		}
+
+		if err == nil {
+			retry = time.Second
+			continue
+		}
+
+		// Authentication errors won't fix themselves.
+		if errors.Is(err, jtp.ErrUnauthorized) {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "watch interrupted, retrying in %s: %v\n", retry, err)
+		time.Sleep(retry)
+		retry = min(retry*2, maxWatchRetry)
+	}
+}
+
+// watcher reports each new message once, whether it's streamed by the server or found in the inbox
+// after reconnecting.
+type watcher struct {
+	config   *Config
+	endpoint *Endpoint
+	command  string
+	once     bool
+	seen     map[uuid.UUID]bool // messages in the inbox the last time it was listed, or reported since
+}
+
+// watch reads events from the server until the watch times out. Messages that arrived since the
+// last time the inbox was listed are reported first.
+func (w *watcher) watch() error {
+	body, err := Download(w.endpoint, "GET", "inbox", "watch")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// The server is already streaming new messages, so none can be missed between listing the
+	// inbox and reading the events. Messages that turn up in both are only reported once.
+	if err = w.replay(true); err != nil {
+		return err
+	}
+
+	return jtp.ReadEvents(body, func(event *jtp.Event) error {
+		if event.Event != secrt.WatchMessage {
+			return nil
+		}
+
+		var msg secrt.Message
+		if err := json.Unmarshal(event.Data, &msg); err != nil {
+			return fmt.Errorf("unable to parse message: %w", err)
+		}
+
+		return w.report(&msg)
+	})
+}
+
+// replay lists the inbox, and reports the messages that haven't been seen yet, unless report is
+// false. Messages that have left the inbox are forgotten, since they won't be seen again.
+func (w *watcher) replay(report bool) error {
+	var inbox secrt.Inbox
+	if err := Call(w.endpoint, jtp.Nil, &inbox, "GET", "inbox"); err != nil {
+		return err
+	}
+
+	seen := make(map[uuid.UUID]bool, len(inbox.Messages))
+	for _, msg := range inbox.Messages {
+		if report && !w.seen[msg.Message] {
+			if err := w.report(&msg); err != nil {
+				return err
+			}
+		}
+		seen[msg.Message] = true
+	}
+
+	w.seen = seen
+	return nil
+}
+
+// report prints the message, or runs the command for it, unless it's already been reported.
+func (w *watcher) report(msg *secrt.Message) error {
+	if w.seen[msg.Message] {
+		return nil
+	}
+
+	if w.seen == nil {
+		w.seen = make(map[uuid.UUID]bool)
+	}
+	w.seen[msg.Message] = true
+
+	entry := getLsEntry(w.config, w.endpoint, msg)
+
+	// New peers might have been added.
+	if err := w.config.Save(); err != nil {
+		return err
+	}
+
+	if w.command == "" {
+		ts := entry.Timestamp.Format("15:04:05")
+		fmt.Printf("%36s %-24.24s %6d %-10s %s\n", entry.ID, entry.Sender, entry.Size, ts, entry.FileDescription)
+	} else if err := runWatchCommand(w.command, entry); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", w.command, err)
+	}
+
+	if w.once {
+		return errWatchDone
+	}
+
+	return nil
+}
+
+// runWatchCommand runs the command using the shell. The message is described by the SECRT_MESSAGE,
+// SECRT_SENDER, SECRT_FILENAME, SECRT_DESCRIPTION and SECRT_SIZE environment variables.
+func runWatchCommand(command string, entry *lsEntry) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"SECRT_MESSAGE="+entry.ID,
+		"SECRT_SENDER="+entry.Sender,
+		"SECRT_FILENAME="+entry.Filename,
+		"SECRT_DESCRIPTION="+entry.Description,
+		"SECRT_SIZE="+strconv.Itoa(entry.Size),
+	)
+
+	return cmd.Run()
+}
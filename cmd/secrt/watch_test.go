@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+)
+
+// testInbox is a server that lists an inbox, and streams the given events to each watch.
+type testInbox struct {
+	lock     sync.Mutex
+	messages []secrt.Message
+	events   []secrt.Message
+}
+
+func (inbox *testInbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/inbox":
+		_ = json.NewEncoder(w).Encode(&secrt.Inbox{Messages: inbox.messages})
+
+	case "/inbox/watch":
+		stream, err := jtp.NewEventStream(w)
+		if err != nil {
+			return
+		}
+
+		for _, msg := range inbox.events {
+			_ = stream.Send(secrt.WatchMessage, msg.Message.String(), msg)
+		}
+		_ = stream.Send(secrt.WatchTimeout, "", jtp.None{})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWatchReconnect(t *testing.T) {
+	inbox := &testInbox{}
+	server := httptest.NewServer(inbox)
+	defer server.Close()
+
+	serverKey, _ := newKey(t)
+	_, privateKey := newKey(t)
+	vault := NewClearVault()
+	if err := vault.Set("authToken", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	if err := vault.Set("privateKey", privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, _ := testEndpoint(t)
+	endpoint.URL = server.URL + "/"
+	endpoint.ServerKey = serverKey
+	endpoint.Vaults = []*StorageEnvelope{{VaultType: VaultClear, vault: vault}}
+
+	reported := filepath.Join(t.TempDir(), "reported")
+	w := &watcher{config: &Config{}, endpoint: endpoint, command: "echo $SECRT_MESSAGE >> " + reported}
+
+	// The claims can't be decrypted, so the messages are reported as invalid, which doesn't matter here.
+	claims := make([]byte, 64)
+	old := secrt.Message{Message: uuid.New(), Claims: claims}
+	missed := secrt.Message{Message: uuid.New(), Claims: claims}
+	streamed := secrt.Message{Message: uuid.New(), Claims: claims}
+
+	// Messages that are waiting when the watch starts aren't reported.
+	inbox.messages = []secrt.Message{old}
+	if err := w.replay(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.watch(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message arrives while the client is disconnected. It's found in the inbox when the client
+	// reconnects, and isn't reported again when it's streamed too.
+	inbox.lock.Lock()
+	inbox.messages = append(inbox.messages, missed)
+	inbox.events = []secrt.Message{missed, streamed}
+	inbox.lock.Unlock()
+
+	if err := w.watch(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(reported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{missed.Message.String(), streamed.Message.String()}
+	if lines := strings.Fields(string(content)); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %v to be reported, got %v", expected, lines)
+	}
+}
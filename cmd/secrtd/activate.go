@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -16,43 +20,120 @@ import (
 //go:embed ui/activate.html
 var activatePage string
 
+// NewAuthenticationToken returns a new, encrypted authentication token for the given peer.
+// Tokens are never issued before the peer's TokensAfter time, so a token issued immediately
+// after a logout is still valid.
+func (server *SecretServer) NewAuthenticationToken(peer *Peer) ([]byte, error) {
+	authToken := AuthenticationToken{
+		Issued: max(time.Now().Unix(), peer.TokensAfter.Unix()),
+		Peer:   peer.Peer,
+		Alias:  peer.Alias,
+	}
+
+	authTokenBytes, err := json.Marshal(&authToken)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize token: %w", err)
+	}
+
+	authTokenCipher, err := server.EncryptSecret(authTokenBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt token: %w", err)
+	}
+
+	return authTokenCipher, nil
+}
+
 // activation returns a token which is used in authentication.
 func (server *SecretServer) handlePostActivate(r *http.Request, req *secrt.ActivationRequest) (*secrt.ActivationResponse, error) {
 	token, err := base64.RawURLEncoding.DecodeString(req.Token)
 	if err != nil {
-		return nil, jtp.BadRequestError(fmt.Errorf("invalid token: %w", err))
+		return nil, jtp.BadRequestError(jtp.Wrapf(err, "invalid token"))
 	}
 
-	var peer uuid.UUID
-	var alias string
-	row := PGXPool.QueryRow(r.Context(), "select _peer, _alias from secrt.activate($1, $2)", token, req.Code)
-	err = row.Scan(&peer, &alias)
+	peer, err := Storage.Activate(r.Context(), token, req.Code)
 	if err != nil {
-		return nil, jtp.BadRequestError(fmt.Errorf("unable to retrieve token: %w", err))
+		if errors.Is(err, ErrUnknownActivation) {
+			return nil, jtp.BadRequestError(jtp.Wrapf(err, "activation token not found")).WithCode(secrt.ErrorInvalidActivation)
+		}
+		return nil, jtp.BadRequestError(jtp.Wrapf(err, "unable to retrieve token"))
 	}
 
-	authToken := AuthenticationToken{
-		Issued: time.Now().Unix(),
-		Peer:   peer,
-		Alias:  alias,
+	// The alias isn't stored, so it's only included in the token if the client supplied it.
+	if req.Alias != "" && bytes.Equal(server.AliasHash(req.Alias), peer.AliasHash) {
+		peer.Alias = req.Alias
 	}
 
-	authTokenBytes, err := json.Marshal(&authToken)
+	authTokenCipher, err := server.NewAuthenticationToken(peer)
 	if err != nil {
-		return nil, jtp.BadRequestError(fmt.Errorf("unable to serialize token: %w", err))
+		return nil, jtp.InternalServerError(err)
 	}
 
-	authTokenCipher, err := server.EncryptSecret(authTokenBytes)
+	// The peer is activated, so a failure to send the welcome message or link the peer to
+	// their inviters isn't fatal.
+	if err = server.sendWelcome(r.Context(), peer); err != nil {
+		log.Printf("unable to send welcome message to %s: %v", peer, err)
+	}
+
+	inviters, err := server.acceptInvites(r.Context(), peer)
 	if err != nil {
-		return nil, jtp.BadRequestError(fmt.Errorf("unable to encrypt token: %w", err))
+		log.Printf("unable to accept invites for %s: %v", peer, err)
 	}
 
 	return &secrt.ActivationResponse{
-		Message: "Welcome to secrt!",
-		Token:   authTokenCipher,
+		Message:  "Welcome to secrt!",
+		Token:    authTokenCipher,
+		Expiry:   tokenExpiry(),
+		Inviters: inviters,
 	}, nil
 }
 
+// sendWelcome puts the server's welcome message (SECRT_WELCOME_MESSAGE) in a new peer's inbox.
+// The message is sent by the server's own peer, so it's encrypted and claimed like any other.
+func (server *SecretServer) sendWelcome(ctx context.Context, peer *Peer) error {
+	if Config.WelcomeMessage == "" {
+		return nil
+	}
+
+	sender := server.Peer()
+
+	metadata, err := json.Marshal(&secrt.Metadata{
+		Description: "Welcome to secrt",
+		Size:        len(Config.WelcomeMessage),
+		Sender:      sender.Alias,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to marshal metadata: %w", err)
+	}
+
+	policy, err := server.GetPolicy(ctx, peer)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	msg := &Message{
+		Server:   server.Server,
+		Peer:     peer.Peer,
+		Message:  uuid.New(),
+		Received: now,
+		Expiry:   now.Add(policy.Lifetime(0)),
+	}
+
+	if msg.Metadata, err = server.Encrypt(metadata, peer.PublicKey); err != nil {
+		return fmt.Errorf("unable to encrypt metadata: %w", err)
+	}
+
+	if msg.Payload, err = server.Encrypt([]byte(Config.WelcomeMessage), peer.PublicKey); err != nil {
+		return fmt.Errorf("unable to encrypt message: %w", err)
+	}
+
+	if msg.Claims, err = server.GetClaims(msg, sender, peer); err != nil {
+		return err
+	}
+
+	return Storage.AddMessages(ctx, msg)
+}
+
 // Display the activation web page.
 func handleGetActivate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
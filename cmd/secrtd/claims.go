@@ -31,19 +31,46 @@ func (server *SecretServer) Encrypt(plaintext []byte, peerKey []byte) ([]byte, e
 	return box.Seal(ciphertext, plaintext, &nonce, secrt.To32(peerKey), secrt.To32(server.PrivateBoxKey)), nil
 }
 
+// Decrypt opens a message sealed by a peer for the server, using the peer's public key.
+func (server *SecretServer) Decrypt(ciphertext []byte, peerKey []byte) ([]byte, error) {
+	// Check that the version number works with us.
+	if len(ciphertext) < 25 || ciphertext[0] != 0 {
+		return nil, fmt.Errorf("unsupported ciphertext")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], ciphertext[1:25])
+
+	plaintext, ok := box.Open(nil, ciphertext[25:], &nonce, secrt.To32(peerKey), secrt.To32(server.PrivateBoxKey))
+	if !ok {
+		return nil, fmt.Errorf("unable to authenticate message")
+	}
+
+	return plaintext, nil
+}
+
 // GetClaims returns a sealed set of claims, effectively a server-supplied signature over the message
-// that asserts a sender's identity.
+// that asserts a sender's identity. The sender is identified by their alias hash, which the recipient
+// compares with the alias in the message metadata.
 func (server *SecretServer) GetClaims(msg *Message, sender *Peer, recipient *Peer) ([]byte, error) {
 	payloadHash := sha256.Sum256(msg.Payload)
+	return server.getClaims(msg, payloadHash[:], sender, recipient)
+}
+
+// getClaims is like GetClaims, but the hash of the payload is supplied by the caller. Streamed
+// payloads are hashed as they're stored.
+func (server *SecretServer) getClaims(msg *Message, payloadHash []byte, sender *Peer, recipient *Peer) ([]byte, error) {
 	metadataHash := sha256.Sum256(msg.Metadata)
 
 	claim := &secrt.Claims{
 		Message:      msg.Message,
-		Alias:        sender.Alias,
+		Sender:       sender.AliasHash,
 		PublicKey:    sender.PublicKey,
-		PayloadHash:  payloadHash[:],
+		PayloadHash:  payloadHash,
 		MetadataHash: metadataHash[:],
 		Timestamp:    time.Now().Unix(),
+		Expiry:       msg.Expiry.Unix(),
+		Burn:         msg.Burn,
 	}
 
 	claimBytes, err := json.Marshal(claim)
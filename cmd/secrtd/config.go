@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net/mail"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -14,14 +16,45 @@ const (
 )
 
 var Config struct {
-	DatabaseDSN      string `split_words:"true"`
-	Store            string `split_words:"true"`
-	SignatureSkew    int64  `split_words:"true" default:"5"`
-	ChallengeSize    int    `split_words:"true" default:"20"` // Incrementing by 1 *doubles* the complexity
-	PathPrefix       string `split_words:"true" default:"/"`
-	ServerConfigPath string `split_words:"true" default:"./server.json"`
-	EnrolAction      string `split_words:"true" default:"mail"` // What to do for enrolment requests
-	EnrolFile        string `split_words:"true"`                // Optional filename
+	DatabaseDSN           string        `split_words:"true"`
+	Store                 string        `split_words:"true" default:"postgres"`              // "postgres" or "memory"
+	Hostname              string        `split_words:"true" default:"http://localhost:8080"` // Server created at startup by the memory store
+	SignatureSkew         int64         `split_words:"true" default:"5"`
+	ChallengeSize         int           `split_words:"true" default:"20"` // Incrementing by 1 *doubles* the complexity
+	PathPrefix            string        `split_words:"true" default:"/"`
+	ServerConfigPath      string        `split_words:"true" default:"./server.json"`
+	EnrolAction           string        `split_words:"true" default:"mail"`    // What to do for enrolment requests
+	EnrolFile             string        `split_words:"true"`                   // Optional filename
+	MessageLifetime       time.Duration `split_words:"true" default:"24h"`     // How long unread messages are kept
+	MaxLifetime           time.Duration `split_words:"true" default:"24h"`     // Longest lifetime a sender can request
+	PurgeInterval         time.Duration `split_words:"true" default:"5m"`      // How often expired messages are purged
+	MaxRequestSize        int64         `split_words:"true" default:"65536"`   // Largest request body, in bytes
+	MaxMessageRequestSize int64         `split_words:"true" default:"1048576"` // Largest message request, if the policy has no size limits
+	MaxTokenAge           time.Duration `split_words:"true" default:"2160h"`   // How long authentication tokens last; zero means forever
+	InviteLifetime        time.Duration `split_words:"true" default:"168h"`    // How long invites last before the allowance is returned
+	WatchTimeout          time.Duration `split_words:"true" default:"5m"`      // How long GET /inbox/watch runs before the client reconnects
+
+	// WelcomeMessage is sent to each new peer, from the server. Set it to "" to disable it.
+	WelcomeMessage string `split_words:"true" default:"Welcome to secrt! Use 'secrt ls' to see the secrets waiting for you, and 'secrt send' to send one."`
+
+	// Mail delivery. Templates in MailTemplates override the defaults, and can be overridden
+	// for each server by placing them in a subdirectory named after the server's hostname.
+	Mailer        string            `split_words:"true" default:"smtp"` // "smtp", "mbox" or "memory"
+	MailFrom      string            `split_words:"true" default:"secrt <noreply@secrt.io>"`
+	MailTemplates string            `split_words:"true"`             // Optional directory
+	MailRetries   int               `split_words:"true" default:"5"` // Retries after a failed delivery
+	SmtpHost      string            `split_words:"true"`
+	SmtpPort      int               `split_words:"true" default:"587"`
+	SmtpUsername  string            `split_words:"true"`
+	SmtpPassword  string            `split_words:"true"`
+	SmtpHeaders   map[string]string `split_words:"true"`                        // Extra headers, eg "X-PM-Message-Stream:outbound"
+	MboxFile      string            `split_words:"true" default:"./secrt.mbox"` // Used by the mbox mailer
+
+	// Notification emails, for peers who ask for them. See notify.go.
+	NotifyDelay    time.Duration `split_words:"true" default:"1m"`   // How long to wait for more messages before notifying
+	NotifyInterval time.Duration `split_words:"true" default:"1h"`   // Shortest time between notifications to a peer
+	NotifySender   bool          `split_words:"true" default:"true"` // Include the senders' aliases, if they're known
+	NotifyKey      string        `split_words:"true"`                // Base64 key for notification addresses; unset disables them
 }
 
 func initConfig() error {
@@ -37,6 +70,62 @@ func initConfig() error {
 		return fmt.Errorf("invalid enrolment action: %s", Config.EnrolAction)
 	}
 
+	if !slices.Contains([]string{StorePostgres, StoreMemory}, Config.Store) {
+		return fmt.Errorf("invalid store: %s", Config.Store)
+	}
+
+	if !slices.Contains([]string{MailerSMTP, MailerMbox, MailerMemory}, Config.Mailer) {
+		return fmt.Errorf("invalid mailer: %s", Config.Mailer)
+	}
+
+	if Config.MailRetries < 0 {
+		return fmt.Errorf("SECRT_MAIL_RETRIES must not be negative")
+	}
+
+	if _, err := mail.ParseAddress(Config.MailFrom); err != nil {
+		return fmt.Errorf("invalid SECRT_MAIL_FROM: %w", err)
+	}
+
+	if Config.SmtpPort <= 0 || Config.SmtpPort > 65535 {
+		return fmt.Errorf("invalid SECRT_SMTP_PORT: %d", Config.SmtpPort)
+	}
+
+	if Config.Mailer == MailerMbox && Config.MboxFile == "" {
+		return fmt.Errorf("SECRT_MAILER is 'mbox' but no SECRT_MBOX_FILE is specified")
+	}
+
+	if Config.MessageLifetime <= 0 {
+		return fmt.Errorf("SECRT_MESSAGE_LIFETIME must be positive")
+	}
+
+	if Config.MaxLifetime < Config.MessageLifetime {
+		return fmt.Errorf("SECRT_MAX_LIFETIME must be at least SECRT_MESSAGE_LIFETIME")
+	}
+
+	if Config.PurgeInterval <= 0 {
+		return fmt.Errorf("SECRT_PURGE_INTERVAL must be positive")
+	}
+
+	if Config.MaxRequestSize <= 0 || Config.MaxMessageRequestSize <= 0 {
+		return fmt.Errorf("SECRT_MAX_REQUEST_SIZE and SECRT_MAX_MESSAGE_REQUEST_SIZE must be positive")
+	}
+
+	if Config.InviteLifetime <= 0 {
+		return fmt.Errorf("SECRT_INVITE_LIFETIME must be positive")
+	}
+
+	if Config.NotifyDelay < 0 || Config.NotifyInterval < 0 {
+		return fmt.Errorf("SECRT_NOTIFY_DELAY and SECRT_NOTIFY_INTERVAL must not be negative")
+	}
+
+	if Config.WatchTimeout <= 0 {
+		return fmt.Errorf("SECRT_WATCH_TIMEOUT must be positive")
+	}
+
+	if Config.MaxTokenAge < 0 {
+		return fmt.Errorf("SECRT_MAX_TOKEN_AGE must not be negative")
+	}
+
 	if Config.EnrolAction == EnrolFile && Config.EnrolFile == "" {
 		return fmt.Errorf("SECRT_ENROL_ACTION is 'file' but no SECRT_ENROL_FILE is specified")
 	}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,22 +20,22 @@ func (server *SecretServer) verifyChallenge(r *http.Request) error {
 	// enrolment requires a challenge and nonce header.
 	challenge64 := r.Header.Get("Challenge")
 	if challenge64 == "" {
-		return jtp.ForbiddenError(fmt.Errorf("no challenge provided"))
+		return jtp.ForbiddenError(jtp.Errorf("no challenge provided")).WithCode(secrt.ErrorInvalidChallenge)
 	}
 
 	nonceStr := r.Header.Get("Nonce")
 	if nonceStr == "" {
-		return jtp.ForbiddenError(fmt.Errorf("no nonce provided"))
+		return jtp.ForbiddenError(jtp.Errorf("no nonce provided")).WithCode(secrt.ErrorInvalidChallenge)
 	}
 
 	challenge, err := base64.StdEncoding.DecodeString(challenge64)
 	if err != nil {
-		return jtp.BadRequestError(fmt.Errorf("invalid challenge encoding: %w", err))
+		return jtp.BadRequestError(jtp.Wrapf(err, "invalid challenge encoding"))
 	}
 
 	nonce, err := strconv.ParseUint(nonceStr, 10, 64)
 	if err != nil {
-		return jtp.BadRequestError(fmt.Errorf("invalid nonce encoding: %w", err))
+		return jtp.BadRequestError(jtp.Wrapf(err, "invalid nonce encoding"))
 	}
 
 	challengeResponse := &secrt.ChallengeResponse{
@@ -41,7 +44,10 @@ func (server *SecretServer) verifyChallenge(r *http.Request) error {
 	}
 
 	if err = secrt.ValidateResponse(challengeResponse, server.PublicSignKey); err != nil {
-		return jtp.ForbiddenError(fmt.Errorf("invalid challenge solution: %w", err))
+		if errors.Is(err, secrt.ErrChallengeExpired) {
+			return jtp.ForbiddenError(jtp.Wrapf(err, "challenge expired")).WithCode(secrt.ErrorChallengeExpired)
+		}
+		return jtp.ForbiddenError(jtp.Wrapf(err, "invalid challenge solution")).WithCode(secrt.ErrorInvalidChallenge)
 	}
 
 	return nil
@@ -54,11 +60,22 @@ type ActivationToken struct {
 	Code   int
 }
 
-func (server *SecretServer) sendActivationToken(token *ActivationToken) error {
+func (server *SecretServer) sendActivationToken(ctx context.Context, token *ActivationToken) error {
 	switch Config.EnrolAction {
 	case EnrolMail:
-		// Queue the email up
-		ActivateMailChannel <- token
+		// Queue the email up. If the queue stays full, the peer has to enrol again.
+		ctx, cancel := context.WithTimeout(ctx, mailQueueTimeout)
+		defer cancel()
+
+		err := queueMail(ctx, &MailRequest{
+			To:       token.Peer,
+			Template: "activation",
+			Server:   server,
+			Values:   token,
+		})
+		if err != nil {
+			return jtp.ServiceUnavailableError(jtp.Wrapf(err, "unable to send an activation code; try again later"))
+		}
 	case EnrolFile:
 		// File is used only in testing.
 		f, err := os.OpenFile(Config.EnrolFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -81,18 +98,20 @@ func (server *SecretServer) sendActivationToken(token *ActivationToken) error {
 func (server *SecretServer) handleEnrol(r *http.Request, req *secrt.EnrolmentRequest) (*secrt.EnrolmentResponse, error) {
 
 	if err := server.verifyChallenge(r); err != nil {
-		return nil, jtp.ForbiddenError(err)
+		return nil, err
 	}
 
 	alias := r.PathValue("alias")
 	log.Printf("challenge response accepted for enrolment request from peer %s", alias)
 
-	var token []byte
-	var code int
+	// The server's own identity can't be claimed by a peer.
+	if alias == secrt.ServerAlias || bytes.Equal(req.PublicKey, server.PublicBoxKey) {
+		return nil, jtp.BadRequestError(jtp.Errorf("alias %s is reserved", alias))
+	}
 
 	// Generate a token.
-	row := PGXPool.QueryRow(r.Context(), "select _token, _code from secrt.enrol($1, $2, $3)", server.Server, alias, req.PublicKey)
-	if err := row.Scan(&token, &code); err != nil {
+	token, code, err := Storage.Enrol(r.Context(), server.Server, server.AliasHash(alias), req.PublicKey)
+	if err != nil {
 		return nil, fmt.Errorf("unable to create token: %w", err)
 	}
 
@@ -104,8 +123,8 @@ func (server *SecretServer) handleEnrol(r *http.Request, req *secrt.EnrolmentReq
 		Code:   code,
 	}
 
-	if err := server.sendActivationToken(activationToken); err != nil {
-		return nil, jtp.InternalServerError(err)
+	if err := server.sendActivationToken(r.Context(), activationToken); err != nil {
+		return nil, err
 	}
 
 	var msg string
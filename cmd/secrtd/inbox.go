@@ -1,9 +1,7 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
@@ -15,29 +13,17 @@ func (server *SecretServer) handleGetInbox(r *http.Request, _ *jtp.None) (*secrt
 		return nil, aerr
 	}
 
-	rows, err := PGXPool.Query(r.Context(),
-		`select message, received, metadata, claims from secrt.message
-				where message.server=$1 and message.peer=$2 order by received`, server.Server, peer.Peer)
+	messages, err := Storage.GetInbox(r.Context(), server.Server, peer.Peer)
 	if err != nil {
-		return nil, jtp.InternalServerError(fmt.Errorf("unable to query inbox: %w", err))
+		return nil, jtp.InternalServerError(err)
 	}
 
-	defer rows.Close()
-
 	inbox := &secrt.Inbox{
 		Messages: []secrt.Message{},
 	}
 
-	for rows.Next() {
-		var timestamp time.Time
-		msg := secrt.Message{}
-		if err := rows.Scan(&msg.Message, &timestamp, &msg.Metadata, &msg.Claims); err != nil {
-			return nil, jtp.InternalServerError(fmt.Errorf("unable to read inbox: %w", err))
-		}
-
-		msg.Timestamp = timestamp.Unix()
-
-		inbox.Messages = append(inbox.Messages, msg)
+	for _, msg := range messages {
+		inbox.Messages = append(inbox.Messages, inboxMessage(msg))
 	}
 
 	// 204 just means there's nothing here. No messages!
@@ -47,3 +33,15 @@ func (server *SecretServer) handleGetInbox(r *http.Request, _ *jtp.None) (*secrt
 
 	return inbox, nil
 }
+
+// inboxMessage returns the inbox entry for a message, which doesn't include the payload.
+func inboxMessage(msg *Message) secrt.Message {
+	return secrt.Message{
+		Message:   msg.Message,
+		Timestamp: msg.Received.Unix(),
+		Expiry:    msg.Expiry.Unix(),
+		Metadata:  msg.Metadata,
+		Claims:    msg.Claims,
+		Burn:      msg.Burn,
+	}
+}
@@ -1,19 +1,113 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"net/mail"
+	"time"
 
 	"github.com/commandquery/secrt/jtp"
 )
 
+// Invitation is the information needed to send an invite email.
+type Invitation struct {
+	Server  *SecretServer
+	Inviter string
+	Invitee string
+	Expiry  time.Time
+}
+
+// handleInvite records an invite from the authenticated peer, and emails it to the invitee.
+// Pending invites count against the peer's invite allowance.
+//
+// The response is the same whether or not the invitee is already a peer, so invites can't be
+// used to find out who has enrolled. Peers aren't emailed, and neither is anyone who already
+// has an invite from this peer that hasn't expired.
 func (server *SecretServer) handleInvite(r *http.Request, _ *jtp.None) (*jtp.None, error) {
-	_, aerr := server.Authenticate(r)
+	peer, aerr := server.Authenticate(r)
 	if aerr != nil {
 		return nil, aerr
 	}
 
 	alias := r.PathValue("alias")
-	log.Println("received invite request for user:", alias)
+	if _, err := mail.ParseAddress(alias); err != nil {
+		return nil, jtp.BadRequestError(jtp.Errorf("invalid email address %q", alias))
+	}
+
+	policy, err := server.GetPolicy(r.Context(), peer)
+	if err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	invitation := &Invitation{
+		Server:  server,
+		Inviter: peer.Alias,
+		Invitee: alias,
+		Expiry:  time.Now().Add(Config.InviteLifetime),
+	}
+
+	// The token doesn't always identify the peer by alias.
+	if invitation.Inviter == "" {
+		invitation.Inviter = "a secrt user"
+	}
+
+	created, err := Storage.AddInvite(r.Context(), server.Server, peer.Peer, server.AliasHash(alias), invitation.Expiry, policy.Invites)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return nil, policy.inviteViolation()
+	}
+
+	if err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	if _, enrolled := server.GetPeer(alias); created && !enrolled {
+		server.sendInvitation(r.Context(), invitation)
+	}
+
 	return nil, nil
 }
+
+// sendInvitation emails an invitation. Like activation tokens, invitations aren't emailed
+// when SECRT_ENROL_ACTION is "file", which is only used for testing.
+//
+// The invite has already been recorded, and inviting the same peer again doesn't send another
+// email, so this waits for room in the mail queue even if the request is cancelled. Invites are
+// limited by the invite quota, so they can't pile up.
+func (server *SecretServer) sendInvitation(ctx context.Context, invitation *Invitation) {
+	switch Config.EnrolAction {
+	case EnrolMail:
+		err := queueMail(context.WithoutCancel(ctx), &MailRequest{
+			To:       invitation.Invitee,
+			Template: "invite",
+			Server:   server,
+			Values:   invitation,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	case EnrolFile:
+		log.Printf("invitation for %s from %s", invitation.Invitee, invitation.Inviter)
+	}
+}
+
+// acceptInvites links a newly activated peer to the peers who invited them, and returns their
+// alias hashes. The oldest invite uses up one of the inviter's invites.
+func (server *SecretServer) acceptInvites(ctx context.Context, peer *Peer) ([][]byte, error) {
+	inviters, err := Storage.AcceptInvites(ctx, server.Server, peer.AliasHash, today())
+	if err != nil || len(inviters) == 0 {
+		return nil, err
+	}
+
+	var aliasHashes [][]byte
+	for _, id := range inviters {
+		inviter, err := Storage.GetPeerByID(ctx, server.Server, id)
+		if err != nil {
+			return nil, err
+		}
+		aliasHashes = append(aliasHashes, inviter.AliasHash)
+	}
+
+	return aliasHashes, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wneessen/go-mail"
+)
+
+const (
+	MailerSMTP   = "smtp"
+	MailerMbox   = "mbox"
+	MailerMemory = "memory"
+)
+
+// Mail is the mailer used to deliver emails. It's initialised by initMailer, based on
+// the value of SECRT_MAILER.
+var Mail Mailer
+
+// Mailer delivers emails. SMTPMailer is the production implementation. MboxMailer appends
+// emails to a file, and MemoryMailer keeps them in memory, which is handy for testing.
+type Mailer interface {
+	Send(ctx context.Context, email *Email) error
+}
+
+// Email is a rendered email. The HTML part is optional.
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// message converts the email to a go-mail message, which is used by the SMTP and mbox mailers.
+func (email *Email) message() (*mail.Msg, error) {
+	message := mail.NewMsg()
+	if err := message.From(Config.MailFrom); err != nil {
+		return nil, fmt.Errorf("failed to set FROM address: %w", err)
+	}
+
+	if err := message.To(email.To); err != nil {
+		return nil, fmt.Errorf("failed to set TO address: %w", err)
+	}
+
+	message.Subject(email.Subject)
+	message.SetBodyString(mail.TypeTextPlain, email.Text)
+	if email.HTML != "" {
+		message.AddAlternativeString(mail.TypeTextHTML, email.HTML)
+	}
+
+	for key, value := range Config.SmtpHeaders {
+		message.SetGenHeader(mail.Header(key), value)
+	}
+
+	return message, nil
+}
+
+// SMTPMailer delivers emails using the SECRT_SMTP_* settings.
+type SMTPMailer struct {
+	client *mail.Client
+}
+
+func NewSMTPMailer() (*SMTPMailer, error) {
+	if Config.SmtpHost == "" {
+		return nil, fmt.Errorf("SECRT_SMTP_HOST must be set when SECRT_MAILER is %q", MailerSMTP)
+	}
+
+	options := []mail.Option{mail.WithPort(Config.SmtpPort), mail.WithTLSPortPolicy(mail.TLSMandatory)}
+	if Config.SmtpUsername != "" {
+		options = append(options, mail.WithSMTPAuth(mail.SMTPAuthAutoDiscover),
+			mail.WithUsername(Config.SmtpUsername), mail.WithPassword(Config.SmtpPassword))
+	}
+
+	client, err := mail.NewClient(Config.SmtpHost, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mail client: %w", err)
+	}
+
+	return &SMTPMailer{client: client}, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, email *Email) error {
+	message, err := email.message()
+	if err != nil {
+		return err
+	}
+
+	return m.client.DialAndSendWithContext(ctx, message)
+}
+
+// MboxMailer appends emails to a file in mbox format, so they can be read with a mail client.
+type MboxMailer struct {
+	lock sync.Mutex
+	path string
+}
+
+func NewMboxMailer(path string) *MboxMailer {
+	return &MboxMailer{path: path}
+}
+
+func (m *MboxMailer) Send(ctx context.Context, email *Email) error {
+	message, err := email.message()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if _, err = message.WriteTo(&buf); err != nil {
+		return fmt.Errorf("unable to write message: %w", err)
+	}
+
+	// Each message starts with a "From " line, so lines in the message that look like one are quoted.
+	var mbox strings.Builder
+	fmt.Fprintf(&mbox, "From secrt %s\n", time.Now().UTC().Format(time.ANSIC))
+	for line := range strings.Lines(strings.ReplaceAll(buf.String(), "\r\n", "\n")) {
+		if strings.HasPrefix(line, "From ") {
+			mbox.WriteString(">")
+		}
+		mbox.WriteString(line)
+	}
+	mbox.WriteString("\n\n")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open mailbox: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(mbox.String())
+	return err
+}
+
+// MemoryMailer keeps emails in memory, instead of sending them.
+type MemoryMailer struct {
+	lock   sync.Mutex
+	emails []*Email
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, email *Email) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+// Emails returns the emails that have been sent so far.
+func (m *MemoryMailer) Emails() []*Email {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]*Email(nil), m.emails...)
+}
+
+// initMailer creates the mailer. It's only needed by the server itself, so commands such as
+// "secrtd add" work without any mail settings.
+func initMailer() error {
+	switch Config.Mailer {
+	case MailerSMTP:
+		mailer, err := NewSMTPMailer()
+		if err != nil {
+			return err
+		}
+		Mail = mailer
+	case MailerMbox:
+		Mail = NewMboxMailer(Config.MboxFile)
+	case MailerMemory:
+		Mail = NewMemoryMailer()
+	default:
+		return fmt.Errorf("unsupported mailer: %s", Config.Mailer)
+	}
+
+	return nil
+}
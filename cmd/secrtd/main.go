@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/commandquery/secrt"
 )
 
 // Temporary command to create a server.
@@ -22,16 +24,12 @@ func addServerCmd(hostname string) error {
 
 	ctx := context.Background()
 
-	_, err := PGXPool.Exec(ctx, "insert into secrt.server (server, secret_box_key, private_box_key, public_box_key, private_sign_key, public_sign_key) values ($1, $2, $3, $4, $5, $6)",
-		server.Server, server.SecretBoxKey, server.PrivateBoxKey, server.PublicBoxKey, server.PrivateSignKey, server.PublicSignKey)
-	if err != nil {
-		return fmt.Errorf("unable to add server: %w", err)
+	if err := Storage.AddServer(ctx, server); err != nil {
+		return err
 	}
 
-	_, err = PGXPool.Exec(ctx, "insert into secrt.hostname (hostname, server) values ($1, $2)",
-		hostname, server.Server)
-	if err != nil {
-		return fmt.Errorf("unable to add hostname: %w", err)
+	if err := Storage.AddHostname(ctx, hostname, server.Server); err != nil {
+		return err
 	}
 
 	return nil
@@ -39,11 +37,22 @@ func addServerCmd(hostname string) error {
 
 func main() {
 
-	mustInitPGX()
-	mustInitPgpkg()
+	if err := initConfig(); err != nil {
+		secrt.Exit(1, err)
+	}
 
-	// start as many mail pollers as you like, to increase concurrency.
-	startMailPoller(2)
+	mustInitStore()
+
+	if err := initNotifyKey(); err != nil {
+		secrt.Exit(1, err)
+	}
+
+	// The memory store starts empty, so it needs a server to talk to.
+	if Config.Store == StoreMemory {
+		if err := addServerCmd(Config.Hostname); err != nil {
+			secrt.Exit(1, err)
+		}
+	}
 
 	if len(os.Args) == 3 && os.Args[1] == "add" {
 		err := addServerCmd(os.Args[2])
@@ -54,6 +63,29 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Assign a plan to a server, or to one of its peers: secrtd plan <hostname> <plan> [alias]
+	if len(os.Args) >= 4 && os.Args[1] == "plan" {
+		var alias string
+		if len(os.Args) > 4 {
+			alias = os.Args[4]
+		}
+
+		if err := setPlanCmd(os.Args[2], os.Args[3], alias); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err := initMailer(); err != nil {
+		secrt.Exit(1, err)
+	}
+
+	// start as many mail pollers as you like, to increase concurrency.
+	startMailPoller(2)
+
+	startReaper(Config.PurgeInterval)
+
 	if err := StartServer(); err != nil {
 		panic(err)
 	}
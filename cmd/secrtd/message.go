@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 )
 
 // Message is the internal representation of a message. Use secrt.Message to
@@ -21,11 +26,38 @@ type Message struct {
 	Peer    uuid.UUID
 	Message uuid.UUID
 	//Sender      uuid.UUID
-	SenderAlias string
-	Received    time.Time
-	Metadata    []byte
-	Payload     []byte
-	Claims      []byte
+	Received   time.Time
+	Expiry     time.Time
+	Burn       bool
+	Metadata   []byte
+	Payload    []byte
+	Claims     []byte
+	Streamed   bool      // The payload was streamed, and is stored separately. See Store.AddPayload.
+	PayloadID  uuid.UUID // Identifies a streamed payload, which might be shared with other messages
+	PayloadKey []byte    // The key for a shared payload, wrapped for the recipient
+}
+
+// messageLimit returns the largest request that handlePostMessage will read from the authenticated peer.
+// It's derived from the peer's policy: the payload and metadata are base64 encoded, and SECRT_MAX_REQUEST_SIZE
+// allows for the rest of the envelope. If the policy doesn't limit the size of messages, SECRT_MAX_MESSAGE_REQUEST_SIZE
+// is used instead.
+func (server *SecretServer) messageLimit(r *http.Request) (int64, error) {
+	sender, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return 0, aerr
+	}
+
+	policy, err := server.GetPolicy(r.Context(), sender)
+	if err != nil {
+		return 0, jtp.InternalServerError(err)
+	}
+
+	if policy.MaxPayloadSize <= 0 || policy.MaxMetadataSize <= 0 {
+		return Config.MaxMessageRequestSize, nil
+	}
+
+	encoded := base64.StdEncoding.EncodedLen(policy.MaxPayloadSize) + base64.StdEncoding.EncodedLen(policy.MaxMetadataSize)
+	return int64(encoded) + Config.MaxRequestSize, nil
 }
 
 func (server *SecretServer) handlePostMessage(r *http.Request, envelope *secrt.SendRequest) (*secrt.SendResponse, error) {
@@ -36,46 +68,289 @@ func (server *SecretServer) handlePostMessage(r *http.Request, envelope *secrt.S
 
 	recipientID := r.PathValue("recipient")
 	if recipientID == "" {
-		return nil, jtp.BadRequestError(fmt.Errorf("missing recipient"))
+		return nil, jtp.BadRequestError(jtp.Errorf("missing recipient"))
 	}
 
 	recipient, ok := server.GetPeer(recipientID)
 	if !ok {
-		return nil, jtp.NotFoundError(fmt.Errorf("recipient not found"))
+		return nil, jtp.NotFoundError(jtp.Errorf("recipient not found")).WithCode(secrt.ErrorUnknownRecipient)
 	}
 
+	if len(envelope.RecipientKey) > 0 && !bytes.Equal(envelope.RecipientKey, recipient.PublicKey) {
+		return nil, jtp.ConflictError(jtp.Errorf("the public key for %s has changed", recipient.Alias)).WithCode(secrt.ErrorRecipientKey)
+	}
+
+	if err := server.checkTeam(r.Context(), make(map[string]*Team), envelope.Team, recipient); err != nil {
+		return nil, err
+	}
+
+	policy, err := server.GetPolicy(r.Context(), sender)
+	if err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	if perr := policy.CheckMessage(envelope); perr != nil {
+		return nil, perr
+	}
+
+	refund, err := server.UseMessages(r.Context(), policy, sender, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
 	newMessage := &Message{
-		Server:  server.Server,
-		Peer:    recipient.Peer,
-		Message: uuid.New(),
-		//Sender:      sender.Peer,
-		SenderAlias: sender.Alias,
-		Received:    time.Now(),
-		Metadata:    envelope.Metadata,
-		Payload:     envelope.Payload,
+		Server:   server.Server,
+		Peer:     recipient.Peer,
+		Message:  uuid.New(),
+		Received: now,
+		Expiry:   now.Add(policy.Lifetime(envelope.TTL)),
+		Burn:     envelope.Burn,
+		Metadata: envelope.Metadata,
+		Payload:  envelope.Payload,
 	}
 
-	var err error
 	newMessage.Claims, err = server.GetClaims(newMessage, sender, recipient)
 	if err != nil {
+		refund()
 		return nil, fmt.Errorf("unable to set message claims: %w", err)
 	}
 
-	_, err = PGXPool.Exec(r.Context(), "insert into secrt.message (server, peer, message, received, metadata, payload, claims) values ($1, $2, $3, $4, $5, $6, $7)",
-		newMessage.Server, newMessage.Peer, newMessage.Message, newMessage.Received, envelope.Metadata, envelope.Payload, newMessage.Claims)
-	if err != nil {
-		return nil, jtp.InternalServerError(fmt.Errorf("unable to insert message: %w", err))
+	if err = Storage.AddMessages(r.Context(), newMessage); err != nil {
+		refund()
+		return nil, jtp.InternalServerError(err)
 	}
 
-	//recipient.AddMessage(newMessage)
 	log.Println("sent message", newMessage.Message)
+	server.notify(sender, recipient)
 
 	// Tell the sender the message ID
 	return &secrt.SendResponse{
-		ID: newMessage.Message,
+		ID:     newMessage.Message,
+		Expiry: newMessage.Expiry.Unix(),
 	}, nil
 }
 
+// streamLimit returns the largest payload that handlePostStream will read from the authenticated peer.
+// If the policy doesn't limit the size of payloads, SECRT_MAX_MESSAGE_REQUEST_SIZE is used instead.
+func (server *SecretServer) streamLimit(r *http.Request) (int64, error) {
+	sender, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return 0, aerr
+	}
+
+	policy, err := server.GetPolicy(r.Context(), sender)
+	if err != nil {
+		return 0, jtp.InternalServerError(err)
+	}
+
+	if policy.MaxPayloadSize <= 0 {
+		return Config.MaxMessageRequestSize, nil
+	}
+
+	return int64(policy.MaxPayloadSize), nil
+}
+
+// handlePostStream is like handlePostMessage, but the request body is the payload itself, which is
+// stored as it's read. The rest of the envelope is sent in the Secrt-Envelope header.
+func (server *SecretServer) handlePostStream(r *http.Request, _ *jtp.None) (*secrt.SendResponse, error) {
+	sender, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	recipientID := r.PathValue("recipient")
+	if recipientID == "" {
+		return nil, jtp.BadRequestError(jtp.Errorf("missing recipient"))
+	}
+
+	var envelope secrt.SendRequest
+	if err := readEnvelope(r, &envelope); err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Payload) > 0 {
+		return nil, jtp.BadRequestError(jtp.Errorf("the payload must be sent in the request body"))
+	}
+
+	recipients := []*secrt.RecipientEnvelope{{
+		Alias:        recipientID,
+		RecipientKey: envelope.RecipientKey,
+		Team:         envelope.Team,
+		Metadata:     envelope.Metadata,
+	}}
+
+	responses, err := server.sendStream(r, sender, recipients, envelope.TTL, envelope.Burn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responses[0], nil
+}
+
+// handlePostShared sends a single streamed payload to several recipients. The payload is encrypted
+// with a key that's wrapped for each recipient, and it's only stored once. The recipients are listed
+// in the Secrt-Envelope header.
+func (server *SecretServer) handlePostShared(r *http.Request, _ *jtp.None) (*secrt.SharedSendResponse, error) {
+	sender, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	var envelope secrt.SharedSendRequest
+	if err := readEnvelope(r, &envelope); err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Recipients) == 0 {
+		return nil, jtp.BadRequestError(jtp.Errorf("missing recipients"))
+	}
+
+	for _, recipient := range envelope.Recipients {
+		if len(recipient.PayloadKey) == 0 {
+			return nil, jtp.BadRequestError(jtp.Errorf("missing payload key for %s", recipient.Alias))
+		}
+	}
+
+	responses, err := server.sendStream(r, sender, envelope.Recipients, envelope.TTL, envelope.Burn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secrt.SharedSendResponse{Messages: responses}, nil
+}
+
+// readEnvelope decodes the Secrt-Envelope header of a streamed message.
+func readEnvelope(r *http.Request, envelope any) error {
+	envelopeJS, err := base64.StdEncoding.DecodeString(r.Header.Get(secrt.EnvelopeHeader))
+	if err != nil {
+		return jtp.BadRequestError(jtp.Wrapf(err, "invalid envelope"))
+	}
+
+	if err = json.Unmarshal(envelopeJS, envelope); err != nil {
+		return jtp.BadRequestError(jtp.Wrapf(err, "invalid envelope"))
+	}
+
+	return nil
+}
+
+// sendStream stores the payload in the request body, and adds a message that refers to it to each
+// recipient's inbox. The responses are in the same order as the recipients. The messages count
+// towards the sender's daily limit before the payload is read, and are given back if they can't be
+// stored.
+func (server *SecretServer) sendStream(r *http.Request, sender *Peer, envelopes []*secrt.RecipientEnvelope, ttl int64, burn bool) (_ []secrt.SendResponse, err error) {
+	policy, err := server.GetPolicy(r.Context(), sender)
+	if err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	// Check all the recipients before the payload is read. Each recipient counts towards the daily limit.
+	recipients := make([]*Peer, len(envelopes))
+	teams := make(map[string]*Team)
+	for i, envelope := range envelopes {
+		recipient, ok := server.GetPeer(envelope.Alias)
+		if !ok {
+			return nil, jtp.NotFoundError(jtp.Errorf("recipient %s not found", envelope.Alias)).WithCode(secrt.ErrorUnknownRecipient)
+		}
+
+		if slices.ContainsFunc(recipients[:i], func(peer *Peer) bool { return peer.Peer == recipient.Peer }) {
+			return nil, jtp.BadRequestError(jtp.Errorf("duplicate recipient %s", envelope.Alias))
+		}
+
+		if len(envelope.RecipientKey) > 0 && !bytes.Equal(envelope.RecipientKey, recipient.PublicKey) {
+			return nil, jtp.ConflictError(jtp.Errorf("the public key for %s has changed", recipient.Alias)).WithCode(secrt.ErrorRecipientKey)
+		}
+
+		if err = server.checkTeam(r.Context(), teams, envelope.Team, recipient); err != nil {
+			return nil, err
+		}
+
+		if perr := policy.CheckMessage(&secrt.SendRequest{Metadata: envelope.Metadata}); perr != nil {
+			return nil, perr
+		}
+
+		recipients[i] = recipient
+	}
+
+	refund, err := server.UseMessages(r.Context(), policy, sender, len(recipients))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			refund()
+		}
+	}()
+
+	now := time.Now()
+	expiry := now.Add(policy.Lifetime(ttl))
+	payloadID := uuid.New()
+
+	// The payload is hashed as it's stored, so the claims can include the hash.
+	hash := sha256.New()
+	size, err := Storage.AddPayload(r.Context(), server.Server, payloadID, expiry, io.TeeReader(r.Body, hash))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			if policy.MaxPayloadSize > 0 {
+				return nil, policy.violation(http.StatusRequestEntityTooLarge, secrt.PolicyMaxPayloadSize, int64(policy.MaxPayloadSize),
+					"secret is too large (the limit is %d bytes)", policy.MaxPayloadSize)
+			}
+			return nil, jtp.RequestEntityTooLargeError(jtp.Errorf("secret is larger than the limit of %d bytes", maxBytesErr.Limit))
+		}
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to store payload: %w", err))
+	}
+
+	if size == 0 {
+		return nil, jtp.BadRequestError(jtp.Errorf("missing payload"))
+	}
+
+	payloadHash := hash.Sum(nil)
+	messages := make([]*Message, len(recipients))
+
+	for i, recipient := range recipients {
+		messages[i] = &Message{
+			Server:     server.Server,
+			Peer:       recipient.Peer,
+			Message:    uuid.New(),
+			Received:   now,
+			Expiry:     expiry,
+			Burn:       burn,
+			Metadata:   envelopes[i].Metadata,
+			Payload:    []byte{},
+			Streamed:   true,
+			PayloadID:  payloadID,
+			PayloadKey: envelopes[i].PayloadKey,
+		}
+
+		messages[i].Claims, err = server.getClaims(messages[i], payloadHash, sender, recipient)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set message claims: %w", err)
+		}
+	}
+
+	// The recipients get the message together, or not at all. If it isn't stored, the payload is
+	// purged when it expires.
+	if err = Storage.AddMessages(r.Context(), messages...); err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	responses := make([]secrt.SendResponse, len(recipients))
+	for i, recipient := range recipients {
+		log.Println("sent message", messages[i].Message, "streamed", size, "bytes")
+		server.notify(sender, recipient)
+
+		responses[i] = secrt.SendResponse{
+			ID:     messages[i].Message,
+			Expiry: messages[i].Expiry.Unix(),
+		}
+	}
+
+	return responses, nil
+}
+
 func (server *SecretServer) handleGetMessage(r *http.Request, _ *jtp.None) (*secrt.Message, error) {
 	peer, aerr := server.Authenticate(r)
 	if aerr != nil {
@@ -84,30 +359,106 @@ func (server *SecretServer) handleGetMessage(r *http.Request, _ *jtp.None) (*sec
 
 	id := r.PathValue("id")
 	if len(id) != 8 && len(id) != 36 {
-		return nil, jtp.BadRequestError(fmt.Errorf("invalid message id"))
+		return nil, jtp.BadRequestError(jtp.Errorf("invalid message id"))
 	}
 
 	msg, err := GetMessage(peer, id)
 	if err != nil {
 		if errors.Is(err, ErrUnknownMessageID) {
-			return nil, jtp.NotFoundError(err)
+			return nil, jtp.NotFoundError(jtp.Wrapf(err, "message not found")).WithCode(secrt.ErrorUnknownMessage)
 		}
 		if errors.Is(err, ErrAmbiguousMessageID) {
-			return nil, jtp.BadRequestError(err)
+			return nil, jtp.BadRequestError(jtp.Wrapf(err, "ambiguous message ID")).WithCode(secrt.ErrorAmbiguousMessageID)
 		}
 		return nil, jtp.InternalServerError(fmt.Errorf("error while retrieving message: %w", err))
 	}
 
+	// Burn-after-read messages are deleted before they're returned. If someone else deleted
+	// the message first (e.g. a concurrent read), then it's already gone. Streamed messages are
+	// deleted when the payload is read.
+	if msg.Burn && !msg.Streamed {
+		if err = msg.Delete(); err != nil {
+			if errors.Is(err, ErrUnknownMessageID) {
+				return nil, jtp.NotFoundError(jtp.Wrapf(err, "message not found")).WithCode(secrt.ErrorUnknownMessage)
+			}
+			return nil, jtp.InternalServerError(fmt.Errorf("unable to burn message: %w", err))
+		}
+	}
+
 	return &secrt.Message{
-		Message:   msg.Message,
-		Sender:    msg.SenderAlias,
-		Timestamp: msg.Received.Unix(),
-		Metadata:  msg.Metadata,
-		Payload:   msg.Payload,
-		Claims:    msg.Claims,
+		Message:    msg.Message,
+		Timestamp:  msg.Received.Unix(),
+		Expiry:     msg.Expiry.Unix(),
+		Metadata:   msg.Metadata,
+		Payload:    msg.Payload,
+		Claims:     msg.Claims,
+		Burn:       msg.Burn,
+		Streamed:   msg.Streamed,
+		PayloadKey: msg.PayloadKey,
 	}, nil
 }
 
+// handleGetStream writes the payload of a streamed message. Burn-after-read messages are deleted
+// once the whole payload has been sent.
+func (server *SecretServer) handleGetStream(w http.ResponseWriter, r *http.Request) error {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return aerr
+	}
+
+	id := r.PathValue("id")
+	if len(id) != 8 && len(id) != 36 {
+		return jtp.BadRequestError(jtp.Errorf("invalid message id"))
+	}
+
+	msg, err := GetMessage(peer, id)
+	if err != nil {
+		if errors.Is(err, ErrUnknownMessageID) {
+			return jtp.NotFoundError(jtp.Wrapf(err, "message not found")).WithCode(secrt.ErrorUnknownMessage)
+		}
+		if errors.Is(err, ErrAmbiguousMessageID) {
+			return jtp.BadRequestError(jtp.Wrapf(err, "ambiguous message ID")).WithCode(secrt.ErrorAmbiguousMessageID)
+		}
+		return jtp.InternalServerError(fmt.Errorf("error while retrieving message: %w", err))
+	}
+
+	if !msg.Streamed {
+		return jtp.NotFoundError(jtp.Errorf("message %s wasn't streamed", msg.Message)).WithCode(secrt.ErrorUnknownMessage)
+	}
+
+	// Nothing is written until the first chunk arrives, so the error can still be sent if the
+	// message has gone.
+	out := &streamWriter{w: w}
+	if err = Storage.GetPayload(r.Context(), server.Server, msg.Message, msg.Burn, out); err != nil {
+		if out.started {
+			log.Printf("unable to send payload for %s: %v", msg.Message, err)
+			return nil
+		}
+		if errors.Is(err, ErrUnknownMessageID) {
+			return jtp.NotFoundError(jtp.Wrapf(err, "message not found")).WithCode(secrt.ErrorUnknownMessage)
+		}
+		return jtp.InternalServerError(fmt.Errorf("unable to get payload: %w", err))
+	}
+
+	return nil
+}
+
+// streamWriter sets the content type of a streamed response when the first bytes are written.
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.started = true
+		sw.w.Header().Set("Content-Type", "application/octet-stream")
+		sw.w.WriteHeader(http.StatusOK)
+	}
+
+	return sw.w.Write(p)
+}
+
 func (server *SecretServer) handleDeleteMessage(r *http.Request, _ *jtp.None) (*jtp.None, error) {
 	peer, aerr := server.Authenticate(r)
 	if aerr != nil {
@@ -116,21 +467,24 @@ func (server *SecretServer) handleDeleteMessage(r *http.Request, _ *jtp.None) (*
 
 	id := r.PathValue("id")
 	if len(id) != 8 && len(id) != 36 {
-		return nil, jtp.BadRequestError(fmt.Errorf("invalid message id"))
+		return nil, jtp.BadRequestError(jtp.Errorf("invalid message id"))
 	}
 
 	msg, err := GetMessage(peer, id)
 	if err != nil {
 		if errors.Is(err, ErrUnknownMessageID) {
-			return nil, jtp.NotFoundError(err)
+			return nil, jtp.NotFoundError(jtp.Wrapf(err, "message not found")).WithCode(secrt.ErrorUnknownMessage)
 		}
 		if errors.Is(err, ErrAmbiguousMessageID) {
-			return nil, jtp.BadRequestError(err)
+			return nil, jtp.BadRequestError(jtp.Wrapf(err, "ambiguous message ID")).WithCode(secrt.ErrorAmbiguousMessageID)
 		}
 		return nil, err
 	}
 
 	if err = msg.Delete(); err != nil {
+		if errors.Is(err, ErrUnknownMessageID) {
+			return nil, jtp.NotFoundError(jtp.Wrapf(err, "message not found")).WithCode(secrt.ErrorUnknownMessage)
+		}
 		return nil, jtp.InternalServerError(fmt.Errorf("unable to delete message: %w", err))
 	}
 
@@ -138,12 +492,7 @@ func (server *SecretServer) handleDeleteMessage(r *http.Request, _ *jtp.None) (*
 }
 
 func (msg *Message) Delete() error {
-	_, err := PGXPool.Exec(context.Background(), "delete from secrt.message where server=$1 and message=$2", msg.Server, msg.Message)
-	if err != nil {
-		return fmt.Errorf("unable to delete message: %w", err)
-	}
-
-	return nil
+	return Storage.DeleteMessage(context.Background(), msg.Server, msg.Message)
 }
 
 // GetMessage finds a message by either it's full ID or its prefix.
@@ -152,55 +501,40 @@ func (msg *Message) Delete() error {
 // use the long ID to avoid potential duplicate message errors.
 func GetMessage(peer *Peer, messageId string) (*Message, error) {
 
-	ctx := context.Background()
-	msgQuery := "select message, received, metadata, payload, claims from secrt.message "
+	var lower, upper uuid.UUID
 
-	var rows pgx.Rows
-	var sqlErr error
-
-	// Perform a different query based on the length of the message ID.
+	// Perform a different search based on the length of the message ID.
 	// If it's an 8-hex-digit prefix, do a range search. Otherwise, do an exact search.
 	if len(messageId) == 8 {
 		prefix, err := prefixFromHex(messageId)
 		if err != nil {
 			return nil, fmt.Errorf("invalid message id %s: %w", messageId, err)
 		}
-		lower, upper := uuidBoundsFromPrefix(prefix)
-		rows, sqlErr = PGXPool.Query(ctx, msgQuery+"where message.server=$1 and message.peer=$2 and message between $3 and $4", peer.Server, peer.Peer, lower, upper)
+		lower, upper = uuidBoundsFromPrefix(prefix)
 	} else if len(messageId) == 36 {
 		exactId, err := uuid.Parse(messageId)
 		if err != nil {
 			return nil, ErrUnknownMessageID
 		}
-		rows, sqlErr = PGXPool.Query(ctx, msgQuery+"where message.server=$1 and message.peer=$2 and message=$3", peer.Server, peer.Peer, exactId)
+		lower, upper = exactId, exactId
 	} else {
 		return nil, fmt.Errorf("invalid message id %s", messageId)
 	}
 
-	if sqlErr != nil {
-		return nil, fmt.Errorf("unable to fetch messages: %w", sqlErr)
+	messages, err := Storage.FindMessages(context.Background(), peer.Server, peer.Peer, lower, upper)
+	if err != nil {
+		return nil, err
 	}
 
-	defer rows.Close()
-
-	if !rows.Next() {
+	if len(messages) == 0 {
 		return nil, ErrUnknownMessageID
 	}
 
-	msg := Message{
-		Server: peer.Server,
-		Peer:   peer.Peer,
-	}
-
-	if err := rows.Scan(&msg.Message, &msg.Received, &msg.Metadata, &msg.Payload, &msg.Claims); err != nil {
-		return nil, fmt.Errorf("unable to read message: %w", err)
-	}
-
-	// If the query returns multiple rows, we have two msg IDs with the same prefix.
+	// If the search returns multiple messages, we have two msg IDs with the same prefix.
 	// Rather than return the wrong secret, we error out.
-	if rows.Next() {
+	if len(messages) > 1 {
 		return nil, ErrAmbiguousMessageID
 	}
 
-	return &msg, nil
+	return messages[0], nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Notifications are batched and rate limited: the first message waits for SECRT_NOTIFY_DELAY so that
+// a burst of messages produces a single email, and a peer gets at most one email every
+// SECRT_NOTIFY_INTERVAL. Pending notifications are kept in memory, so they're lost if the server
+// restarts.
+var notifications = &notifier{
+	pending: make(map[uuid.UUID]*Notification),
+	sent:    make(map[uuid.UUID]time.Time),
+}
+
+// Notification is the information needed to send a notification email. It never contains
+// anything from the messages themselves.
+type Notification struct {
+	Server  *SecretServer
+	To      string
+	Count   int      // The number of messages received since the last notification
+	Senders []string // The aliases of the senders, if they're known and SECRT_NOTIFY_SENDER is set
+}
+
+// notifyKey encrypts the addresses of peers who have asked to be notified. It comes from
+// SECRT_NOTIFY_KEY rather than the database, so a copy of the database doesn't reveal the
+// addresses. Without it, peers can't ask to be notified.
+var notifyKey *[32]byte
+
+// initNotifyKey loads SECRT_NOTIFY_KEY. The memory store forgets everything when the server stops,
+// so it uses a random key if there isn't one.
+func initNotifyKey() error {
+	notifyKey = nil
+
+	if Config.NotifyKey == "" {
+		if Config.Store == StoreMemory {
+			notifyKey = new([32]byte)
+			_, err := rand.Read(notifyKey[:])
+			return err
+		}
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(Config.NotifyKey)
+	if err != nil || len(key) != len(notifyKey) {
+		return fmt.Errorf("SECRT_NOTIFY_KEY must be 32 bytes, base64 encoded")
+	}
+
+	notifyKey = secrt.To32(key)
+	return nil
+}
+
+// encryptAddress encrypts a notification address with the notify key.
+func encryptAddress(address string) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], []byte(address), &nonce, notifyKey), nil
+}
+
+// decryptAddress decrypts a notification address that was encrypted with the notify key.
+func decryptAddress(encrypted []byte) (string, error) {
+	if notifyKey == nil {
+		return "", errors.New("SECRT_NOTIFY_KEY isn't set")
+	}
+
+	if len(encrypted) < 24 {
+		return "", errors.New("ciphertext too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], encrypted[:24])
+
+	address, ok := secretbox.Open(nil, encrypted[24:], &nonce, notifyKey)
+	if !ok {
+		return "", errors.New("decryption failed")
+	}
+
+	return string(address), nil
+}
+
+type notifier struct {
+	lock    sync.Mutex
+	pending map[uuid.UUID]*Notification
+	sent    map[uuid.UUID]time.Time
+}
+
+// handlePostNotify sets how the authenticated peer is told about new messages.
+func (server *SecretServer) handlePostNotify(r *http.Request, req *secrt.NotifyRequest) (*jtp.None, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	var address []byte
+
+	switch req.Notify {
+	case secrt.NotifyNone:
+	case secrt.NotifyEmail:
+		if notifyKey == nil {
+			return nil, jtp.ForbiddenError(jtp.Errorf("this server doesn't send notifications"))
+		}
+
+		if !bytes.Equal(server.AliasHash(req.Address), peer.AliasHash) {
+			return nil, jtp.BadRequestError(jtp.Errorf("notification address for %s must be the peer's alias", peer))
+		}
+
+		var err error
+		if address, err = encryptAddress(req.Address); err != nil {
+			return nil, jtp.InternalServerError(err)
+		}
+	default:
+		return nil, jtp.BadRequestError(jtp.Errorf("unknown notification setting %q", req.Notify))
+	}
+
+	if err := Storage.SetNotify(r.Context(), server.Server, peer.Peer, address); err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	log.Printf("set notifications for %s to %s", peer, req.Notify)
+	return nil, nil
+}
+
+// notify tells the recipient that a message from the sender has arrived, if they've asked to be told.
+func (server *SecretServer) notify(sender *Peer, recipient *Peer) {
+	if recipient.Notify == nil {
+		return
+	}
+
+	address, err := decryptAddress(recipient.Notify)
+	if err != nil {
+		log.Printf("unable to decrypt notification address for %s: %v", recipient, err)
+		return
+	}
+
+	notifications.add(server, recipient.Peer, address, sender.Alias)
+}
+
+// add records a message for the recipient, and schedules a notification if there isn't one already.
+func (n *notifier) add(server *SecretServer, recipient uuid.UUID, address string, sender string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	notification, ok := n.pending[recipient]
+	if !ok {
+		notification = &Notification{Server: server, To: address}
+		n.pending[recipient] = notification
+
+		delay := Config.NotifyDelay
+		if next := time.Until(n.sent[recipient].Add(Config.NotifyInterval)); next > delay {
+			delay = next
+		}
+
+		time.AfterFunc(delay, func() { n.send(recipient) })
+	}
+
+	notification.Count++
+	if Config.NotifySender && sender != "" && !slices.Contains(notification.Senders, sender) {
+		notification.Senders = append(notification.Senders, sender)
+	}
+}
+
+// send queues the pending notification for the recipient.
+func (n *notifier) send(recipient uuid.UUID) {
+	n.lock.Lock()
+	notification := n.pending[recipient]
+	delete(n.pending, recipient)
+
+	now := time.Now()
+	n.sent[recipient] = now
+	for peer, sent := range n.sent {
+		if now.Sub(sent) > Config.NotifyInterval {
+			delete(n.sent, peer)
+		}
+	}
+	n.lock.Unlock()
+
+	// This runs on a timer, so it can wait for room in the queue without holding up a request. The
+	// context is never done, so the email is always queued.
+	_ = queueMail(context.Background(), &MailRequest{
+		To:       notification.To,
+		Template: "notify",
+		Server:   notification.Server,
+		Values:   notification,
+	})
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
@@ -13,10 +15,27 @@ import (
 
 // Peer is a peer who's enrolled in this server instance.
 type Peer struct {
-	Server    uuid.UUID
-	Peer      uuid.UUID
-	Alias     string
+	Server      uuid.UUID
+	Peer        uuid.UUID
+	Alias       string // never stored; only known if the request identified the peer by alias
+	AliasHash   []byte // see secrt.AliasHash
+	PublicKey   []byte
+	TokensAfter time.Time // Authentication tokens issued before this time are rejected
+	Notify      []byte    // Encrypted address for notification emails; nil if the peer hasn't opted in
+}
+
+// String identifies the peer in log messages. The alias isn't always known.
+func (peer *Peer) String() string {
+	if peer.Alias != "" {
+		return peer.Alias
+	}
+	return peer.Peer.String()
+}
+
+// PeerKey is a public key that was replaced using "secrt rekey".
+type PeerKey struct {
 	PublicKey []byte
+	Retired   time.Time
 }
 
 func prefixFromHex(s string) (uint32, error) {
@@ -38,16 +57,39 @@ func (server *SecretServer) handleGetPeer(r *http.Request, _ *jtp.None) (*secrt.
 
 	alias := r.PathValue("alias")
 	if alias == "" {
-		return nil, jtp.BadRequestError(fmt.Errorf("missing peer parameter"))
+		return nil, jtp.BadRequestError(jtp.Errorf("missing peer parameter"))
+	}
+
+	if alias == secrt.ServerAlias {
+		return server.peerResponse(r.Context(), server.Peer())
 	}
 
 	peer, ok := server.GetPeer(alias)
 	if !ok {
-		return nil, jtp.NotFoundError(fmt.Errorf("peer not found"))
+		return nil, jtp.NotFoundError(jtp.Errorf("peer not found")).WithCode(secrt.ErrorUnknownPeer)
 	}
 
-	return &secrt.Peer{
-		Peer:      alias,
+	return server.peerResponse(r.Context(), peer)
+}
+
+// peerResponse returns the public information about a peer, including the keys they've rotated out.
+func (server *SecretServer) peerResponse(ctx context.Context, peer *Peer) (*secrt.Peer, error) {
+	previousKeys, err := Storage.GetPreviousKeys(ctx, server.Server, peer.Peer)
+	if err != nil {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to get previous keys for %s: %w", peer, err))
+	}
+
+	response := &secrt.Peer{
+		Peer:      peer.Alias,
 		PublicKey: peer.PublicKey,
-	}, nil
+	}
+
+	for _, key := range previousKeys {
+		response.PreviousKeys = append(response.PreviousKeys, secrt.PeerKey{
+			PublicKey: key.PublicKey,
+			Retired:   key.Retired.Unix(),
+		})
+	}
+
+	return response, nil
 }
@@ -7,7 +7,7 @@ create or replace
     declare
         _token bytea;
         _code integer;
-        _alias text;
+        _alias_hash bytea = digest('test@example.com', 'sha256');
         _peer_id uuid;
         _peer secrt.peer;
         _public_key bytea = gen_random_bytes(32);
@@ -18,17 +18,15 @@ create or replace
         insert into secrt.server (server, secret_box_key, private_box_key, public_box_key, private_sign_key, public_sign_key)
             values (_server, gen_random_bytes(16), gen_random_bytes(16), gen_random_bytes(16), gen_random_bytes(16), gen_random_bytes(16));
 
-        select * into _token, _code from secrt.enrol(_server, 'test@example.com', _public_key);
+        select * into _token, _code from secrt.enrol(_server, _alias_hash, _public_key);
 
         raise notice 'enrolled token: % code %', _token, _code;
 
-        select * into _peer_id, _alias from secrt.activate(_token, _code);
-
-        perform _alias =? 'test@example.com';
+        select * into _peer_id from secrt.activate(_token, _code);
 
         raise notice 'got peer id %', _peer_id;
 
-        select * into _peer from secrt.peer where server=_server and alias=_alias;
+        select * into _peer from secrt.peer where server=_server and alias_hash=_alias_hash;
         if not found then
             raise exception 'activated peer not found';
         end if;
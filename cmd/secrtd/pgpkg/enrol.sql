@@ -3,7 +3,7 @@
 --
 
 create or replace
-    function secrt.enrol(_server uuid, _alias text, _public_key bytea, out _token bytea, out _code integer)
+    function secrt.enrol(_server uuid, _alias_hash bytea, _public_key bytea, out _token bytea, out _code integer)
       returns record language 'plpgsql' as $$
     declare
     begin
@@ -11,10 +11,10 @@ create or replace
         _code = floor(random() * 999999 + 1)::integer;
 
         -- cancel any previous enrolment requests
-        delete from secrt.activation where server=_server and alias=_alias;
+        delete from secrt.activation where server=_server and alias_hash=_alias_hash;
 
-        insert into secrt.activation (token, code, server, alias, public_box_key)
-            values (_token, _code, _server, _alias, _public_key);
+        insert into secrt.activation (token, code, server, alias_hash, public_box_key)
+            values (_token, _code, _server, _alias_hash, _public_key);
 
         return;
     end;
@@ -0,0 +1,15 @@
+--
+-- message_notify tells listening servers about new messages, so that peers watching their
+-- inbox ("secrt watch") see them straight away. The payload is "<peer> <message>".
+--
+create or replace
+    function secrt.message_notify() returns trigger
+       language 'plpgsql' as $$
+    begin
+        perform pg_notify('secrt_message', new.peer::text || ' ' || new.message::text);
+        return null;
+    end;
+$$;
+
+create trigger message_notify after insert on secrt.message
+    for each row execute function secrt.message_notify();
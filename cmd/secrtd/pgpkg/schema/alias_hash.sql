@@ -0,0 +1,23 @@
+--
+-- peers and activations are identified by a hash of their alias, so the server doesn't store
+-- email addresses. The hash is salted with the server's public key (see secrt.AliasHash).
+--
+alter table secrt.peer add column alias_hash bytea;
+
+update secrt.peer set alias_hash = digest(server.public_box_key || convert_to(peer.alias, 'UTF8'), 'sha256')
+    from secrt.server where server.server = peer.server;
+
+alter table secrt.peer alter column alias_hash set not null;
+drop index secrt.peer_alias_idx;
+alter table secrt.peer drop column alias;
+create index peer_alias_hash_idx on secrt.peer (server, alias_hash);
+
+alter table secrt.activation add column alias_hash bytea;
+
+update secrt.activation set alias_hash = digest(server.public_box_key || convert_to(activation.alias, 'UTF8'), 'sha256')
+    from secrt.server where server.server = activation.server;
+
+alter table secrt.activation alter column alias_hash set not null;
+drop index secrt.activation_peer_ids;
+alter table secrt.activation drop column alias;
+create index activation_alias_hash_idx on secrt.activation (server, alias_hash);
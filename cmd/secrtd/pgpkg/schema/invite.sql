@@ -0,0 +1,17 @@
+--
+-- invites sent by peers. like peers, invitees are identified by the hash of their alias.
+-- an invite counts against the inviter's allowance until it expires, or the invitee joins.
+--
+create table secrt.invite (
+    primary key (server, inviter, invitee_hash),
+    foreign key (server, inviter) references secrt.peer (server, peer) on delete cascade,
+
+    server uuid not null,
+    inviter uuid not null,
+    invitee_hash bytea not null,
+    created timestamptz not null default current_timestamp,
+    expiry timestamptz not null
+);
+
+create index invite_invitee_idx on secrt.invite (server, invitee_hash);
+create index invite_expiry_idx on secrt.invite (expiry);
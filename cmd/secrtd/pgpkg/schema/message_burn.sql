@@ -0,0 +1,4 @@
+--
+-- burn-after-read messages are deleted as soon as they are retrieved.
+--
+alter table secrt.message add column burn boolean not null default false;
@@ -0,0 +1,6 @@
+--
+-- a burn-after-read message is claimed by its reader before its payload is streamed, so only one
+-- reader gets it. claimed messages are hidden, and are deleted once they've been read, or released
+-- if the read fails. a reader that dies leaves the message claimed until it expires.
+--
+alter table secrt.message add column claimed timestamptz;
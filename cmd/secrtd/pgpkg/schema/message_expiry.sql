@@ -0,0 +1,10 @@
+--
+-- messages expire after a while, whether they've been read or not.
+-- existing messages get the default 24 hour lifetime.
+--
+alter table secrt.message add column expiry timestamptz;
+update secrt.message set expiry = received + '24 hours'::interval;
+alter table secrt.message alter column expiry set not null;
+
+-- make it easy to purge expired messages.
+create index message_expiry_idx on secrt.message (expiry);
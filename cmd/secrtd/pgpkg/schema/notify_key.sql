@@ -0,0 +1,6 @@
+--
+-- notification addresses were encrypted with the server's secret key, which is in the database, so a
+-- copy of the database revealed them. they're now encrypted with SECRT_NOTIFY_KEY, which isn't in the
+-- database. the old addresses can't be re-encrypted here, so peers have to ask for notifications again.
+--
+update secrt.peer set notify = null;
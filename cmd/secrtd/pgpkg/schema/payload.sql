@@ -0,0 +1,19 @@
+--
+-- large payloads are streamed, and stored in chunks so they're never held in memory.
+-- the payload is stored before the message, so orphaned chunks are purged when they expire.
+--
+alter table secrt.message add column streamed boolean not null default false;
+
+create table secrt.payload (
+    primary key (server, message, seq),
+
+    foreign key (server) references secrt.server,
+
+    server uuid not null,
+    message uuid not null,
+    seq integer not null,
+    expiry timestamptz not null,
+    data bytea not null
+);
+
+create index payload_expiry_idx on secrt.payload (expiry);
@@ -0,0 +1,11 @@
+--
+-- a streamed payload can be shared by several messages, so a secret that's sent to several
+-- peers is only stored once. payload_key is the payload's key, wrapped for the recipient.
+--
+alter table secrt.payload rename column message to payload_id;
+
+alter table secrt.message add column payload_id uuid;
+alter table secrt.message add column payload_key bytea;
+update secrt.message set payload_id = message where streamed;
+
+create index message_payload_idx on secrt.message (server, payload_id);
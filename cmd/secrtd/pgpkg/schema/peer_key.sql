@@ -0,0 +1,13 @@
+--
+-- peer_key records the keys that peers have replaced using "secrt rekey", so that other
+-- peers can tell that a key was rotated by its owner, rather than replaced by a stranger.
+--
+create table secrt.peer_key (
+    primary key (server, peer, public_box_key),
+    foreign key (server, peer) references secrt.peer (server, peer) on delete cascade,
+
+    server uuid not null,
+    peer uuid not null,
+    public_box_key bytea not null,
+    retired timestamptz not null default current_timestamp
+);
@@ -0,0 +1,6 @@
+--
+-- signature is the retired key's signature over the key that replaced it, so that other peers
+-- can check the rotation themselves, rather than trusting the server. Keys retired before
+-- rotations were signed have no signature, and peers treat them as unsigned key changes.
+--
+alter table secrt.peer_key add column signature bytea;
@@ -0,0 +1,5 @@
+--
+-- rotated keys are no longer signed: peers accept a changed key themselves, with "secrt peer
+-- accept-key", rather than trusting a signature.
+--
+alter table secrt.peer_key drop column signature;
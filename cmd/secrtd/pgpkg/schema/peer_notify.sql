@@ -0,0 +1,5 @@
+--
+-- notify contains the peer's email address, encrypted with the server's secret key, if the peer
+-- has asked to be emailed when messages arrive ("secrt set notify=email"). Otherwise it's null.
+--
+alter table secrt.peer add column notify bytea;
@@ -0,0 +1,19 @@
+--
+-- The alias "secrt" is reserved for the server's own peer identity (see secrt.ServerAlias), and
+-- clients trust messages from it. Peers and activations that claimed that alias, or the server's
+-- public key, before it was reserved are removed, along with the messages waiting for them.
+--
+delete from secrt.message using secrt.peer, secrt.server
+    where message.server = peer.server and message.peer = peer.peer and peer.server = server.server
+      and (peer.alias_hash = digest(server.public_box_key || convert_to('secrt', 'UTF8'), 'sha256')
+           or peer.public_box_key = server.public_box_key);
+
+delete from secrt.peer using secrt.server
+    where peer.server = server.server
+      and (peer.alias_hash = digest(server.public_box_key || convert_to('secrt', 'UTF8'), 'sha256')
+           or peer.public_box_key = server.public_box_key);
+
+delete from secrt.activation using secrt.server
+    where activation.server = server.server
+      and (activation.alias_hash = digest(server.public_box_key || convert_to('secrt', 'UTF8'), 'sha256')
+           or activation.public_box_key = server.public_box_key);
@@ -0,0 +1,5 @@
+--
+-- authentication tokens issued before tokens_after are rejected. "secrt logout --all-devices"
+-- sets it to the current time, which revokes every token issued to the peer.
+--
+alter table secrt.peer add column tokens_after timestamptz not null default 'epoch';
@@ -0,0 +1,20 @@
+--
+-- policies limit what peers can do. the server policy applies to all peers,
+-- unless the peer has a policy of their own. null means the default policy applies.
+--
+alter table secrt.server add column policy jsonb;
+alter table secrt.peer add column policy jsonb;
+
+--
+-- usage is counted per peer, per (UTC) day, so we can enforce daily limits.
+--
+create table secrt.usage (
+    primary key (server, peer, day),
+    foreign key (server, peer) references secrt.peer (server, peer) on delete cascade,
+
+    server uuid not null,
+    peer uuid not null,
+    day date not null,
+    messages integer not null default 0,
+    invites integer not null default 0
+);
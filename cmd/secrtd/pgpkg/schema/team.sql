@@ -0,0 +1,29 @@
+--
+-- teams are managed by their owner, and a message sent to a team is sent to each member. aliases
+-- are never stored in the clear, so the owner's and members' aliases are encrypted with the
+-- server's secret key, like peer.notify.
+--
+create table secrt.team (
+    primary key (server, team),
+    foreign key (server, owner) references secrt.peer (server, peer) on delete cascade,
+
+    server uuid not null references secrt.server (server),
+    team text not null,
+    owner uuid not null,
+    owner_alias bytea not null,
+    created timestamptz not null default current_timestamp
+);
+
+create table secrt.team_member (
+    primary key (server, team, peer),
+    foreign key (server, team) references secrt.team (server, team) on delete cascade,
+    foreign key (server, peer) references secrt.peer (server, peer) on delete cascade,
+
+    server uuid not null,
+    team text not null,
+    peer uuid not null,
+    alias bytea not null,
+    added timestamptz not null default current_timestamp
+);
+
+create index team_member_peer_idx on secrt.team_member (server, peer);
@@ -0,0 +1,8 @@
+--
+-- peers are invited to teams, and aren't members until they've joined. owners have always joined.
+-- other existing members were added without being asked, so they have to join again.
+--
+alter table secrt.team_member add column joined boolean not null default false;
+
+update secrt.team_member set joined = true from secrt.team
+    where team_member.server = team.server and team_member.team = team.team and team_member.peer = team.owner;
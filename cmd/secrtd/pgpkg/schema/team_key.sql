@@ -0,0 +1,9 @@
+--
+-- team aliases were encrypted with the server's secret key, which is in the database, so a copy of
+-- the database revealed them. they're now encrypted with a team key that only the team's members
+-- have. the server can't create team keys for existing teams, so they have to be created again.
+--
+delete from secrt.team;
+
+alter table secrt.team drop column owner_alias;
+alter table secrt.team_member add column team_key bytea not null;
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// Policy describes the limits that apply to a peer. Policies are stored per server (the default for all
+// the server's peers) and per peer (which overrides the server policy). A zero limit means there is no limit.
+type Policy struct {
+	Plan            string `json:"plan,omitzero"`   // Name of the plan this policy came from, if any
+	DailyLimit      int    `json:"dailyLimit"`      // Messages a peer can send per (UTC) day
+	MaxPayloadSize  int    `json:"maxPayloadSize"`  // Maximum encrypted payload size, in bytes
+	MaxMetadataSize int    `json:"maxMetadataSize"` // Maximum encrypted metadata size, in bytes
+	MaxLifetime     int64  `json:"maxLifetime"`     // Maximum message lifetime, in seconds (capped by SECRT_MAX_LIFETIME)
+	Invites         int    `json:"invites"`         // Number of invites a peer can send
+}
+
+// Usage records what a peer has done, for comparison with their policy.
+type Usage struct {
+	Messages       int // Messages sent today
+	Invites        int // Invited peers who have joined, ever
+	PendingInvites int // Invites that haven't expired, or been accepted
+}
+
+// DefaultPolicy applies when neither the server nor the peer has a policy.
+var DefaultPolicy = &Policy{
+	MaxPayloadSize:  secrt.MessageSizeLimit,
+	MaxMetadataSize: 4 * 1024,
+}
+
+// Plans are predefined policies, which can be assigned to a server or a peer using "secrtd plan".
+var Plans = map[string]*Policy{
+	"free": {
+		Plan:            "free",
+		DailyLimit:      10,
+		MaxPayloadSize:  10 * 1024,
+		MaxMetadataSize: 4 * 1024,
+		MaxLifetime:     int64((4 * time.Hour).Seconds()),
+	},
+	"pro": {
+		Plan:            "pro",
+		DailyLimit:      100,
+		MaxPayloadSize:  50 * 1024,
+		MaxMetadataSize: 4 * 1024,
+		MaxLifetime:     int64((24 * time.Hour).Seconds()),
+	},
+	"ops": {
+		Plan:            "ops",
+		DailyLimit:      1000,
+		MaxPayloadSize:  250 * 1024,
+		MaxMetadataSize: 4 * 1024,
+	},
+}
+
+// today returns the start of the current UTC day, which is used to count daily usage.
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// GetPolicy returns the policy that applies to the given peer.
+func (server *SecretServer) GetPolicy(ctx context.Context, peer *Peer) (*Policy, error) {
+	policy, err := Storage.GetPolicy(ctx, server.Server, peer.Peer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get policy for %s: %w", peer, err)
+	}
+
+	if policy == nil {
+		return DefaultPolicy, nil
+	}
+
+	return policy, nil
+}
+
+// violation returns a HTTP error that sends a PolicyError to the client.
+func (policy *Policy) violation(status int, name string, limit int64, format string, args ...any) *jtp.HTTPError {
+	policyErr := &secrt.PolicyError{
+		Policy:  name,
+		Plan:    policy.Plan,
+		Limit:   limit,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	return &jtp.HTTPError{
+		StatusCode: status,
+		Err:        jtp.Errorf("%s", policyErr.Message),
+		Code:       secrt.ErrorPolicy,
+		Body:       policyErr,
+	}
+}
+
+// CheckMessage returns an error if the envelope is too large to be sent under this policy. The daily
+// limit is checked by UseMessages.
+func (policy *Policy) CheckMessage(envelope *secrt.SendRequest) *jtp.HTTPError {
+	if policy.MaxPayloadSize > 0 && len(envelope.Payload) > policy.MaxPayloadSize {
+		return policy.violation(http.StatusRequestEntityTooLarge, secrt.PolicyMaxPayloadSize, int64(policy.MaxPayloadSize),
+			"secret is too large: %d bytes (the limit is %d bytes)", len(envelope.Payload), policy.MaxPayloadSize)
+	}
+
+	if policy.MaxMetadataSize > 0 && len(envelope.Metadata) > policy.MaxMetadataSize {
+		return policy.violation(http.StatusRequestEntityTooLarge, secrt.PolicyMaxMetadataSize, int64(policy.MaxMetadataSize),
+			"metadata is too large: %d bytes (the limit is %d bytes)", len(envelope.Metadata), policy.MaxMetadataSize)
+	}
+
+	return nil
+}
+
+// UseMessages counts messages against the peer's daily limit, and returns an error if the limit would
+// be exceeded. The usage is recorded before the messages are stored, in a single step, so concurrent
+// requests can't get past the limit between them. The returned function gives the messages back, for
+// when they can't be stored after all.
+func (server *SecretServer) UseMessages(ctx context.Context, policy *Policy, peer *Peer, count int) (func(), error) {
+	day := today()
+	err := Storage.UseMessages(ctx, server.Server, peer.Peer, day, count, policy.DailyLimit)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return nil, policy.violation(http.StatusTooManyRequests, secrt.PolicyDailyLimit, int64(policy.DailyLimit),
+			"daily limit of %d secrets reached; try again tomorrow", policy.DailyLimit)
+	}
+
+	if err != nil {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to record usage for %s: %w", peer, err))
+	}
+
+	refund := func() {
+		// The messages often aren't stored because the request was cancelled.
+		if err := Storage.UseMessages(context.WithoutCancel(ctx), server.Server, peer.Peer, day, -count, 0); err != nil {
+			log.Printf("unable to give back %d messages to %s: %v", count, peer, err)
+		}
+	}
+
+	return refund, nil
+}
+
+// inviteViolation is the error returned when the peer has no invites left. Pending invites count
+// against the limit, but the allowance is returned if they expire without being accepted.
+func (policy *Policy) inviteViolation() *jtp.HTTPError {
+	return policy.violation(http.StatusForbidden, secrt.PolicyInvites, int64(policy.Invites),
+		"all %d of your invites have been used", policy.Invites)
+}
+
+// Lifetime returns the lifetime of a message, given the TTL (in seconds) requested by the sender.
+// If no TTL was requested, the default lifetime is used. Requests are capped to the policy's maximum
+// lifetime, and to the server's maximum lifetime.
+func (policy *Policy) Lifetime(ttl int64) time.Duration {
+	maxLifetime := Config.MaxLifetime
+	if policy.MaxLifetime > 0 && time.Duration(policy.MaxLifetime)*time.Second < maxLifetime {
+		maxLifetime = time.Duration(policy.MaxLifetime) * time.Second
+	}
+
+	lifetime := Config.MessageLifetime
+	if ttl > 0 {
+		lifetime = time.Duration(ttl) * time.Second
+
+		// Very large TTLs overflow.
+		if lifetime <= 0 {
+			lifetime = maxLifetime
+		}
+	}
+
+	return min(lifetime, maxLifetime)
+}
+
+// setPlanCmd assigns a plan to a server, or to a peer on that server.
+func setPlanCmd(hostname string, plan string, alias string) error {
+	policy, ok := Plans[plan]
+	if !ok {
+		return fmt.Errorf("unknown plan: %s", plan)
+	}
+
+	ctx := context.Background()
+
+	server, err := GetSecretServer(hostname)
+	if err != nil {
+		return err
+	}
+
+	if alias == "" {
+		return Storage.SetServerPolicy(ctx, server.Server, policy)
+	}
+
+	peer, err := Storage.GetPeer(ctx, server.Server, server.AliasHash(alias))
+	if err != nil {
+		return fmt.Errorf("unable to find peer %s: %w", alias, err)
+	}
+
+	return Storage.SetPeerPolicy(ctx, server.Server, peer.Peer, policy)
+}
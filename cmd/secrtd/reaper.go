@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// startReaper starts a goroutine that periodically purges expired messages and activations.
+// Handlers never return expired messages, so the reaper only needs to run often enough
+// to keep the database tidy.
+func startReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			reap()
+		}
+	}()
+}
+
+func reap() {
+	messages, activations, err := Storage.PurgeExpired(context.Background())
+	if err != nil {
+		log.Println("unable to purge expired data:", err)
+		return
+	}
+
+	if messages > 0 || activations > 0 {
+		log.Printf("purged %d expired messages and %d expired activations", messages, activations)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// openRekeyProof opens a RekeyProof sealed with the given public key, and checks that it's current
+// and refers to the requested key.
+func (server *SecretServer) openRekeyProof(proof []byte, peerKey []byte, request *secrt.RekeyRequest) error {
+	plaintext, err := server.Decrypt(proof, peerKey)
+	if err != nil {
+		return err
+	}
+
+	var rekeyProof secrt.RekeyProof
+	if err = json.Unmarshal(plaintext, &rekeyProof); err != nil {
+		return fmt.Errorf("unable to unmarshal proof: %w", err)
+	}
+
+	if !bytes.Equal(rekeyProof.PublicKey, request.PublicKey) {
+		return fmt.Errorf("proof is for a different key")
+	}
+
+	delta := time.Now().Unix() - rekeyProof.Timestamp
+	if delta < -Config.SignatureSkew || delta > Config.SignatureSkew {
+		return fmt.Errorf("proof has expired")
+	}
+
+	return nil
+}
+
+// handlePostRekey replaces the authenticated peer's public key. The peer must prove that they hold
+// both the current and the new private key. The old key is kept, so other peers can see that
+// the key was rotated. The peer's team keys are replaced with copies sealed for the new key.
+func (server *SecretServer) handlePostRekey(r *http.Request, request *secrt.RekeyRequest) (*secrt.Peer, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	if len(request.PublicKey) != 32 {
+		return nil, jtp.BadRequestError(jtp.Errorf("invalid public key length: %d", len(request.PublicKey)))
+	}
+
+	if err := server.openRekeyProof(request.OldKeyProof, peer.PublicKey, request); err != nil {
+		return nil, jtp.ForbiddenError(jtp.Wrapf(err, "invalid proof for current key")).WithCode(secrt.ErrorInvalidProof)
+	}
+
+	if err := server.openRekeyProof(request.NewKeyProof, request.PublicKey, request); err != nil {
+		return nil, jtp.ForbiddenError(jtp.Wrapf(err, "invalid proof for new key")).WithCode(secrt.ErrorInvalidProof)
+	}
+
+	if err := Storage.RotateKey(r.Context(), server.Server, peer.Peer, peer.PublicKey, request.PublicKey); err != nil {
+		if errors.Is(err, ErrKeyChanged) {
+			return nil, jtp.ConflictError(jtp.Wrapf(err, "public key has changed"))
+		}
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to rotate key for %s: %w", peer, err))
+	}
+
+	log.Printf("rotated public key for %s", peer)
+
+	// The team keys sealed for the old key can't be opened any more.
+	keys := make(map[string][]byte, len(request.TeamKeys))
+	for alias, key := range request.TeamKeys {
+		keys[strings.TrimPrefix(alias, secrt.TeamPrefix)] = key
+	}
+
+	if err := Storage.SetTeamKeys(r.Context(), server.Server, peer.Peer, keys); err != nil {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to replace team keys for %s: %w", peer, err))
+	}
+
+	peer.PublicKey = request.PublicKey
+	return server.peerResponse(r.Context(), peer)
+}
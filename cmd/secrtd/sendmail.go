@@ -2,39 +2,48 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"embed"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"text/template"
-
-	"github.com/wneessen/go-mail"
+	"time"
 )
 
-const SMTP_SERVER = "smtp.postmarkapp.com"
-const SMTP_USERNAME = "30fe41f5-c222-42c3-9258-5bee39bba4d5"
-const SMTP_PASSWORD = "30fe41f5-c222-42c3-9258-5bee39bba4d5"
-const SMTP_HEADER_KEY = "X-PM-Message-Stream"
-const SMTP_HEADER_VALUE = "outbound"
-
-var ActivateMailChannel = make(chan *ActivationToken, 16)
-
-const activationEmail = `
-hi! thanks for trying secrt.
-
-secrt is a command line tool for sending secrets to coworkers, friends,
-and people who need to know.
-
-to activate your account, please copy and paste this whole command into your command line:
+// The default email templates. Each email has a text template, and an optional HTML template.
+// Both are executed with the values in the MailRequest, and the text template must define
+// a "subject" template.
+//
+//go:embed mail
+var mailTemplates embed.FS
 
-	secrt activate "{{.Token}}" {{.Code}}
+// mailRetryDelay is how long to wait before retrying a failed delivery. It doubles after each attempt.
+var mailRetryDelay = time.Second
 
-or just click here:
+// mailQueueTimeout is how long a request waits for room in a full mail queue.
+var mailQueueTimeout = 5 * time.Second
 
-    {{.Server.Hostname}}/activate?t={{.Token}}
+// MailRequest is an email waiting to be sent by the mail poller. Template names the email
+// template, such as "activation", which is executed with the given values.
+type MailRequest struct {
+	To       string
+	Template string
+	Server   *SecretServer
+	Values   any
 
-and enter code {{printf "%06d" .Code}}
+	retries int // failed deliveries so far
+}
 
-you can find out more about secrt by visiting our web site: https://secrt.io/
-`
+// MailChannel holds the emails waiting to be sent. Use queueMail to add to it. Retries don't go
+// through the queue, so they can't fill it up.
+var MailChannel = make(chan *MailRequest, 16)
 
 func startMailPoller(replicas int) {
 	for range replicas {
@@ -43,56 +52,130 @@ func startMailPoller(replicas int) {
 }
 
 func mailPoller() {
-	for token := range ActivateMailChannel {
-		if err := sendmail(activationEmail, token); err != nil {
-			log.Println("unable to send activation email:", err)
-		}
+	for m := range MailChannel {
+		deliverMail(m)
 	}
 }
 
-func sendmail(msg string, values any) error {
-	tmpl, err := template.New("email").Parse(msg)
-	if err != nil {
-		return err
+// queueMail adds an email to the queue, waiting for room if it's full. Returns an error, and
+// doesn't queue the email, if ctx is done first.
+func queueMail(ctx context.Context, m *MailRequest) error {
+	select {
+	case MailChannel <- m:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("unable to queue %q email to %s: %w", m.Template, m.To, context.Cause(ctx))
+	}
+}
+
+// deliverMail makes one attempt to deliver an email, and schedules a retry if it fails.
+func deliverMail(m *MailRequest) {
+	if err := sendmail(context.Background(), m); err != nil {
+		retryMail(m, err)
 	}
+}
 
-	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, values)
+// retryMail delivers a failed email again after a delay, which doubles after each attempt. The
+// pollers don't wait for the delay, so other emails are still sent. Returns false if the email has
+// been retried SECRT_MAIL_RETRIES times, and has been dropped.
+func retryMail(m *MailRequest, err error) bool {
+	if m.retries >= Config.MailRetries {
+		log.Printf("unable to send %q email to %s: %v", m.Template, m.To, err)
+		return false
+	}
+
+	m.retries++
+	log.Printf("unable to send %q email to %s (attempt %d): %v", m.Template, m.To, m.retries, err)
+
+	time.AfterFunc(mailRetryDelay<<(m.retries-1), func() { deliverMail(m) })
+	return true
+}
+
+// sendmail renders the email and makes one attempt to deliver it.
+func sendmail(ctx context.Context, m *MailRequest) error {
+	email, err := renderMail(m)
 	if err != nil {
 		return err
 	}
 
-	mailBody := buf.String()
+	return Mail.Send(ctx, email)
+}
+
+// renderMail executes the templates for the request.
+func renderMail(m *MailRequest) (*Email, error) {
+	text, err := readMailTemplate(m.Server, m.Template+".txt")
+	if err != nil {
+		return nil, err
+	}
 
-	message := mail.NewMsg()
-	if err := message.From("mark@commandquery.com"); err != nil {
-		return fmt.Errorf("failed to set FROM address: %w", err)
+	textTemplate, err := template.New(m.Template).Parse(text)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := message.To("mark@commandquery.com"); err != nil {
-		log.Fatalf("failed to set TO address: %s", err)
+	email := &Email{To: m.To}
+
+	var buf bytes.Buffer
+	if err = textTemplate.ExecuteTemplate(&buf, "subject", m.Values); err != nil {
+		return nil, err
 	}
+	email.Subject = strings.TrimSpace(buf.String())
 
-	message.Subject("welcome to secrt.io")
-	message.SetBodyString(mail.TypeTextPlain, mailBody)
+	buf.Reset()
+	if err = textTemplate.Execute(&buf, m.Values); err != nil {
+		return nil, err
+	}
+	email.Text = buf.String()
 
-	// Deliver the mails via SMTP
-	client, err := mail.NewClient(SMTP_SERVER,
-		mail.WithSMTPAuth(mail.SMTPAuthAutoDiscover), mail.WithTLSPortPolicy(mail.TLSMandatory),
-		mail.WithUsername(SMTP_USERNAME), mail.WithPassword(SMTP_PASSWORD),
-	)
+	html, err := readMailTemplate(m.Server, m.Template+".html")
+	if errors.Is(err, fs.ErrNotExist) {
+		return email, nil
+	}
 
-	message.SetGenHeader(SMTP_HEADER_KEY, SMTP_HEADER_VALUE)
+	if err != nil {
+		return nil, err
+	}
 
+	htmlTemplate, err := htmltemplate.New(m.Template).Parse(html)
 	if err != nil {
-		log.Fatalf("failed to create new mail delivery client: %s", err)
+		return nil, err
 	}
 
-	if err := client.DialAndSend(message); err != nil {
-		log.Fatalf("failed to deliver mail: %s", err)
+	buf.Reset()
+	if err = htmlTemplate.Execute(&buf, m.Values); err != nil {
+		return nil, err
 	}
+	email.HTML = buf.String()
 
-	log.Printf("Test mail successfully delivered.")
+	return email, nil
+}
+
+// readMailTemplate finds the named template. Templates in SECRT_MAIL_TEMPLATES/<hostname> are used
+// first, then those in SECRT_MAIL_TEMPLATES, and finally the defaults.
+func readMailTemplate(server *SecretServer, name string) (string, error) {
+	if Config.MailTemplates != "" {
+		var paths []string
+		if u, err := url.Parse(server.Hostname); err == nil && u.Hostname() != "" {
+			paths = append(paths, filepath.Join(Config.MailTemplates, u.Hostname(), name))
+		}
+		paths = append(paths, filepath.Join(Config.MailTemplates, name))
+
+		for _, path := range paths {
+			content, err := os.ReadFile(path)
+			if err == nil {
+				return string(content), nil
+			}
+
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+
+	content, err := mailTemplates.ReadFile("mail/" + name)
+	if err != nil {
+		return "", err
+	}
 
-	return nil
+	return string(content), nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
@@ -9,11 +10,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/commandquery/secrt"
 	"github.com/commandquery/secrt/jtp"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/nacl/sign"
@@ -68,18 +69,12 @@ func NewSecretServer(hostname string) *SecretServer {
 
 // GetSecretServer returns a secret server based on the given hostname.
 func GetSecretServer(hostname string) (*SecretServer, error) {
-	ctx := context.Background()
-	row := PGXPool.QueryRow(ctx, "select server, secret_box_key, private_box_key, public_box_key, private_sign_key, public_sign_key from secrt.hostname join secrt.server using (server) where hostname=$1", hostname)
-
-	server := SecretServer{
-		Hostname: hostname,
-	}
-	err := row.Scan(&server.Server, &server.SecretBoxKey, &server.PrivateBoxKey, &server.PublicBoxKey, &server.PrivateSignKey, &server.PublicSignKey)
+	server, err := Storage.GetServer(context.Background(), hostname)
 	if err != nil {
 		return nil, fmt.Errorf("unable to find server %s: %w", hostname, err)
 	}
 
-	return &server, nil
+	return server, nil
 }
 
 // Encrypt an object with the server's secret key. This is used for authentication tokens.
@@ -109,74 +104,173 @@ func (server *SecretServer) DecryptSecret(encrypted []byte) ([]byte, error) {
 	return message, nil
 }
 
-func (server *SecretServer) GetPeer(alias string) (*Peer, bool) {
-	ctx := context.Background()
+// AliasHash returns the hash that identifies the given alias on this server. Aliases aren't stored,
+// but the hash can be checked against a guessed alias (see secrt.AliasHash).
+func (server *SecretServer) AliasHash(alias string) []byte {
+	return secrt.AliasHash(server.PublicBoxKey, alias)
+}
 
-	peer := Peer{
-		Server: server.Server,
-		Alias:  alias,
+// Peer returns the server's own peer identity, which uses the server's box key. The server sends
+// messages from this peer, such as the welcome message. It isn't stored, and its alias is reserved.
+func (server *SecretServer) Peer() *Peer {
+	return &Peer{
+		Server:    server.Server,
+		Peer:      server.Server,
+		Alias:     secrt.ServerAlias,
+		AliasHash: server.AliasHash(secrt.ServerAlias),
+		PublicKey: server.PublicBoxKey,
 	}
+}
 
-	row := PGXPool.QueryRow(ctx, "select peer, public_box_key from secrt.peer where server=$1 and alias=$2", server.Server, alias)
-	err := row.Scan(&peer.Peer, &peer.PublicKey)
+// GetPeer finds the peer with the given alias. The alias is hashed, since only the hash is stored.
+func (server *SecretServer) GetPeer(alias string) (*Peer, bool) {
+	peer, err := Storage.GetPeer(context.Background(), server.Server, server.AliasHash(alias))
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, ErrUnknownPeer) {
 			return nil, false
 		}
 		log.Printf("error attempting to read peer %s: %v", alias, err)
 		return nil, false
 	}
 
-	return &peer, true
+	peer.Alias = alias
+	return peer, true
 }
 
+// authKey is the context key for the result of Authenticate, which dispatch caches for the
+// duration of a request.
+type authKey struct{}
+
+type authResult struct {
+	done bool
+	peer *Peer
+	err  *jtp.HTTPError
+}
+
+// Authenticate returns the peer identified by the request's authentication token. The peer is
+// only looked up once per request, even if the request's limit function also authenticates it.
 func (server *SecretServer) Authenticate(r *http.Request) (*Peer, *jtp.HTTPError) {
+	result, ok := r.Context().Value(authKey{}).(*authResult)
+	if !ok {
+		return server.authenticate(r)
+	}
+
+	if !result.done {
+		result.peer, result.err = server.authenticate(r)
+		result.done = true
+	}
+
+	return result.peer, result.err
+}
+
+func (server *SecretServer) authenticate(r *http.Request) (*Peer, *jtp.HTTPError) {
 
 	token := r.Header.Get("Authorization")
 	if token == "" {
-		return nil, jtp.UnauthorizedError(fmt.Errorf("missing authorization header"))
+		return nil, jtp.UnauthorizedError(jtp.Errorf("missing authorization header"))
 	}
 
 	if len(token) < 8 {
-		return nil, jtp.UnauthorizedError(fmt.Errorf("invalid authorization token"))
+		return nil, jtp.UnauthorizedError(jtp.Errorf("invalid authorization token"))
 	}
 
 	token = token[7:]
 
 	authTokenCipher, err := base64.StdEncoding.DecodeString(token)
 	if err != nil {
-		return nil, jtp.UnauthorizedError(fmt.Errorf("unable to decode token: %w", err))
+		return nil, jtp.UnauthorizedError(jtp.Wrapf(err, "unable to decode token"))
 	}
 
 	tokenJs, err := server.DecryptSecret(authTokenCipher)
 	if err != nil {
-		return nil, jtp.BadRequestError(fmt.Errorf("unable to decrypt token: %w", err))
+		return nil, jtp.BadRequestError(jtp.Wrapf(err, "unable to decrypt token"))
 	}
 
 	var authToken AuthenticationToken
 	if err := json.Unmarshal(tokenJs, &authToken); err != nil {
-		return nil, jtp.BadRequestError(fmt.Errorf("unable to unmarshal token: %w", err))
+		return nil, jtp.BadRequestError(jtp.Wrapf(err, "unable to unmarshal token"))
 	}
 
-	peer, ok := server.GetPeer(authToken.Alias)
-	if !ok {
-		return nil, jtp.UnauthorizedError(fmt.Errorf("unknown peer %q", authToken.Alias))
+	peer, err := Storage.GetPeerByID(r.Context(), server.Server, authToken.Peer)
+	if err != nil {
+		return nil, jtp.UnauthorizedError(jtp.Errorf("unknown peer %s", authToken.Peer))
+	}
+
+	// Peers who enrolled with the server's identity before it was reserved could send messages
+	// that clients trust as coming from the server. The peer_reserved migration removes them.
+	if bytes.Equal(peer.AliasHash, server.AliasHash(secrt.ServerAlias)) || bytes.Equal(peer.PublicKey, server.PublicBoxKey) {
+		return nil, jtp.UnauthorizedError(jtp.Errorf("peer %s uses a reserved identity", authToken.Peer))
+	}
+
+	// The token only contains an alias if the peer supplied it during activation, and it's
+	// only trusted if it matches the peer's alias hash.
+	if authToken.Alias != "" {
+		if !bytes.Equal(server.AliasHash(authToken.Alias), peer.AliasHash) {
+			return nil, jtp.UnauthorizedError(jtp.Errorf("token for %s doesn't match peer %s", authToken.Alias, authToken.Peer))
+		}
+		peer.Alias = authToken.Alias
+	}
+
+	if authToken.Issued < peer.TokensAfter.Unix() {
+		return nil, jtp.UnauthorizedError(jtp.Errorf("token for %s has been revoked", peer)).WithCode(secrt.ErrorTokenRevoked)
+	}
+
+	if Config.MaxTokenAge > 0 && time.Since(time.Unix(authToken.Issued, 0)) > Config.MaxTokenAge {
+		return nil, jtp.UnauthorizedError(jtp.Errorf("token for %s has expired", peer)).WithCode(secrt.ErrorTokenExpired)
 	}
 
 	return peer, nil
 }
 
 // dispatch is a simple wrapper for jtp.Handle that finds the appropriate server and calls the given function on it.
+// Request bodies are limited to SECRT_MAX_REQUEST_SIZE.
 func dispatch[IN any, OUT any](method func(*SecretServer, *http.Request, *IN) (*OUT, error)) http.HandlerFunc {
-	return jtp.Handle(func(w http.ResponseWriter, r *http.Request, in *IN) (*OUT, error) {
+	return dispatchLimit(method, nil)
+}
+
+// dispatchLimit is like dispatch, but the size of the request body is limited by the given function,
+// which is called before the body is read. If limit is nil, SECRT_MAX_REQUEST_SIZE is used. The limit
+// function and the handler share the result of Authenticate.
+func dispatchLimit[IN any, OUT any](method func(*SecretServer, *http.Request, *IN) (*OUT, error), limit func(*SecretServer, *http.Request) (int64, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		host := GetHostname(r)
 		s, err := GetSecretServer(host)
 		if err != nil {
-			return nil, jtp.NotFoundError(fmt.Errorf("unable to find secret server %s: %w", host, err))
+			jtp.WriteError(w, jtp.NotFoundError(jtp.Wrapf(err, "unable to find secret server %s", host)))
+			return
 		}
 
-		return method(s, r, in)
-	})
+		r = r.WithContext(context.WithValue(r.Context(), authKey{}, &authResult{}))
+
+		maxBytes := jtp.MaxBytes(func(r *http.Request) (int64, error) {
+			if limit == nil {
+				return Config.MaxRequestSize, nil
+			}
+			return limit(s, r)
+		})
+
+		jtp.Handle(func(w http.ResponseWriter, r *http.Request, in *IN) (*OUT, error) {
+			return method(s, r, in)
+		}, maxBytes)(w, r)
+	}
+}
+
+// dispatchStream is like dispatch, but the handler reads the request and writes the response itself,
+// which lets it stream data that's too large to hold in memory. If the handler returns an error
+// before writing anything, the error is sent to the client.
+func dispatchStream(method func(*SecretServer, http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := GetHostname(r)
+		s, err := GetSecretServer(host)
+		if err != nil {
+			jtp.WriteError(w, jtp.NotFoundError(jtp.Wrapf(err, "unable to find secret server %s", host)))
+			return
+		}
+
+		if err = method(s, w, r); err != nil {
+			jtp.SendError(w, err)
+		}
+	}
 }
 
 func GetHostname(r *http.Request) string {
@@ -189,11 +283,8 @@ func GetHostname(r *http.Request) string {
 	return scheme + "://" + r.Host
 }
 
-func StartServer() error {
-	if err := initConfig(); err != nil {
-		secrt.Exit(1, err)
-	}
-
+// NewServeMux returns the HTTP handler for all the server endpoints.
+func NewServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	pathPrefix := Config.PathPrefix
@@ -210,17 +301,35 @@ func StartServer() error {
 
 	mux.HandleFunc("POST "+pathPrefix+"enrol/{alias}", dispatch((*SecretServer).handleEnrol))
 	mux.HandleFunc("GET "+pathPrefix+"inbox", dispatch((*SecretServer).handleGetInbox))
-	mux.HandleFunc("POST "+pathPrefix+"message/{recipient}", dispatch((*SecretServer).handlePostMessage))
+	mux.HandleFunc("GET "+pathPrefix+"inbox/watch", dispatchStream((*SecretServer).handleGetWatch))
+	mux.HandleFunc("POST "+pathPrefix+"message/{recipient}", dispatchLimit((*SecretServer).handlePostMessage, (*SecretServer).messageLimit))
+	mux.HandleFunc("POST "+pathPrefix+"message", dispatchLimit((*SecretServer).handlePostShared, (*SecretServer).streamLimit))
+	mux.HandleFunc("POST "+pathPrefix+"message/{recipient}/stream", dispatchLimit((*SecretServer).handlePostStream, (*SecretServer).streamLimit))
 	mux.HandleFunc("GET "+pathPrefix+"message/{id}", dispatch((*SecretServer).handleGetMessage))
+	mux.HandleFunc("GET "+pathPrefix+"message/{id}/stream", dispatchStream((*SecretServer).handleGetStream))
 	mux.HandleFunc("DELETE "+pathPrefix+"message/{id}", dispatch((*SecretServer).handleDeleteMessage))
 	mux.HandleFunc("GET "+pathPrefix+"peer/{alias}", dispatch((*SecretServer).handleGetPeer))
 	mux.HandleFunc("POST "+pathPrefix+"invite/{alias}", dispatch((*SecretServer).handleInvite))
+	mux.HandleFunc("POST "+pathPrefix+"notify", dispatch((*SecretServer).handlePostNotify))
+	mux.HandleFunc("GET "+pathPrefix+"team", dispatch((*SecretServer).handleGetTeams))
+	mux.HandleFunc("GET "+pathPrefix+"team/{team}", dispatch((*SecretServer).handleGetTeam))
+	mux.HandleFunc("POST "+pathPrefix+"team/{team}", dispatch((*SecretServer).handlePostTeam))
+	mux.HandleFunc("DELETE "+pathPrefix+"team/{team}", dispatch((*SecretServer).handleDeleteTeam))
+	mux.HandleFunc("POST "+pathPrefix+"team/{team}/join", dispatch((*SecretServer).handlePostTeamJoin))
+	mux.HandleFunc("DELETE "+pathPrefix+"team/{team}/member/{alias}", dispatch((*SecretServer).handleDeleteTeamMember))
 	mux.HandleFunc("GET "+pathPrefix+"challenge", dispatch((*SecretServer).handleGetChallenge))
+	mux.HandleFunc("POST "+pathPrefix+"token", dispatch((*SecretServer).handlePostToken))
+	mux.HandleFunc("POST "+pathPrefix+"logout", dispatch((*SecretServer).handlePostLogout))
+	mux.HandleFunc("POST "+pathPrefix+"rekey", dispatch((*SecretServer).handlePostRekey))
 
 	// POST performs the enrolment. GET displays the HTML activation page.
 	mux.HandleFunc("POST "+pathPrefix+"activate", dispatch((*SecretServer).handlePostActivate))
 	mux.HandleFunc("GET "+pathPrefix+"activate", handleGetActivate)
 
+	return mux
+}
+
+func StartServer() error {
 	log.Println("listening on :8080")
-	return http.ListenAndServe(":8080", mux)
+	return http.ListenAndServe(":8080", NewServeMux())
 }
@@ -0,0 +1,1636 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// testServer is a secrtd instance backed by a MemoryStore.
+type testServer struct {
+	t      *testing.T
+	http   *httptest.Server
+	server *SecretServer
+}
+
+// testPeer is an enrolled and activated peer.
+type testPeer struct {
+	alias      string
+	publicKey  []byte
+	privateKey []byte
+	header     http.Header
+	inviters   [][]byte // alias hashes of the peers who invited this peer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	Config.Store = StoreMemory
+	Config.ChallengeSize = 1
+	Config.EnrolAction = EnrolFile
+	Config.EnrolFile = filepath.Join(t.TempDir(), "token.txt")
+	Config.WelcomeMessage = "" // most tests expect an empty inbox
+	Config.Mailer = MailerMemory
+	Storage = NewMemoryStore()
+	Mail = NewMemoryMailer()
+
+	if err := initNotifyKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{
+		t:    t,
+		http: httptest.NewServer(NewServeMux()),
+	}
+	t.Cleanup(ts.http.Close)
+
+	if err := addServerCmd(ts.http.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if ts.server, err = GetSecretServer(ts.http.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	return ts
+}
+
+func (ts *testServer) url(path ...string) string {
+	return ts.http.URL + Config.PathPrefix + strings.Join(path, "/")
+}
+
+// enrol runs a peer through the enrolment and activation handlers.
+func (ts *testServer) enrol(alias string) *testPeer {
+	ts.t.Helper()
+
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	header := ts.challenge()
+
+	var enrolmentResponse secrt.EnrolmentResponse
+	enrolmentRequest := &secrt.EnrolmentRequest{PublicKey: public[:]}
+	if err = jtp.Call("POST", ts.url("enrol", alias), header, enrolmentRequest, &enrolmentResponse); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	activationRequest := ts.lastActivation()
+	activationRequest.Alias = alias
+	var activationResponse secrt.ActivationResponse
+	if err = jtp.Call("POST", ts.url("activate"), nil, activationRequest, &activationResponse); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	peer := &testPeer{
+		alias:      alias,
+		publicKey:  public[:],
+		privateKey: private[:],
+		header:     make(http.Header),
+		inviters:   activationResponse.Inviters,
+	}
+
+	peer.header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString(activationResponse.Token))
+	return peer
+}
+
+// challenge solves an enrolment challenge, and returns the headers for the enrolment request.
+func (ts *testServer) challenge() http.Header {
+	ts.t.Helper()
+
+	var challengeRequest secrt.ChallengeRequest
+	if err := jtp.Call("GET", ts.url("challenge"), nil, jtp.Nil, &challengeRequest); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	challengeResponse, err := secrt.SolveChallenge(&challengeRequest)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	header := make(http.Header)
+	header.Set("Challenge", base64.StdEncoding.EncodeToString(challengeResponse.Challenge))
+	header.Set("Nonce", fmt.Sprintf("%d", challengeResponse.Nonce))
+	return header
+}
+
+// lastActivation reads the most recent token and code from the enrolment file.
+func (ts *testServer) lastActivation() *secrt.ActivationRequest {
+	ts.t.Helper()
+
+	f, err := os.Open(Config.EnrolFile)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer f.Close()
+
+	var request secrt.ActivationRequest
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if _, err = fmt.Sscanf(scanner.Text(), "%s %d", &request.Token, &request.Code); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+
+	return &request
+}
+
+// claims opens the server-sealed claims of a message.
+func (peer *testPeer) claims(t *testing.T, ts *testServer, sealed []byte) *secrt.Claims {
+	t.Helper()
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[1:25])
+
+	claimBytes, ok := box.Open(nil, sealed[25:], &nonce, secrt.To32(ts.server.PublicBoxKey), secrt.To32(peer.privateKey))
+	if !ok {
+		t.Fatal("unable to open claims")
+	}
+
+	var claims secrt.Claims
+	if err := json.Unmarshal(claimBytes, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	return &claims
+}
+
+func TestAliasHash(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+
+	// Only the hash of the alias is stored.
+	peer, err := Storage.GetPeer(context.Background(), ts.server.Server, ts.server.AliasHash(alice.alias))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Alias != "" || !bytes.Equal(peer.PublicKey, alice.publicKey) {
+		t.Fatalf("unexpected peer: %+v", peer)
+	}
+
+	// The peer can be found by alias.
+	var response secrt.Peer
+	if err = jtp.Call("GET", ts.url("peer", alice.alias), alice.header, jtp.Nil, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Peer != alice.alias {
+		t.Fatalf("unexpected peer alias: %s", response.Peer)
+	}
+
+	// A token without an alias is still valid.
+	token, err := ts.server.NewAuthenticationToken(&Peer{Peer: peer.Peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString(token))
+	if err = jtp.Call("GET", ts.url("peer", alice.alias), header, jtp.Nil, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token with the wrong alias is rejected.
+	token, err = ts.server.NewAuthenticationToken(&Peer{Peer: peer.Peer, Alias: "mallory@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString(token))
+	if err = jtp.Call("GET", ts.url("peer", alice.alias), header, jtp.Nil, &response); !errors.Is(err, jtp.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestWelcomeMessage(t *testing.T) {
+	ts := newTestServer(t)
+	Config.WelcomeMessage = "welcome!"
+	alice := ts.enrol("alice@example.com")
+
+	var inbox secrt.Inbox
+	if err := jtp.Call("GET", ts.url("inbox"), alice.header, jtp.Nil, &inbox); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inbox.Messages) != 1 {
+		t.Fatalf("expected a welcome message, got %d messages", len(inbox.Messages))
+	}
+
+	var message secrt.Message
+	if err := jtp.Call("GET", ts.url("message", inbox.Messages[0].Message.String()), alice.header, jtp.Nil, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message comes from the server's own peer.
+	claims := alice.claims(t, ts, message.Claims)
+	if !bytes.Equal(claims.PublicKey, ts.server.PublicBoxKey) || !bytes.Equal(claims.Sender, ts.server.AliasHash(secrt.ServerAlias)) {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], message.Payload[1:25])
+	payload, ok := box.Open(nil, message.Payload[25:], &nonce, secrt.To32(ts.server.PublicBoxKey), secrt.To32(alice.privateKey))
+	if !ok || string(payload) != "welcome!" {
+		t.Fatalf("unable to open welcome message: %q", payload)
+	}
+
+	// Nobody can enrol as the server.
+	challengeHeader := ts.challenge()
+	err := jtp.Call("POST", ts.url("enrol", secrt.ServerAlias), challengeHeader, &secrt.EnrolmentRequest{PublicKey: alice.publicKey}, &secrt.EnrolmentResponse{})
+	if !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+}
+
+func TestSendAndReceive(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	request := &secrt.SendRequest{
+		Payload:  []byte("payload"),
+		Metadata: []byte("metadata"),
+	}
+
+	var sendResponse secrt.SendResponse
+	if err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &sendResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	var inbox secrt.Inbox
+	if err := jtp.Call("GET", ts.url("inbox"), bob.header, jtp.Nil, &inbox); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inbox.Messages) != 1 || inbox.Messages[0].Message != sendResponse.ID {
+		t.Fatalf("expected message %s in inbox, got %v", sendResponse.ID, inbox.Messages)
+	}
+
+	if inbox.Messages[0].Payload != nil {
+		t.Fatal("inbox should not contain payload")
+	}
+
+	// Use the short ID, as the CLI usually does.
+	var message secrt.Message
+	if err := jtp.Call("GET", ts.url("message", sendResponse.ID.String()[:8]), bob.header, jtp.Nil, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(message.Payload) != "payload" || string(message.Metadata) != "metadata" {
+		t.Fatalf("unexpected message content: %q %q", message.Payload, message.Metadata)
+	}
+
+	claims := bob.claims(t, ts, message.Claims)
+	if claims.Alias != "" || !bytes.Equal(claims.Sender, secrt.AliasHash(ts.server.PublicBoxKey, alice.alias)) || claims.Message != sendResponse.ID {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	// Alice can't see Bob's message.
+	err := jtp.Call("GET", ts.url("message", sendResponse.ID.String()), alice.header, jtp.Nil, &message)
+	if !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err = jtp.Call("DELETE", ts.url("message", sendResponse.ID.String()), bob.header, jtp.Nil, jtp.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	err = jtp.Call("GET", ts.url("message", sendResponse.ID.String()), bob.header, jtp.Nil, &message)
+	if !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+
+	err = jtp.Call("DELETE", ts.url("message", sendResponse.ID.String()), bob.header, jtp.Nil, jtp.Nil)
+	if !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found for second delete, got %v", err)
+	}
+}
+
+func TestUnknownRecipient(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+
+	request := &secrt.SendRequest{Payload: []byte("payload")}
+	err := jtp.Call("POST", ts.url("message", "nobody@example.com"), alice.header, request, &secrt.SendResponse{})
+	if !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// The server explains the problem.
+	var httpErr *jtp.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorUnknownRecipient || httpErr.Err == nil || httpErr.Err.Error() != "recipient not found" {
+		t.Fatalf("expected unknown recipient error, got %v", err)
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	ts := newTestServer(t)
+
+	err := jtp.Call("GET", ts.url("inbox"), nil, jtp.Nil, &secrt.Inbox{})
+	if !errors.Is(err, jtp.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	// Codes are derived from the status if the server doesn't set one.
+	var httpErr *jtp.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != "unauthorized" {
+		t.Fatalf("expected unauthorized code, got %v", err)
+	}
+}
+
+// Only the public part of an error is sent to the client.
+func TestErrorMessages(t *testing.T) {
+	ts := newTestServer(t)
+
+	request, err := http.NewRequest("GET", ts.url("challenge"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = "unknown.example.com"
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var errorResponse jtp.ErrorResponse
+	if err = json.NewDecoder(response.Body).Decode(&errorResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	if errorResponse.Message != "unable to find secret server http://unknown.example.com" {
+		t.Fatalf("unexpected message: %q", errorResponse.Message)
+	}
+
+	// Errors that aren't marked as public only send the status text.
+	internal := jtp.BadRequestError(fmt.Errorf("unable to query: %w", errors.New("connection refused")))
+	if message := internal.Response().Message; message != http.StatusText(http.StatusBadRequest) {
+		t.Fatalf("unexpected message: %q", message)
+	}
+}
+
+func TestDoubleActivation(t *testing.T) {
+	ts := newTestServer(t)
+	ts.enrol("alice@example.com")
+
+	// The activation token has been consumed.
+	err := jtp.Call("POST", ts.url("activate"), nil, ts.lastActivation(), &secrt.ActivationResponse{})
+	if !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+}
+
+// An activation that fails because the peer already exists isn't consumed, as in Postgres.
+func TestActivateExistingPeer(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	aliasHash := ts.server.AliasHash("alice@example.com")
+
+	for i := range 2 {
+		token, code, err := Storage.Enrol(ctx, ts.server.Server, aliasHash, make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = Storage.Activate(ctx, token, code)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 1 && !errors.Is(err, ErrExistingPeer) {
+			t.Fatalf("expected existing peer, got %v", err)
+		}
+	}
+
+	if activations := len(Storage.(*MemoryStore).activations); activations != 1 {
+		t.Fatalf("expected the activation to be kept, got %d activations", activations)
+	}
+}
+
+func TestExpiredMessages(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	// Messages sent with a negative lifetime expire immediately.
+	Config.MessageLifetime = -time.Second
+
+	var sendResponse secrt.SendResponse
+	if err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, &secrt.SendRequest{Payload: []byte("payload")}, &sendResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	err := jtp.Call("GET", ts.url("inbox"), bob.header, jtp.Nil, &secrt.Inbox{})
+	if !errors.Is(err, jtp.ErrNoContent) {
+		t.Fatalf("expected empty inbox, got %v", err)
+	}
+
+	err = jtp.Call("GET", ts.url("message", sendResponse.ID.String()), bob.header, jtp.Nil, &secrt.Message{})
+	if !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	messages, _, err := Storage.PurgeExpired(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messages != 1 {
+		t.Fatalf("expected 1 purged message, got %d", messages)
+	}
+}
+
+func TestBurnAfterReading(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	request := &secrt.SendRequest{Payload: []byte("payload"), Burn: true}
+
+	var sendResponse secrt.SendResponse
+	if err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &sendResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	var message secrt.Message
+	if err := jtp.Call("GET", ts.url("message", sendResponse.ID.String()), bob.header, jtp.Nil, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if !message.Burn || !bob.claims(t, ts, message.Claims).Burn {
+		t.Fatal("expected burn flag in message and claims")
+	}
+
+	err := jtp.Call("GET", ts.url("message", sendResponse.ID.String()), bob.header, jtp.Nil, &message)
+	if !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected burnt message to be gone, got %v", err)
+	}
+}
+
+func TestMessageLifetime(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	tests := []struct {
+		ttl      int64
+		expected time.Duration
+	}{
+		{0, Config.MessageLifetime},
+		{3600, time.Hour},
+		{int64(Config.MaxLifetime.Seconds()) * 2, Config.MaxLifetime},
+	}
+
+	for _, test := range tests {
+		before := time.Now()
+
+		var sendResponse secrt.SendResponse
+		request := &secrt.SendRequest{Payload: []byte("payload"), TTL: test.ttl}
+		if err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &sendResponse); err != nil {
+			t.Fatal(err)
+		}
+
+		lifetime := time.Unix(sendResponse.Expiry, 0).Sub(before)
+		if lifetime < test.expected-time.Second || lifetime > test.expected+time.Second {
+			t.Errorf("ttl %d: expected lifetime %s, got %s", test.ttl, test.expected, lifetime)
+		}
+	}
+}
+
+func TestInvite(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	ctx := context.Background()
+
+	peer, err := Storage.GetPeer(ctx, ts.server.Server, ts.server.AliasHash(alice.alias))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Storage.SetPeerPolicy(ctx, ts.server.Server, peer.Peer, &Policy{Invites: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = jtp.Call("POST", ts.url("invite", "not an address"), alice.header, jtp.Nil, jtp.Nil); !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+
+	if err = jtp.Call("POST", ts.url("invite", "bob@example.com"), alice.header, jtp.Nil, jtp.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending invite uses up Alice's allowance.
+	err = jtp.Call("POST", ts.url("invite", "carol@example.com"), alice.header, jtp.Nil, jtp.Nil)
+	var policyErr secrt.PolicyError
+	if !jtp.DecodeBody(err, &policyErr) || policyErr.Policy != secrt.PolicyInvites {
+		t.Fatalf("expected invite limit, got %v", err)
+	}
+
+	// Bob is linked to Alice when he joins, and the invite is used up.
+	bob := ts.enrol("bob@example.com")
+	if len(bob.inviters) != 1 || !bytes.Equal(bob.inviters[0], ts.server.AliasHash(alice.alias)) {
+		t.Fatalf("unexpected inviters: %v", bob.inviters)
+	}
+
+	usage, err := Storage.GetUsage(ctx, ts.server.Server, peer.Peer, today())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Invites != 1 || usage.PendingInvites != 0 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	if err = Storage.SetPeerPolicy(ctx, ts.server.Server, peer.Peer, &Policy{Invites: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inviting a peer looks the same as inviting anyone else, but nobody is emailed.
+	Config.EnrolAction = EnrolMail
+	if err = jtp.Call("POST", ts.url("invite", bob.alias), alice.header, jtp.Nil, jtp.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol is only emailed once, however often she's invited.
+	for range 2 {
+		if err = jtp.Call("POST", ts.url("invite", "carol@example.com"), alice.header, jtp.Nil, jtp.Nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(MailChannel) != 1 {
+		t.Fatalf("expected one invitation, got %d", len(MailChannel))
+	}
+
+	if invitation := <-MailChannel; invitation.To != "carol@example.com" {
+		t.Fatalf("unexpected invitation for %s", invitation.To)
+	}
+}
+
+// failingMailer fails the given number of times before succeeding.
+type failingMailer struct {
+	failures int
+	MemoryMailer
+}
+
+func (m *failingMailer) Send(ctx context.Context, email *Email) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("temporary failure")
+	}
+	return m.MemoryMailer.Send(ctx, email)
+}
+
+func TestMail(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	mailRetryDelay = time.Millisecond
+
+	invite := &MailRequest{
+		To:       "bob@example.com",
+		Template: "invite",
+		Server:   ts.server,
+		Values: &Invitation{
+			Server:  ts.server,
+			Inviter: "alice@example.com",
+			Invitee: "bob@example.com",
+			Expiry:  time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	if err := sendmail(ctx, invite); err != nil {
+		t.Fatal(err)
+	}
+
+	emails := Mail.(*MemoryMailer).Emails()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+
+	email := emails[0]
+	if email.To != "bob@example.com" || email.Subject != "you've been invited to secrt.io" {
+		t.Fatalf("unexpected email: %+v", email)
+	}
+
+	if !strings.Contains(email.Text, "alice@example.com has invited you") || !strings.Contains(email.Text, "1 March 2025") {
+		t.Fatalf("unexpected text: %s", email.Text)
+	}
+
+	if !strings.Contains(email.HTML, "<html") || !strings.Contains(email.HTML, "alice@example.com") {
+		t.Fatalf("unexpected HTML: %s", email.HTML)
+	}
+
+	// Templates can be overridden for each server. The HTML part is optional.
+	Config.MailTemplates = t.TempDir()
+	t.Cleanup(func() { Config.MailTemplates = "" })
+
+	dir := filepath.Join(Config.MailTemplates, "127.0.0.1")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	override := `{{define "subject"}}join {{.Inviter}}{{end}}custom invite`
+	if err := os.WriteFile(filepath.Join(dir, "invite.txt"), []byte(override), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	email, err := renderMail(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email.Subject != "join alice@example.com" || email.Text != "custom invite" || !strings.Contains(email.HTML, "<html") {
+		t.Fatalf("unexpected email: %+v", email)
+	}
+
+	// Failed deliveries are retried after a delay, rather than holding up the poller, and without
+	// going through the queue.
+	Config.MailRetries = 2
+	failing := &failingMailer{failures: 2}
+	Mail = failing
+	deliverMail(invite)
+
+	for deadline := time.Now().Add(time.Second); len(failing.Emails()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the email to be delivered after two retries")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(MailChannel) != 0 {
+		t.Fatalf("expected retries to bypass the queue, got %d", len(MailChannel))
+	}
+
+	// After SECRT_MAIL_RETRIES retries, the email is dropped.
+	if retryMail(invite, errors.New("temporary failure")) {
+		t.Fatal("expected delivery to be abandoned")
+	}
+
+	// When the queue is full, queueMail waits until its context is done, and enrolment fails with
+	// 503 rather than dropping the activation code.
+	for range cap(MailChannel) {
+		if err = queueMail(ctx, invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = queueMail(cancelled, invite); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+
+	Config.EnrolAction = EnrolMail
+	mailQueueTimeout = 10 * time.Millisecond
+	request := &secrt.EnrolmentRequest{PublicKey: make([]byte, 32)}
+	if err = jtp.Call("POST", ts.url("enrol", "carol@example.com"), ts.challenge(), request, &secrt.EnrolmentResponse{}); !errors.Is(err, jtp.ErrServiceUnavailable) {
+		t.Fatalf("expected service unavailable, got %v", err)
+	}
+
+	for len(MailChannel) > 0 {
+		<-MailChannel
+	}
+
+	if err = jtp.Call("POST", ts.url("enrol", "carol@example.com"), ts.challenge(), request, &secrt.EnrolmentResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if activation := <-MailChannel; activation.To != "carol@example.com" || activation.Template != "activation" {
+		t.Fatalf("unexpected email: %+v", activation)
+	}
+
+	// The mbox mailer appends each message to a file.
+	mbox := filepath.Join(t.TempDir(), "secrt.mbox")
+	Mail = NewMboxMailer(mbox)
+	for range 2 {
+		if err = sendmail(ctx, invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := os.ReadFile(mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(content), "\nFrom secrt "); n != 1 || !strings.HasPrefix(string(content), "From secrt ") {
+		t.Fatalf("expected 2 messages in mbox:\n%s", content)
+	}
+
+	if !strings.Contains(string(content), "Subject: join alice@example.com") {
+		t.Fatalf("unexpected mbox:\n%s", content)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+	carol := ts.enrol("carol@example.com")
+	Config.NotifyDelay = 50 * time.Millisecond
+
+	// The address must be the peer's own alias.
+	request := &secrt.NotifyRequest{Notify: secrt.NotifyEmail, Address: bob.alias}
+	if err := jtp.Call("POST", ts.url("notify"), alice.header, request, jtp.Nil); !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+
+	request.Address = alice.alias
+	if err := jtp.Call("POST", ts.url("notify"), alice.header, request, jtp.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address is encrypted with the notify key, not the server's key, which is in the database.
+	peer, err := Storage.GetPeer(context.Background(), ts.server.Server, ts.server.AliasHash(alice.alias))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ts.server.DecryptSecret(peer.Notify); err == nil {
+		t.Fatal("expected the address not to decrypt with the server's key")
+	}
+
+	// A burst of messages produces one notification.
+	payload := []byte("the launch code is 0000")
+	for _, sender := range []*testPeer{bob, carol, bob} {
+		message := &secrt.SendRequest{Payload: payload}
+		if err := jtp.Call("POST", ts.url("message", alice.alias), sender.header, message, &secrt.SendResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var notification *MailRequest
+	select {
+	case notification = <-MailChannel:
+	case <-time.After(time.Second):
+		t.Fatal("expected a notification")
+	}
+
+	email, err := renderMail(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email.To != alice.alias || email.Subject != "you have 3 new secrets on secrt.io" {
+		t.Fatalf("unexpected email: %+v", email)
+	}
+
+	if !strings.Contains(email.Text, "from bob@example.com, carol@example.com.") || strings.Contains(email.Text, string(payload)) {
+		t.Fatalf("unexpected text: %s", email.Text)
+	}
+
+	// Notifications are rate limited, so the next message doesn't produce an email straight away.
+	if err = jtp.Call("POST", ts.url("message", alice.alias), bob.header, &secrt.SendRequest{Payload: payload}, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case notification = <-MailChannel:
+		t.Fatalf("unexpected notification: %+v", notification)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Peers who haven't asked for notifications don't get them.
+	request = &secrt.NotifyRequest{Notify: secrt.NotifyNone}
+	if err = jtp.Call("POST", ts.url("notify"), bob.header, request, jtp.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = jtp.Call("POST", ts.url("message", bob.alias), carol.header, &secrt.SendRequest{Payload: payload}, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case notification = <-MailChannel:
+		t.Fatalf("unexpected notification: %+v", notification)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Without a notify key, peers can't ask for notifications.
+	notifyKey = nil
+	request = &secrt.NotifyRequest{Notify: secrt.NotifyEmail, Address: carol.alias}
+	if err = jtp.Call("POST", ts.url("notify"), carol.header, request, jtp.Nil); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+	Config.WatchTimeout = 500 * time.Millisecond
+
+	// Messages that are already waiting aren't sent.
+	if err := jtp.Call("POST", ts.url("message", alice.alias), bob.header, &secrt.SendRequest{Payload: []byte("old")}, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", ts.url("inbox", "watch"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = alice.header
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	var sent secrt.SendResponse
+	if err = jtp.Call("POST", ts.url("message", alice.alias), bob.header, &secrt.SendRequest{Payload: []byte("new")}, &sent); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new message arrives, and then the watch times out.
+	var events []*jtp.Event
+	if err = jtp.ReadEvents(resp.Body, func(event *jtp.Event) error {
+		events = append(events, event)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Event != secrt.WatchMessage || events[1].Event != secrt.WatchTimeout {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	var message secrt.Message
+	if err = json.Unmarshal(events[0].Data, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Message != sent.ID || events[0].ID != sent.ID.String() || len(message.Payload) != 0 {
+		t.Fatalf("unexpected message: %+v", message)
+	}
+
+	if !bytes.Equal(alice.claims(t, ts, message.Claims).Sender, ts.server.AliasHash(bob.alias)) {
+		t.Fatal("unexpected sender")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	if err := setPlanCmd(ts.http.URL, "free", alice.alias); err != nil {
+		t.Fatal(err)
+	}
+
+	// The free plan has a 10KB limit.
+	request := &secrt.SendRequest{Payload: make([]byte, 20*1024)}
+	err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &secrt.SendResponse{})
+
+	var policyErr secrt.PolicyError
+	if !jtp.DecodeBody(err, &policyErr) || policyErr.Policy != secrt.PolicyMaxPayloadSize || policyErr.Plan != "free" {
+		t.Fatalf("expected payload size policy error, got %v (%+v)", err, policyErr)
+	}
+
+	// Bob isn't on the free plan.
+	if err = jtp.Call("POST", ts.url("message", alice.alias), bob.header, request, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages that can't be stored don't count towards the daily limit.
+	if _, err = ts.postStream(alice, bob.alias, &secrt.SendRequest{}, nil); !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+
+	// The free plan has a daily limit of 10 messages.
+	request.Payload = []byte("payload")
+	for i := 0; i < Plans["free"].DailyLimit; i++ {
+		if err = jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &secrt.SendResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &secrt.SendResponse{})
+	if !errors.Is(err, jtp.TooManyRequestsError(nil)) || !jtp.DecodeBody(err, &policyErr) || policyErr.Policy != secrt.PolicyDailyLimit {
+		t.Fatalf("expected daily limit policy error, got %v", err)
+	}
+
+	// The free plan limits the lifetime of messages to 4 hours.
+	if Plans["free"].Lifetime(int64((48 * time.Hour).Seconds())) != 4*time.Hour {
+		t.Fatal("expected lifetime to be capped by the plan")
+	}
+}
+
+// Both stores return a copy of the policy, and don't have a policy for unknown peers.
+func TestGetPolicy(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	ctx := context.Background()
+
+	peer, err := Storage.GetPeer(ctx, ts.server.Server, ts.server.AliasHash(alice.alias))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Storage.SetServerPolicy(ctx, ts.server.Server, &Policy{DailyLimit: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := Storage.GetPolicy(ctx, ts.server.Server, peer.Peer)
+	if err != nil || policy.DailyLimit != 5 {
+		t.Fatalf("expected the server policy, got %+v: %v", policy, err)
+	}
+
+	policy.DailyLimit = 1
+	if policy, err = Storage.GetPolicy(ctx, ts.server.Server, peer.Peer); err != nil || policy.DailyLimit != 5 {
+		t.Fatalf("expected the stored policy to be unchanged, got %+v: %v", policy, err)
+	}
+
+	if _, err = Storage.GetPolicy(ctx, ts.server.Server, uuid.New()); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("expected unknown peer, got %v", err)
+	}
+}
+
+// Concurrent senders can't get past the daily limit between them.
+func TestConcurrentDailyLimit(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	if err := setPlanCmd(ts.http.URL, "free", alice.alias); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := Plans["free"].DailyLimit
+	results := make(chan error)
+	for range 3 * limit {
+		go func() {
+			request := &secrt.SendRequest{Payload: []byte("payload")}
+			results <- jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &secrt.SendResponse{})
+		}()
+	}
+
+	sent := 0
+	for range 3 * limit {
+		if err := <-results; err == nil {
+			sent++
+		} else if !errors.Is(err, jtp.TooManyRequestsError(nil)) {
+			t.Error(err)
+		}
+	}
+
+	if sent != limit {
+		t.Fatalf("expected %d messages to be sent, got %d", limit, sent)
+	}
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	// Most requests are limited by SECRT_MAX_REQUEST_SIZE.
+	request := &secrt.EnrolmentRequest{PublicKey: make([]byte, Config.MaxRequestSize)}
+	err := jtp.Call("POST", ts.url("enrol", "carol@example.com"), nil, request, &secrt.EnrolmentResponse{})
+	if !errors.Is(err, jtp.RequestEntityTooLargeError(nil)) {
+		t.Fatalf("expected request entity too large, got %v", err)
+	}
+
+	// Messages are limited by the sender's policy, and are rejected before they're decoded.
+	if err = setPlanCmd(ts.http.URL, "free", alice.alias); err != nil {
+		t.Fatal(err)
+	}
+
+	message := &secrt.SendRequest{Payload: make([]byte, Config.MaxRequestSize)}
+	err = jtp.Call("POST", ts.url("message", bob.alias), alice.header, message, &secrt.SendResponse{})
+
+	var policyErr secrt.PolicyError
+	if !errors.Is(err, jtp.RequestEntityTooLargeError(nil)) || jtp.DecodeBody(err, &policyErr) {
+		t.Fatalf("expected request entity too large, got %v", err)
+	}
+
+	// Bob's default policy allows larger messages.
+	message.Payload = make([]byte, DefaultPolicy.MaxPayloadSize)
+	if err = jtp.Call("POST", ts.url("message", alice.alias), bob.header, message, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingStore counts the peer lookups made by Authenticate.
+type countingStore struct {
+	Store
+	lookups atomic.Int32
+}
+
+func (s *countingStore) GetPeerByID(ctx context.Context, server uuid.UUID, peer uuid.UUID) (*Peer, error) {
+	s.lookups.Add(1)
+	return s.Store.GetPeerByID(ctx, server, peer)
+}
+
+// The limit function and the handler share the authenticated peer.
+func TestAuthenticateOnce(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	store := &countingStore{Store: Storage}
+	Storage = store
+
+	request := &secrt.SendRequest{Payload: []byte("payload")}
+	if err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, request, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if lookups := store.lookups.Load(); lookups != 1 {
+		t.Fatalf("expected 1 peer lookup, got %d", lookups)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	var tokenResponse secrt.TokenResponse
+	if err := jtp.Call("POST", ts.url("logout"), alice.header, jtp.Nil, &tokenResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old token is revoked.
+	var httpErr *jtp.HTTPError
+	err := jtp.Call("GET", ts.url("peer", bob.alias), alice.header, jtp.Nil, &secrt.Peer{})
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorTokenRevoked {
+		t.Fatalf("expected revoked token, got %v", err)
+	}
+
+	// The new token works, and can be refreshed.
+	alice.header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString(tokenResponse.Token))
+	if err = jtp.Call("POST", ts.url("token"), alice.header, jtp.Nil, &tokenResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	if tokenResponse.Expiry == 0 {
+		t.Fatal("expected token to have an expiry")
+	}
+
+	// Bob's token is unaffected, unless it's too old.
+	if err = jtp.Call("GET", ts.url("peer", alice.alias), bob.header, jtp.Nil, &secrt.Peer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	Config.MaxTokenAge = time.Nanosecond
+	err = jtp.Call("GET", ts.url("peer", alice.alias), bob.header, jtp.Nil, &secrt.Peer{})
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorTokenExpired {
+		t.Fatalf("expected expired token, got %v", err)
+	}
+}
+
+// seal encrypts a message for the server, in the same format as the client.
+func (ts *testServer) seal(plaintext []byte, privateKey []byte) []byte {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	ciphertext := append([]byte{0}, nonce[:]...)
+	return box.Seal(ciphertext, plaintext, &nonce, secrt.To32(ts.server.PublicBoxKey), secrt.To32(privateKey))
+}
+
+func TestRekey(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := json.Marshal(&secrt.RekeyProof{PublicKey: public[:], Timestamp: time.Now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both keys must be proven.
+	request := &secrt.RekeyRequest{
+		PublicKey:   public[:],
+		OldKeyProof: ts.seal(proof, private[:]),
+		NewKeyProof: ts.seal(proof, private[:]),
+		TeamKeys:    make(map[string][]byte),
+	}
+
+	var httpErr *jtp.HTTPError
+	err = jtp.Call("POST", ts.url("rekey"), alice.header, request, &secrt.Peer{})
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorInvalidProof {
+		t.Fatalf("expected invalid proof, got %v", err)
+	}
+
+	// Alice's team key is sealed for her new key as well.
+	key, err := secrt.NewTeamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teamRequest := &secrt.TeamRequest{Members: []secrt.TeamInvite{alice.invite(t, key)}}
+	if err = jtp.Call("POST", ts.url("team", "sre"), alice.header, teamRequest, &secrt.Team{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.TeamKeys["team:sre"], err = key.Seal(public[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	request.OldKeyProof = ts.seal(proof, alice.privateKey)
+	if err = jtp.Call("POST", ts.url("rekey"), alice.header, request, &secrt.Peer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var team secrt.Team
+	if err = jtp.Call("GET", ts.url("team", "sre"), alice.header, jtp.Nil, &team); err != nil {
+		t.Fatal(err)
+	}
+
+	if opened, err := secrt.OpenTeamKey(team.TeamKey, public[:], private[:]); err != nil || *opened != *key {
+		t.Fatalf("team key wasn't replaced: %v", err)
+	}
+
+	// Bob can see that the key was rotated.
+	var peer secrt.Peer
+	if err = jtp.Call("GET", ts.url("peer", alice.alias), bob.header, jtp.Nil, &peer); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(peer.PublicKey, public[:]) || len(peer.PreviousKeys) != 1 || !bytes.Equal(peer.PreviousKeys[0].PublicKey, alice.publicKey) {
+		t.Fatalf("expected rotated key, got %+v", peer)
+	}
+
+	// Messages encrypted for the old key are rejected.
+	message := &secrt.SendRequest{Payload: []byte("payload"), RecipientKey: alice.publicKey}
+	err = jtp.Call("POST", ts.url("message", alice.alias), bob.header, message, &secrt.SendResponse{})
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorRecipientKey {
+		t.Fatalf("expected recipient key error, got %v", err)
+	}
+
+	message.RecipientKey = public[:]
+	if err = jtp.Call("POST", ts.url("message", alice.alias), bob.header, message, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// postStream sends a streamed payload, with the envelope in the header.
+func (ts *testServer) postStream(sender *testPeer, recipient string, envelope *secrt.SendRequest, payload []byte) (*secrt.SendResponse, error) {
+	envelopeJS, err := json.Marshal(envelope)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	header := sender.header.Clone()
+	header.Set(secrt.EnvelopeHeader, base64.StdEncoding.EncodeToString(envelopeJS))
+
+	var response secrt.SendResponse
+	err = jtp.Upload("POST", ts.url("message", recipient, "stream"), header, bytes.NewReader(payload), &response)
+	return &response, err
+}
+
+func TestStreamedMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	if err := setPlanCmd(ts.http.URL, "ops", alice.alias); err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := make([]byte, 3*secrt.StreamChunkSize+10)
+	rand.Read(plaintext)
+
+	var ciphertext bytes.Buffer
+	stream, err := secrt.NewStreamWriter(&ciphertext, bob.publicKey, alice.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write(plaintext)
+	stream.Close()
+
+	sendResponse, err := ts.postStream(alice, bob.alias, &secrt.SendRequest{Metadata: []byte("metadata"), Burn: true}, ciphertext.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed burn-after-read messages are only deleted once the payload is read.
+	id := sendResponse.ID.String()
+	var message secrt.Message
+	for range 2 {
+		if err = jtp.Call("GET", ts.url("message", id), bob.header, jtp.Nil, &message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !message.Streamed || len(message.Payload) != 0 || string(message.Metadata) != "metadata" {
+		t.Fatalf("unexpected message: %+v", message)
+	}
+
+	body, err := jtp.Download("GET", ts.url("message", id, "stream"), bob.header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	if !bytes.Equal(payloadHash[:], bob.claims(t, ts, message.Claims).PayloadHash) {
+		t.Fatal("payload claim does not match streamed payload")
+	}
+
+	reader, err := secrt.NewStreamReader(bytes.NewReader(payload), alice.publicKey, bob.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := io.ReadAll(reader); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("unable to decrypt streamed payload: %v", err)
+	}
+
+	if _, err = jtp.Download("GET", ts.url("message", id, "stream"), bob.header); !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected burnt message to be gone, got %v", err)
+	}
+
+	// Bob's default policy limits the size of the payload.
+	_, err = ts.postStream(bob, alice.alias, &secrt.SendRequest{}, ciphertext.Bytes())
+	var policyErr secrt.PolicyError
+	if !jtp.DecodeBody(err, &policyErr) || policyErr.Policy != secrt.PolicyMaxPayloadSize {
+		t.Fatalf("expected payload size policy error, got %v", err)
+	}
+}
+
+func TestReservedPeer(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+
+	// A peer who enrolled as the server before the alias was reserved.
+	store := Storage.(*MemoryStore)
+	for _, peer := range store.peers[ts.server.Server] {
+		if bytes.Equal(peer.PublicKey, alice.publicKey) {
+			peer.AliasHash = ts.server.AliasHash(secrt.ServerAlias)
+		}
+	}
+
+	var httpErr *jtp.HTTPError
+	err := jtp.Call("POST", ts.url("message", bob.alias), alice.header, &secrt.SendRequest{Payload: []byte("payload")}, &secrt.SendResponse{})
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+}
+
+// failingWriter fails every write, like a client that disconnects.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestPayloadWriteFails(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	server, peer, payloadID := uuid.New(), uuid.New(), uuid.New()
+	expiry := time.Now().Add(time.Hour)
+
+	if _, err := store.AddPayload(ctx, server, payloadID, expiry, strings.NewReader("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	message := &Message{Server: server, Peer: peer, Message: uuid.New(), Expiry: expiry, Burn: true, Streamed: true, PayloadID: payloadID}
+	if err := store.AddMessages(ctx, message); err != nil {
+		t.Fatal(err)
+	}
+
+	// A burn-after-read message isn't lost if the reader goes away.
+	if err := store.GetPayload(ctx, server, message.Message, true, failingWriter{}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected write error, got %v", err)
+	}
+
+	var payload bytes.Buffer
+	if err := store.GetPayload(ctx, server, message.Message, true, &payload); err != nil || payload.String() != "payload" {
+		t.Fatalf("expected payload, got %q, %v", payload.String(), err)
+	}
+
+	if err := store.GetPayload(ctx, server, message.Message, true, &payload); !errors.Is(err, ErrUnknownMessageID) {
+		t.Fatalf("expected burnt message to be gone, got %v", err)
+	}
+}
+
+func TestSharedMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+	carol := ts.enrol("carol@example.com")
+
+	key, err := secrt.NewStreamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertext bytes.Buffer
+	stream, err := secrt.NewSharedStreamWriter(&ciphertext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("shared secret"))
+	stream.Close()
+
+	envelope := &secrt.SharedSendRequest{}
+	for _, recipient := range []*testPeer{bob, carol} {
+		payloadKey, err := key.Seal(recipient.publicKey, alice.privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		envelope.Recipients = append(envelope.Recipients, &secrt.RecipientEnvelope{
+			Alias:        recipient.alias,
+			RecipientKey: recipient.publicKey,
+			Metadata:     []byte("metadata"),
+			PayloadKey:   payloadKey,
+		})
+	}
+
+	envelopeJS, _ := json.Marshal(envelope)
+	header := alice.header.Clone()
+	header.Set(secrt.EnvelopeHeader, base64.StdEncoding.EncodeToString(envelopeJS))
+
+	var response secrt.SharedSendResponse
+	if err = jtp.Upload("POST", ts.url("message"), header, bytes.NewReader(ciphertext.Bytes()), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Messages) != 2 {
+		t.Fatalf("expected 2 messages, got %v", response.Messages)
+	}
+
+	for i, recipient := range []*testPeer{bob, carol} {
+		id := response.Messages[i].ID.String()
+
+		var message secrt.Message
+		if err = jtp.Call("GET", ts.url("message", id), recipient.header, jtp.Nil, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := jtp.Download("GET", ts.url("message", id, "stream"), recipient.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _ := io.ReadAll(body)
+		body.Close()
+
+		payloadHash := sha256.Sum256(payload)
+		if !bytes.Equal(payloadHash[:], recipient.claims(t, ts, message.Claims).PayloadHash) {
+			t.Fatal("payload claim does not match shared payload")
+		}
+
+		opened, err := secrt.OpenStreamKey(message.PayloadKey, alice.publicKey, recipient.privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := secrt.NewSharedStreamReader(bytes.NewReader(payload), opened)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := io.ReadAll(reader); err != nil || string(plaintext) != "shared secret" {
+			t.Fatalf("unable to decrypt shared payload: %q %v", plaintext, err)
+		}
+
+		// The payload is only stored once, and it's deleted along with the last message.
+		if err = jtp.Call("DELETE", ts.url("message", id), recipient.header, jtp.Nil, jtp.Nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if payloads := len(Storage.(*MemoryStore).payloads); payloads != 1-i {
+			t.Fatalf("expected %d stored payloads, got %d", 1-i, payloads)
+		}
+	}
+
+	// A duplicate recipient is rejected.
+	envelope.Recipients[1] = envelope.Recipients[0]
+	envelopeJS, _ = json.Marshal(envelope)
+	header.Set(secrt.EnvelopeHeader, base64.StdEncoding.EncodeToString(envelopeJS))
+	err = jtp.Upload("POST", ts.url("message"), header, bytes.NewReader(ciphertext.Bytes()), &response)
+	if !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+}
+
+// invite returns an invitation to a team for the peer.
+func (peer *testPeer) invite(t *testing.T, key *secrt.TeamKey) secrt.TeamInvite {
+	t.Helper()
+
+	alias, err := key.EncryptAlias(peer.alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := key.Seal(peer.publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secrt.TeamInvite{Peer: peer.alias, Alias: alias, TeamKey: sealed}
+}
+
+// teamAliases returns the decrypted aliases of the members.
+func teamAliases(t *testing.T, key *secrt.TeamKey, members []secrt.TeamMember) []string {
+	t.Helper()
+
+	var aliases []string
+	for _, member := range members {
+		alias, err := key.DecryptAlias(member.Alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aliases = append(aliases, alias)
+	}
+
+	return aliases
+}
+
+func TestTeams(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.enrol("alice@example.com")
+	bob := ts.enrol("bob@example.com")
+	carol := ts.enrol("carol@example.com")
+
+	key, err := secrt.NewTeamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new team has to include its owner, so they have a copy of the team key.
+	var team secrt.Team
+	request := &secrt.TeamRequest{Members: []secrt.TeamInvite{bob.invite(t, key)}}
+	if err = jtp.Call("POST", ts.url("team", "sre"), alice.header, request, &team); !errors.Is(err, jtp.ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+
+	// Adding members creates the team, with the caller as its owner and first member. Other peers
+	// are invited, and aren't members until they join.
+	request = &secrt.TeamRequest{Members: []secrt.TeamInvite{alice.invite(t, key), bob.invite(t, key)}}
+	if err = jtp.Call("POST", ts.url("team", "sre"), alice.header, request, &team); err != nil {
+		t.Fatal(err)
+	}
+
+	if team.Team != "team:sre" || len(team.Members) != 1 || len(team.Invited) != 1 {
+		t.Fatalf("unexpected team: %+v", team)
+	}
+
+	// The server can't read the aliases, but the owner can, and can check them.
+	opened, err := secrt.OpenTeamKey(team.TeamKey, alice.publicKey, alice.privateKey)
+	if err != nil || *opened != *key {
+		t.Fatalf("unable to open team key: %v", err)
+	}
+
+	if owner := teamAliases(t, key, []secrt.TeamMember{team.Owner}); owner[0] != alice.alias {
+		t.Fatalf("unexpected owner %s", owner)
+	}
+
+	if !slices.Equal(teamAliases(t, key, team.Invited), []string{bob.alias}) || !bytes.Equal(team.Invited[0].AliasHash, ts.server.AliasHash(bob.alias)) {
+		t.Fatalf("unexpected invitations: %+v", team.Invited)
+	}
+
+	var teams secrt.TeamList
+	if err = jtp.Call("GET", ts.url("team"), bob.header, jtp.Nil, &teams); err != nil || len(teams.Teams) != 0 || !slices.Equal(teams.Invitations, []string{"team:sre"}) {
+		t.Fatalf("unexpected teams for bob: %+v %v", teams, err)
+	}
+
+	// Invited peers can't see the team, or be sent its messages.
+	if err = jtp.Call("GET", ts.url("team", "sre"), bob.header, jtp.Nil, &team); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	message := &secrt.SendRequest{Payload: []byte("page"), Team: team.Team}
+	err = jtp.Call("POST", ts.url("message", bob.alias), alice.header, message, &secrt.SendResponse{})
+	var httpErr *jtp.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorTeamMember {
+		t.Fatalf("expected %s error, got %v", secrt.ErrorTeamMember, err)
+	}
+
+	// Only invited peers can join. Once they have, they get their copy of the team key.
+	if err = jtp.Call("POST", ts.url("team", "sre", "join"), carol.header, jtp.Nil, &team); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	team = secrt.Team{}
+	if err = jtp.Call("POST", ts.url("team", "sre", "join"), bob.header, jtp.Nil, &team); err != nil {
+		t.Fatal(err)
+	}
+
+	if opened, err = secrt.OpenTeamKey(team.TeamKey, bob.publicKey, bob.privateKey); err != nil || *opened != *key {
+		t.Fatalf("unable to open team key: %v", err)
+	}
+
+	if !slices.Equal(teamAliases(t, key, team.Members), []string{alice.alias, bob.alias}) || len(team.Invited) != 0 {
+		t.Fatalf("unexpected team: %+v", team)
+	}
+
+	// Only the owner can add members, and members must be enrolled.
+	request = &secrt.TeamRequest{Members: []secrt.TeamInvite{carol.invite(t, key)}}
+	if err = jtp.Call("POST", ts.url("team", "sre"), carol.header, request, &team); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	request = &secrt.TeamRequest{Members: []secrt.TeamInvite{{Peer: "nobody@example.com", Alias: []byte("x"), TeamKey: []byte("x")}}}
+	if err = jtp.Call("POST", ts.url("team", "sre"), alice.header, request, &team); !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// Members can see the members of a team, with their current keys, but other peers can't.
+	team = secrt.Team{}
+	if err = jtp.Call("GET", ts.url("team", "team:sre"), bob.header, jtp.Nil, &team); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(team.Members) != 2 || !bytes.Equal(team.Members[1].PublicKey, bob.publicKey) {
+		t.Fatalf("unexpected team: %+v", team)
+	}
+
+	if err = jtp.Call("GET", ts.url("team", "team:sre"), carol.header, jtp.Nil, &team); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	teams = secrt.TeamList{}
+	if err = jtp.Call("GET", ts.url("team"), bob.header, jtp.Nil, &teams); err != nil || !slices.Equal(teams.Teams, []string{"team:sre"}) || len(teams.Invitations) != 0 {
+		t.Fatalf("unexpected teams for bob: %+v %v", teams, err)
+	}
+
+	teams = secrt.TeamList{}
+	if err = jtp.Call("GET", ts.url("team"), carol.header, jtp.Nil, &teams); err != nil || len(teams.Teams) != 0 || len(teams.Invitations) != 0 {
+		t.Fatalf("unexpected teams for carol: %+v %v", teams, err)
+	}
+
+	// Messages can be sent to members of the team.
+	if err = jtp.Call("POST", ts.url("message", bob.alias), alice.header, message, &secrt.SendResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Members can't remove other members, but they can leave.
+	if err = jtp.Call("DELETE", ts.url("team", "sre", "member", alice.alias), bob.header, jtp.Nil, &team); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	team = secrt.Team{}
+	if err = jtp.Call("DELETE", ts.url("team", "sre", "member", bob.alias), bob.header, jtp.Nil, &team); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(teamAliases(t, key, team.Members), []string{alice.alias}) {
+		t.Fatalf("unexpected team: %+v", team)
+	}
+
+	// Messages to former members are rejected, so the sender can check the team again.
+	err = jtp.Call("POST", ts.url("message", bob.alias), alice.header, message, &secrt.SendResponse{})
+	if !errors.As(err, &httpErr) || httpErr.Code != secrt.ErrorTeamMember {
+		t.Fatalf("expected %s error, got %v", secrt.ErrorTeamMember, err)
+	}
+
+	// Only the owner can delete the team.
+	if err = jtp.Call("DELETE", ts.url("team", "sre"), carol.header, jtp.Nil, jtp.Nil); !errors.Is(err, jtp.ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	if err = jtp.Call("DELETE", ts.url("team", "sre"), alice.header, jtp.Nil, jtp.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = jtp.Call("GET", ts.url("team", "sre"), alice.header, jtp.Nil, &team); !errors.Is(err, jtp.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
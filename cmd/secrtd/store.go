@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	StorePostgres = "postgres"
+	StoreMemory   = "memory"
+)
+
+var ErrUnknownServer error = errors.New("unknown server")
+var ErrUnknownPeer error = errors.New("unknown peer")
+var ErrUnknownActivation error = errors.New("activation token not found")
+var ErrKeyChanged error = errors.New("public key has changed")
+var ErrUnknownTeam error = errors.New("unknown team")
+var ErrTeamExists error = errors.New("team already exists")
+var ErrQuotaExceeded error = errors.New("quota exceeded")
+
+// payloadChunkSize is the size of the chunks that streamed payloads are stored in.
+const payloadChunkSize = 64 * 1024
+
+// Storage is the store used by all the handlers. It's initialised by mustInitStore,
+// based on the value of SECRT_STORE.
+var Storage Store
+
+// Store is the interface between the server and its persistent storage. Handlers should
+// only use the store to read and write servers, peers, activations and messages.
+//
+// PostgresStore is the production implementation. MemoryStore keeps everything in memory,
+// which is handy for development and testing, but obviously loses everything on restart.
+type Store interface {
+	// AddServer stores a newly created server, including its keys.
+	AddServer(ctx context.Context, server *SecretServer) error
+
+	// AddHostname associates a hostname with an existing server. Requests are dispatched
+	// to a server based on the hostname.
+	AddHostname(ctx context.Context, hostname string, server uuid.UUID) error
+
+	// GetServer returns the server associated with the given hostname, or ErrUnknownServer.
+	GetServer(ctx context.Context, hostname string) (*SecretServer, error)
+
+	// GetPeer returns the peer with the given alias hash, or ErrUnknownPeer. Aliases are never
+	// stored, so the peer's Alias is empty.
+	GetPeer(ctx context.Context, server uuid.UUID, aliasHash []byte) (*Peer, error)
+
+	// GetPeerByID returns the peer with the given ID, or ErrUnknownPeer.
+	GetPeerByID(ctx context.Context, server uuid.UUID, peer uuid.UUID) (*Peer, error)
+
+	// Enrol creates an activation token and code for the given alias hash and key, cancelling
+	// any previous enrolment for the same alias.
+	Enrol(ctx context.Context, server uuid.UUID, aliasHash []byte, publicKey []byte) ([]byte, int, error)
+
+	// Activate consumes an activation token and code, and creates the associated peer.
+	Activate(ctx context.Context, token []byte, code int) (*Peer, error)
+
+	// RevokeTokens rejects all authentication tokens issued to the peer before the given time.
+	RevokeTokens(ctx context.Context, server uuid.UUID, peer uuid.UUID, before time.Time) error
+
+	// SetNotify sets the encrypted address used to notify the peer about new messages. nil stops
+	// notifications.
+	SetNotify(ctx context.Context, server uuid.UUID, peer uuid.UUID, address []byte) error
+
+	// RotateKey replaces the peer's public key, and records the old key as a previous key.
+	// Returns ErrKeyChanged if the peer's current key isn't oldKey.
+	RotateKey(ctx context.Context, server uuid.UUID, peer uuid.UUID, oldKey []byte, newKey []byte) error
+
+	// GetPreviousKeys returns the keys the peer has rotated out, oldest first.
+	GetPreviousKeys(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]*PeerKey, error)
+
+	// AddMessages stores new messages in their recipients' inboxes. Either all of the messages are
+	// stored, or none of them are.
+	AddMessages(ctx context.Context, msgs ...*Message) error
+
+	// GetInbox returns the unexpired messages waiting for a peer, oldest first. The payload
+	// is not returned.
+	GetInbox(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]*Message, error)
+
+	// FindMessages returns the peer's unexpired messages with IDs between lower and upper (inclusive).
+	FindMessages(ctx context.Context, server uuid.UUID, peer uuid.UUID, lower, upper uuid.UUID) ([]*Message, error)
+
+	// Watch returns a channel that receives the IDs of messages added to the peer's inbox from
+	// now on. The channel is closed when the context is done.
+	Watch(ctx context.Context, server uuid.UUID, peer uuid.UUID) (<-chan uuid.UUID, error)
+
+	// DeleteMessage deletes a message. A streamed payload is deleted along with the last message
+	// that refers to it. Returns ErrUnknownMessageID if the message doesn't exist. Burn-after-read
+	// relies on this: only one caller can successfully delete a message.
+	DeleteMessage(ctx context.Context, server uuid.UUID, message uuid.UUID) error
+
+	// AddPayload stores a streamed payload in chunks, and returns its size. The payload is stored
+	// before any messages that refer to it, so a payload that never gets a message is purged when
+	// it expires.
+	AddPayload(ctx context.Context, server uuid.UUID, payload uuid.UUID, expiry time.Time, r io.Reader) (int64, error)
+
+	// GetPayload writes a message's streamed payload to w. If burn is true, the message is taken
+	// before the payload is written, so only one caller can read it, and it's put back if the payload
+	// can't be written. Returns ErrUnknownMessageID if the message doesn't exist.
+	GetPayload(ctx context.Context, server uuid.UUID, message uuid.UUID, burn bool, w io.Writer) error
+
+	// GetPolicy returns the policy for a peer, which is the peer's own policy if it has one,
+	// or the server's policy. Returns nil if neither has a policy, or ErrUnknownPeer if the peer
+	// doesn't exist.
+	GetPolicy(ctx context.Context, server uuid.UUID, peer uuid.UUID) (*Policy, error)
+
+	// SetServerPolicy sets the default policy for all the server's peers. nil removes the policy.
+	SetServerPolicy(ctx context.Context, server uuid.UUID, policy *Policy) error
+
+	// SetPeerPolicy sets the policy for a single peer. nil removes the policy.
+	SetPeerPolicy(ctx context.Context, server uuid.UUID, peer uuid.UUID, policy *Policy) error
+
+	// GetUsage returns the number of messages sent by the peer on the given day, the number of
+	// invited peers who have joined, and the number of the peer's invites that are still pending.
+	GetUsage(ctx context.Context, server uuid.UUID, peer uuid.UUID, day time.Time) (*Usage, error)
+
+	// UseMessages adds count to the number of messages sent by the peer on the given day, unless
+	// the total would exceed limit, in which case it returns ErrQuotaExceeded. A zero limit means
+	// there is no limit. The check and the update are atomic. A negative count gives messages back.
+	UseMessages(ctx context.Context, server uuid.UUID, peer uuid.UUID, day time.Time, count int, limit int) error
+
+	// AddInvite records an invite from a peer to the given alias hash, and returns true if it's a
+	// new invite. Inviting the same alias again extends the existing invite, and returns false.
+	// A new invite returns ErrQuotaExceeded if the peer's joined and pending invites have reached
+	// limit (zero means there is no limit). The check and the insert are atomic.
+	AddInvite(ctx context.Context, server uuid.UUID, inviter uuid.UUID, inviteeHash []byte, expiry time.Time, limit int) (bool, error)
+
+	// AcceptInvites deletes the invites for the given alias hash, and returns the peers who sent
+	// the unexpired invites, oldest invite first. The oldest invite is counted as one of its sender's
+	// joined invites on the given day, in the same step.
+	AcceptInvites(ctx context.Context, server uuid.UUID, inviteeHash []byte, day time.Time) ([]uuid.UUID, error)
+
+	// AddTeam creates a team, with its owner as the only member. owner holds the owner's encrypted
+	// alias and sealed team key. Returns ErrTeamExists if the team already exists.
+	AddTeam(ctx context.Context, team *Team, owner *TeamMember) error
+
+	// GetTeam returns the team with the given name, including its members, their alias hashes and
+	// their current public keys, or ErrUnknownTeam.
+	GetTeam(ctx context.Context, server uuid.UUID, name string) (*Team, error)
+
+	// GetTeams returns the names of the teams that the peer owns or has joined, and the names of
+	// the teams they've been invited to.
+	GetTeams(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]string, []string, error)
+
+	// AddTeamMember invites a peer to a team. They aren't a member until they've accepted with
+	// JoinTeam. Inviting an existing member or invitee replaces their encrypted alias and sealed
+	// team key. Returns ErrUnknownTeam if the team doesn't exist.
+	AddTeamMember(ctx context.Context, server uuid.UUID, name string, member *TeamMember) error
+
+	// SetTeamKeys replaces the peer's sealed team keys, after the peer has replaced their key pair.
+	// keys maps team names to keys. Teams that the peer doesn't belong to are ignored.
+	SetTeamKeys(ctx context.Context, server uuid.UUID, peer uuid.UUID, keys map[string][]byte) error
+
+	// JoinTeam accepts a peer's invitation to a team. Joining a team again does nothing. Returns
+	// ErrUnknownPeer if the peer hasn't been invited.
+	JoinTeam(ctx context.Context, server uuid.UUID, name string, peer uuid.UUID) error
+
+	// RemoveTeamMember removes a peer from a team, or withdraws their invitation. Returns
+	// ErrUnknownPeer if the peer isn't a member or invitee.
+	RemoveTeamMember(ctx context.Context, server uuid.UUID, name string, peer uuid.UUID) error
+
+	// DeleteTeam deletes a team and its membership. Returns ErrUnknownTeam if the team doesn't exist.
+	DeleteTeam(ctx context.Context, server uuid.UUID, name string) error
+
+	// PurgeExpired deletes expired messages, payloads, activations and invites, returning the
+	// number of messages and activations deleted.
+	PurgeExpired(ctx context.Context) (int64, int64, error)
+}
+
+func mustInitStore() {
+	switch Config.Store {
+	case StorePostgres:
+		mustInitPGX()
+		mustInitPgpkg()
+		Storage = NewPostgresStore(PGXPool)
+	case StoreMemory:
+		Storage = NewMemoryStore()
+	default:
+		panic(fmt.Errorf("unsupported store: %s", Config.Store))
+	}
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It's intended for development and
+// testing: nothing survives a restart. The behaviour is intended to mirror the Postgres schema
+// and functions as closely as possible.
+type MemoryStore struct {
+	lock        sync.Mutex
+	servers     map[uuid.UUID]*SecretServer
+	hostnames   map[string]uuid.UUID
+	peers       map[uuid.UUID]map[string]*Peer // server -> alias hash -> peer
+	activations []*memoryActivation
+	invites     []*memoryInvite
+	messages    []*Message
+	payloads    map[uuid.UUID]*memoryPayload // payload ID -> streamed payload
+	keys        map[uuid.UUID][]*PeerKey     // peer -> previous keys
+	policies    map[uuid.UUID]*Policy        // server or peer -> policy
+	usage       map[memoryUsageKey]*Usage
+	teams       map[uuid.UUID]map[string]*Team // server -> name -> team
+	broker      *broker
+}
+
+type memoryUsageKey struct {
+	server uuid.UUID
+	peer   uuid.UUID
+	day    time.Time
+}
+
+type memoryPayload struct {
+	server uuid.UUID
+	expiry time.Time
+	data   []byte
+}
+
+type memoryInvite struct {
+	server      uuid.UUID
+	inviter     uuid.UUID
+	inviteeHash []byte
+	expiry      time.Time
+}
+
+type memoryActivation struct {
+	token     []byte
+	code      int
+	server    uuid.UUID
+	aliasHash []byte
+	publicKey []byte
+	expiry    time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		servers:   make(map[uuid.UUID]*SecretServer),
+		hostnames: make(map[string]uuid.UUID),
+		peers:     make(map[uuid.UUID]map[string]*Peer),
+		policies:  make(map[uuid.UUID]*Policy),
+		usage:     make(map[memoryUsageKey]*Usage),
+		keys:      make(map[uuid.UUID][]*PeerKey),
+		payloads:  make(map[uuid.UUID]*memoryPayload),
+		teams:     make(map[uuid.UUID]map[string]*Team),
+		broker:    newBroker(),
+	}
+}
+
+func (s *MemoryStore) AddServer(ctx context.Context, server *SecretServer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.servers[server.Server]; ok {
+		return fmt.Errorf("unable to add server: server %s already exists", server.Server)
+	}
+
+	stored := *server
+	s.servers[server.Server] = &stored
+	s.peers[server.Server] = make(map[string]*Peer)
+	return nil
+}
+
+func (s *MemoryStore) AddHostname(ctx context.Context, hostname string, server uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.servers[server]; !ok {
+		return fmt.Errorf("unable to add hostname: %w", ErrUnknownServer)
+	}
+
+	if _, ok := s.hostnames[hostname]; ok {
+		return fmt.Errorf("unable to add hostname: hostname %s already exists", hostname)
+	}
+
+	s.hostnames[hostname] = server
+	return nil
+}
+
+func (s *MemoryStore) GetServer(ctx context.Context, hostname string) (*SecretServer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id, ok := s.hostnames[hostname]
+	if !ok {
+		return nil, ErrUnknownServer
+	}
+
+	server := *s.servers[id]
+	server.Hostname = hostname
+	return &server, nil
+}
+
+func (s *MemoryStore) GetPeer(ctx context.Context, server uuid.UUID, aliasHash []byte) (*Peer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	peer, ok := s.peers[server][string(aliasHash)]
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+
+	result := *peer
+	return &result, nil
+}
+
+func (s *MemoryStore) GetPeerByID(ctx context.Context, server uuid.UUID, peerID uuid.UUID) (*Peer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	peer := s.findPeer(server, peerID)
+	if peer == nil {
+		return nil, ErrUnknownPeer
+	}
+
+	result := *peer
+	return &result, nil
+}
+
+func (s *MemoryStore) Enrol(ctx context.Context, server uuid.UUID, aliasHash []byte, publicKey []byte) ([]byte, int, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, 0, err
+	}
+
+	code, err := rand.Int(rand.Reader, big.NewInt(999999))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.servers[server]; !ok {
+		return nil, 0, ErrUnknownServer
+	}
+
+	// cancel any previous enrolment requests
+	s.activations = slices.DeleteFunc(s.activations, func(a *memoryActivation) bool {
+		return a.server == server && bytes.Equal(a.aliasHash, aliasHash)
+	})
+
+	activation := &memoryActivation{
+		token:     token,
+		code:      int(code.Int64()) + 1,
+		server:    server,
+		aliasHash: aliasHash,
+		publicKey: publicKey,
+		expiry:    time.Now().Add(24 * time.Hour),
+	}
+
+	s.activations = append(s.activations, activation)
+	return activation.token, activation.code, nil
+}
+
+func (s *MemoryStore) Activate(ctx context.Context, token []byte, code int) (*Peer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	// Purge expired activations.
+	s.activations = slices.DeleteFunc(s.activations, func(a *memoryActivation) bool {
+		return !a.expiry.After(now)
+	})
+
+	i := slices.IndexFunc(s.activations, func(a *memoryActivation) bool {
+		return bytes.Equal(a.token, token) && a.code == code
+	})
+
+	if i < 0 {
+		return nil, ErrUnknownActivation
+	}
+
+	// Like Postgres, which rolls back, the activation is kept if the peer already exists.
+	activation := s.activations[i]
+	if _, ok := s.peers[activation.server][string(activation.aliasHash)]; ok {
+		return nil, ErrExistingPeer
+	}
+
+	s.activations = slices.Delete(s.activations, i, i+1)
+
+	peer := &Peer{
+		Server:    activation.server,
+		Peer:      uuid.New(),
+		AliasHash: activation.aliasHash,
+		PublicKey: activation.publicKey,
+	}
+
+	s.peers[activation.server][string(activation.aliasHash)] = peer
+
+	result := *peer
+	return &result, nil
+}
+
+func (s *MemoryStore) RevokeTokens(ctx context.Context, server uuid.UUID, peer uuid.UUID, before time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := s.findPeer(server, peer)
+	if p == nil {
+		return ErrUnknownPeer
+	}
+
+	p.TokensAfter = before
+	return nil
+}
+
+func (s *MemoryStore) SetNotify(ctx context.Context, server uuid.UUID, peer uuid.UUID, address []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := s.findPeer(server, peer)
+	if p == nil {
+		return ErrUnknownPeer
+	}
+
+	p.Notify = address
+	return nil
+}
+
+func (s *MemoryStore) RotateKey(ctx context.Context, server uuid.UUID, peer uuid.UUID, oldKey []byte, newKey []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := s.findPeer(server, peer)
+	if p == nil {
+		return ErrUnknownPeer
+	}
+
+	if !bytes.Equal(p.PublicKey, oldKey) {
+		return ErrKeyChanged
+	}
+
+	p.PublicKey = newKey
+	s.keys[peer] = append(s.keys[peer], &PeerKey{PublicKey: oldKey, Retired: time.Now()})
+	return nil
+}
+
+func (s *MemoryStore) GetPreviousKeys(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]*PeerKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var keys []*PeerKey
+	for _, key := range s.keys[peer] {
+		result := *key
+		keys = append(keys, &result)
+	}
+
+	return keys, nil
+}
+
+func (s *MemoryStore) AddMessages(ctx context.Context, msgs ...*Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, msg := range msgs {
+		stored := *msg
+		s.messages = append(s.messages, &stored)
+		s.broker.publish(msg.Peer, msg.Message)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetInbox(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	var messages []*Message
+	for _, msg := range s.messages {
+		if msg.Server == server && msg.Peer == peer && msg.Expiry.After(now) {
+			result := *msg
+			result.Payload = nil
+			messages = append(messages, &result)
+		}
+	}
+
+	slices.SortStableFunc(messages, func(a, b *Message) int {
+		return a.Received.Compare(b.Received)
+	})
+
+	return messages, nil
+}
+
+func (s *MemoryStore) FindMessages(ctx context.Context, server uuid.UUID, peer uuid.UUID, lower, upper uuid.UUID) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	var messages []*Message
+	for _, msg := range s.messages {
+		if msg.Server != server || msg.Peer != peer || !msg.Expiry.After(now) {
+			continue
+		}
+
+		if bytes.Compare(msg.Message[:], lower[:]) >= 0 && bytes.Compare(msg.Message[:], upper[:]) <= 0 {
+			result := *msg
+			messages = append(messages, &result)
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *MemoryStore) Watch(ctx context.Context, server uuid.UUID, peer uuid.UUID) (<-chan uuid.UUID, error) {
+	return s.broker.subscribe(ctx, peer), nil
+}
+
+func (s *MemoryStore) DeleteMessage(ctx context.Context, server uuid.UUID, message uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := slices.IndexFunc(s.messages, func(msg *Message) bool {
+		return msg.Server == server && msg.Message == message
+	})
+
+	if i < 0 {
+		return ErrUnknownMessageID
+	}
+
+	s.deleteMessage(i)
+	return nil
+}
+
+// deleteMessage deletes the i'th message, along with its payload if no other messages refer to it.
+// The lock must be held.
+func (s *MemoryStore) deleteMessage(i int) {
+	msg := s.messages[i]
+	s.messages = slices.Delete(s.messages, i, i+1)
+
+	if !msg.Streamed {
+		return
+	}
+
+	shared := slices.ContainsFunc(s.messages, func(other *Message) bool {
+		return other.Streamed && other.Server == msg.Server && other.PayloadID == msg.PayloadID
+	})
+
+	if !shared {
+		delete(s.payloads, msg.PayloadID)
+	}
+}
+
+func (s *MemoryStore) AddPayload(ctx context.Context, server uuid.UUID, payload uuid.UUID, expiry time.Time, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read payload: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.payloads[payload] = &memoryPayload{server: server, expiry: expiry, data: data}
+	return int64(len(data)), nil
+}
+
+func (s *MemoryStore) GetPayload(ctx context.Context, server uuid.UUID, message uuid.UUID, burn bool, w io.Writer) error {
+	msg, payload, err := s.takePayload(server, message, burn)
+	if err != nil {
+		return err
+	}
+
+	// The payload is written without holding the lock, so a slow reader can't stall the server.
+	if _, err = w.Write(payload.data); err != nil {
+		if burn {
+			s.restoreMessage(msg, payload)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// takePayload finds a message's payload. If burn is true, the message is deleted straight away,
+// so a burn-after-read message can only be read once, even though it's written after the lock
+// is released.
+func (s *MemoryStore) takePayload(server uuid.UUID, message uuid.UUID, burn bool) (*Message, *memoryPayload, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	i := slices.IndexFunc(s.messages, func(msg *Message) bool {
+		return msg.Server == server && msg.Message == message && msg.Expiry.After(now)
+	})
+
+	if i < 0 {
+		return nil, nil, ErrUnknownMessageID
+	}
+
+	msg := s.messages[i]
+	payload, ok := s.payloads[msg.PayloadID]
+	if !ok || payload.server != server {
+		return nil, nil, ErrUnknownMessageID
+	}
+
+	payload = &memoryPayload{server: payload.server, expiry: payload.expiry, data: slices.Clone(payload.data)}
+
+	if burn {
+		s.deleteMessage(i)
+	}
+
+	return msg, payload, nil
+}
+
+// restoreMessage puts back a burn-after-read message whose payload couldn't be written, so it
+// isn't lost.
+func (s *MemoryStore) restoreMessage(msg *Message, payload *memoryPayload) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.messages = append(s.messages, msg)
+	if _, ok := s.payloads[msg.PayloadID]; !ok {
+		s.payloads[msg.PayloadID] = payload
+	}
+}
+
+func (s *MemoryStore) PurgeExpired(ctx context.Context) (int64, int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	messages := len(s.messages)
+	s.messages = slices.DeleteFunc(s.messages, func(msg *Message) bool {
+		return !msg.Expiry.After(now)
+	})
+
+	for id, payload := range s.payloads {
+		if !payload.expiry.After(now) {
+			delete(s.payloads, id)
+		}
+	}
+
+	activations := len(s.activations)
+	s.activations = slices.DeleteFunc(s.activations, func(a *memoryActivation) bool {
+		return !a.expiry.After(now)
+	})
+
+	s.invites = slices.DeleteFunc(s.invites, func(invite *memoryInvite) bool {
+		return !invite.expiry.After(now)
+	})
+
+	return int64(messages - len(s.messages)), int64(activations - len(s.activations)), nil
+}
+
+// AddInvite records an invite. Invites are kept in the order they were first sent.
+func (s *MemoryStore) AddInvite(ctx context.Context, server uuid.UUID, inviter uuid.UUID, inviteeHash []byte, expiry time.Time, limit int) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for _, invite := range s.invites {
+		if invite.server == server && invite.inviter == inviter && bytes.Equal(invite.inviteeHash, inviteeHash) && invite.expiry.After(now) {
+			invite.expiry = expiry
+			return false, nil
+		}
+	}
+
+	if limit > 0 && s.invitesUsed(server, inviter) >= limit {
+		return false, ErrQuotaExceeded
+	}
+
+	// An expired invite that hasn't been purged is replaced.
+	s.invites = slices.DeleteFunc(s.invites, func(invite *memoryInvite) bool {
+		return invite.server == server && invite.inviter == inviter && bytes.Equal(invite.inviteeHash, inviteeHash)
+	})
+
+	s.invites = append(s.invites, &memoryInvite{
+		server:      server,
+		inviter:     inviter,
+		inviteeHash: inviteeHash,
+		expiry:      expiry,
+	})
+
+	return true, nil
+}
+
+func (s *MemoryStore) AcceptInvites(ctx context.Context, server uuid.UUID, inviteeHash []byte, day time.Time) ([]uuid.UUID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var inviters []uuid.UUID
+
+	s.invites = slices.DeleteFunc(s.invites, func(invite *memoryInvite) bool {
+		if invite.server != server || !bytes.Equal(invite.inviteeHash, inviteeHash) {
+			return false
+		}
+
+		if invite.expiry.After(now) {
+			inviters = append(inviters, invite.inviter)
+		}
+		return true
+	})
+
+	if len(inviters) > 0 {
+		key := memoryUsageKey{server: server, peer: inviters[0], day: day}
+		current, ok := s.usage[key]
+		if !ok {
+			current = &Usage{}
+			s.usage[key] = current
+		}
+		current.Invites++
+	}
+
+	return inviters, nil
+}
+
+func (s *MemoryStore) AddTeam(ctx context.Context, team *Team, owner *TeamMember) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.teams[team.Server][team.Name]; ok {
+		return ErrTeamExists
+	}
+
+	if s.teams[team.Server] == nil {
+		s.teams[team.Server] = make(map[string]*Team)
+	}
+
+	s.teams[team.Server][team.Name] = &Team{
+		Server:  team.Server,
+		Name:    team.Name,
+		Owner:   team.Owner,
+		Members: []*TeamMember{{Peer: team.Owner, Alias: owner.Alias, TeamKey: owner.TeamKey, Joined: true}},
+	}
+
+	return nil
+}
+
+// GetTeam returns a copy of the team, with the alias hash and current public key of each member.
+func (s *MemoryStore) GetTeam(ctx context.Context, server uuid.UUID, name string) (*Team, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	team, ok := s.teams[server][name]
+	if !ok {
+		return nil, ErrUnknownTeam
+	}
+
+	stored := *team
+	stored.Members = nil
+	for _, member := range team.Members {
+		if p := s.findPeer(server, member.Peer); p != nil {
+			stored.Members = append(stored.Members, &TeamMember{
+				Peer:      member.Peer,
+				Alias:     member.Alias,
+				TeamKey:   member.TeamKey,
+				AliasHash: p.AliasHash,
+				PublicKey: p.PublicKey,
+				Joined:    member.Joined,
+			})
+		}
+	}
+
+	return &stored, nil
+}
+
+func (s *MemoryStore) GetTeams(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]string, []string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var names, invitations []string
+	for name, team := range s.teams[server] {
+		switch {
+		case team.Owner == peer || team.IsMember(peer):
+			names = append(names, name)
+		case slices.ContainsFunc(team.Members, func(m *TeamMember) bool { return m.Peer == peer }):
+			invitations = append(invitations, name)
+		}
+	}
+
+	slices.Sort(names)
+	slices.Sort(invitations)
+	return names, invitations, nil
+}
+
+func (s *MemoryStore) AddTeamMember(ctx context.Context, server uuid.UUID, name string, member *TeamMember) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	team, ok := s.teams[server][name]
+	if !ok {
+		return ErrUnknownTeam
+	}
+
+	i := slices.IndexFunc(team.Members, func(m *TeamMember) bool { return m.Peer == member.Peer })
+	if i < 0 {
+		team.Members = append(team.Members, &TeamMember{Peer: member.Peer, Alias: member.Alias, TeamKey: member.TeamKey})
+		return nil
+	}
+
+	team.Members[i].Alias = member.Alias
+	team.Members[i].TeamKey = member.TeamKey
+	return nil
+}
+
+func (s *MemoryStore) SetTeamKeys(ctx context.Context, server uuid.UUID, peer uuid.UUID, keys map[string][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, key := range keys {
+		team, ok := s.teams[server][name]
+		if !ok {
+			continue
+		}
+
+		if i := slices.IndexFunc(team.Members, func(m *TeamMember) bool { return m.Peer == peer }); i >= 0 {
+			team.Members[i].TeamKey = key
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) JoinTeam(ctx context.Context, server uuid.UUID, name string, peer uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	team, ok := s.teams[server][name]
+	if !ok {
+		return ErrUnknownPeer
+	}
+
+	i := slices.IndexFunc(team.Members, func(m *TeamMember) bool { return m.Peer == peer })
+	if i < 0 {
+		return ErrUnknownPeer
+	}
+
+	team.Members[i].Joined = true
+	return nil
+}
+
+func (s *MemoryStore) RemoveTeamMember(ctx context.Context, server uuid.UUID, name string, peer uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	team, ok := s.teams[server][name]
+	if !ok {
+		return ErrUnknownPeer
+	}
+
+	i := slices.IndexFunc(team.Members, func(m *TeamMember) bool { return m.Peer == peer })
+	if i < 0 {
+		return ErrUnknownPeer
+	}
+
+	team.Members = slices.Delete(team.Members, i, i+1)
+	return nil
+}
+
+func (s *MemoryStore) DeleteTeam(ctx context.Context, server uuid.UUID, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.teams[server][name]; !ok {
+		return ErrUnknownTeam
+	}
+
+	delete(s.teams[server], name)
+	return nil
+}
+
+func (s *MemoryStore) GetPolicy(ctx context.Context, server uuid.UUID, peer uuid.UUID) (*Policy, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.findPeer(server, peer) == nil {
+		return nil, ErrUnknownPeer
+	}
+
+	policy, ok := s.policies[peer]
+	if !ok {
+		policy, ok = s.policies[server]
+	}
+
+	if !ok {
+		return nil, nil
+	}
+
+	result := *policy
+	return &result, nil
+}
+
+func (s *MemoryStore) SetServerPolicy(ctx context.Context, server uuid.UUID, policy *Policy) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.servers[server]; !ok {
+		return ErrUnknownServer
+	}
+
+	s.setPolicy(server, policy)
+	return nil
+}
+
+func (s *MemoryStore) SetPeerPolicy(ctx context.Context, server uuid.UUID, peer uuid.UUID, policy *Policy) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.findPeer(server, peer) == nil {
+		return ErrUnknownPeer
+	}
+
+	s.setPolicy(peer, policy)
+	return nil
+}
+
+func (s *MemoryStore) setPolicy(id uuid.UUID, policy *Policy) {
+	if policy == nil {
+		delete(s.policies, id)
+		return
+	}
+
+	stored := *policy
+	s.policies[id] = &stored
+}
+
+// findPeer returns the peer with the given ID. The caller must hold the lock.
+func (s *MemoryStore) findPeer(server uuid.UUID, peer uuid.UUID) *Peer {
+	for _, p := range s.peers[server] {
+		if p.Peer == peer {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetUsage(ctx context.Context, server uuid.UUID, peer uuid.UUID, day time.Time) (*Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.getUsage(server, peer, day), nil
+}
+
+// getUsage totals the peer's usage. The caller must hold the lock.
+func (s *MemoryStore) getUsage(server uuid.UUID, peer uuid.UUID, day time.Time) *Usage {
+	var usage Usage
+	for key, u := range s.usage {
+		if key.server != server || key.peer != peer {
+			continue
+		}
+
+		if key.day.Equal(day) {
+			usage.Messages += u.Messages
+		}
+
+		usage.Invites += u.Invites
+	}
+
+	now := time.Now()
+	for _, invite := range s.invites {
+		if invite.server == server && invite.inviter == peer && invite.expiry.After(now) {
+			usage.PendingInvites++
+		}
+	}
+
+	return &usage
+}
+
+// invitesUsed returns the number of the peer's invites that have been accepted or are pending. The
+// caller must hold the lock.
+func (s *MemoryStore) invitesUsed(server uuid.UUID, peer uuid.UUID) int {
+	usage := s.getUsage(server, peer, time.Time{})
+	return usage.Invites + usage.PendingInvites
+}
+
+func (s *MemoryStore) UseMessages(ctx context.Context, server uuid.UUID, peer uuid.UUID, day time.Time, count int, limit int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := memoryUsageKey{server: server, peer: peer, day: day}
+	current, ok := s.usage[key]
+	if !ok {
+		current = &Usage{}
+	}
+
+	if limit > 0 && current.Messages+count > limit {
+		return ErrQuotaExceeded
+	}
+
+	current.Messages += count
+	s.usage[key] = current
+	return nil
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore is a Store backed by the secrt schema, which is managed by pgpkg.
+type PostgresStore struct {
+	pool   *pgxpool.Pool
+	broker *broker
+}
+
+// NewPostgresStore returns a store that uses the given pool. It also starts listening for
+// notifications about new messages, which are used by Watch.
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	s := &PostgresStore{pool: pool, broker: newBroker()}
+	go s.listen(context.Background())
+	return s
+}
+
+// listen publishes the notifications sent by the secrt.message_notify trigger, reconnecting
+// if the connection fails.
+func (s *PostgresStore) listen(ctx context.Context) {
+	for {
+		err := s.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("message notifications interrupted, reconnecting: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *PostgresStore) listenOnce(ctx context.Context) error {
+	pooled, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The connection is taken out of the pool, since it stays subscribed.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "listen secrt_message"); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		peerID, messageID, _ := strings.Cut(notification.Payload, " ")
+		peer, err := uuid.Parse(peerID)
+		if err != nil {
+			log.Printf("invalid message notification %q: %v", notification.Payload, err)
+			continue
+		}
+
+		message, err := uuid.Parse(messageID)
+		if err != nil {
+			log.Printf("invalid message notification %q: %v", notification.Payload, err)
+			continue
+		}
+
+		s.broker.publish(peer, message)
+	}
+}
+
+func (s *PostgresStore) AddServer(ctx context.Context, server *SecretServer) error {
+	_, err := s.pool.Exec(ctx, "insert into secrt.server (server, secret_box_key, private_box_key, public_box_key, private_sign_key, public_sign_key) values ($1, $2, $3, $4, $5, $6)",
+		server.Server, server.SecretBoxKey, server.PrivateBoxKey, server.PublicBoxKey, server.PrivateSignKey, server.PublicSignKey)
+	if err != nil {
+		return fmt.Errorf("unable to add server: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) AddHostname(ctx context.Context, hostname string, server uuid.UUID) error {
+	_, err := s.pool.Exec(ctx, "insert into secrt.hostname (hostname, server) values ($1, $2)", hostname, server)
+	if err != nil {
+		return fmt.Errorf("unable to add hostname: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetServer(ctx context.Context, hostname string) (*SecretServer, error) {
+	row := s.pool.QueryRow(ctx, "select server, secret_box_key, private_box_key, public_box_key, private_sign_key, public_sign_key from secrt.hostname join secrt.server using (server) where hostname=$1", hostname)
+
+	server := SecretServer{
+		Hostname: hostname,
+	}
+
+	err := row.Scan(&server.Server, &server.SecretBoxKey, &server.PrivateBoxKey, &server.PublicBoxKey, &server.PrivateSignKey, &server.PublicSignKey)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownServer
+		}
+		return nil, err
+	}
+
+	return &server, nil
+}
+
+func (s *PostgresStore) GetPeer(ctx context.Context, server uuid.UUID, aliasHash []byte) (*Peer, error) {
+	peer := Peer{
+		Server:    server,
+		AliasHash: aliasHash,
+	}
+
+	row := s.pool.QueryRow(ctx, "select peer, public_box_key, tokens_after, notify from secrt.peer where server=$1 and alias_hash=$2", server, aliasHash)
+	if err := row.Scan(&peer.Peer, &peer.PublicKey, &peer.TokensAfter, &peer.Notify); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownPeer
+		}
+		return nil, err
+	}
+
+	return &peer, nil
+}
+
+func (s *PostgresStore) GetPeerByID(ctx context.Context, server uuid.UUID, peerID uuid.UUID) (*Peer, error) {
+	peer := Peer{
+		Server: server,
+		Peer:   peerID,
+	}
+
+	row := s.pool.QueryRow(ctx, "select alias_hash, public_box_key, tokens_after, notify from secrt.peer where server=$1 and peer=$2", server, peerID)
+	if err := row.Scan(&peer.AliasHash, &peer.PublicKey, &peer.TokensAfter, &peer.Notify); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownPeer
+		}
+		return nil, err
+	}
+
+	return &peer, nil
+}
+
+func (s *PostgresStore) Enrol(ctx context.Context, server uuid.UUID, aliasHash []byte, publicKey []byte) ([]byte, int, error) {
+	var token []byte
+	var code int
+
+	row := s.pool.QueryRow(ctx, "select _token, _code from secrt.enrol($1, $2, $3)", server, aliasHash, publicKey)
+	if err := row.Scan(&token, &code); err != nil {
+		return nil, 0, err
+	}
+
+	return token, code, nil
+}
+
+func (s *PostgresStore) Activate(ctx context.Context, token []byte, code int) (*Peer, error) {
+	var peer Peer
+
+	row := s.pool.QueryRow(ctx, `select peer.server, peer.peer, peer.alias_hash, peer.public_box_key, peer.tokens_after
+		from secrt.activate($1, $2) activation(_peer) join secrt.peer on peer.peer = activation._peer`, token, code)
+	if err := row.Scan(&peer.Server, &peer.Peer, &peer.AliasHash, &peer.PublicKey, &peer.TokensAfter); err != nil {
+		return nil, err
+	}
+
+	return &peer, nil
+}
+
+func (s *PostgresStore) RevokeTokens(ctx context.Context, server uuid.UUID, peer uuid.UUID, before time.Time) error {
+	tag, err := s.pool.Exec(ctx, "update secrt.peer set tokens_after=$3 where server=$1 and peer=$2", server, peer, before)
+	if err != nil {
+		return fmt.Errorf("unable to revoke tokens: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownPeer
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) SetNotify(ctx context.Context, server uuid.UUID, peer uuid.UUID, address []byte) error {
+	tag, err := s.pool.Exec(ctx, "update secrt.peer set notify=$3 where server=$1 and peer=$2", server, peer, address)
+	if err != nil {
+		return fmt.Errorf("unable to set notification address: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownPeer
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) RotateKey(ctx context.Context, server uuid.UUID, peer uuid.UUID, oldKey []byte, newKey []byte) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "update secrt.peer set public_box_key=$4 where server=$1 and peer=$2 and public_box_key=$3",
+			server, peer, oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("unable to update public key: %w", err)
+		}
+
+		if tag.RowsAffected() == 0 {
+			return ErrKeyChanged
+		}
+
+		if _, err = tx.Exec(ctx, "insert into secrt.peer_key (server, peer, public_box_key) values ($1, $2, $3)", server, peer, oldKey); err != nil {
+			return fmt.Errorf("unable to record previous key: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *PostgresStore) GetPreviousKeys(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]*PeerKey, error) {
+	rows, err := s.pool.Query(ctx, "select public_box_key, retired from secrt.peer_key where server=$1 and peer=$2 order by retired", server, peer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query previous keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*PeerKey
+	for rows.Next() {
+		var key PeerKey
+		if err = rows.Scan(&key.PublicKey, &key.Retired); err != nil {
+			return nil, fmt.Errorf("unable to scan previous key: %w", err)
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) AddMessages(ctx context.Context, msgs ...*Message) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		for _, msg := range msgs {
+			var payloadID *uuid.UUID
+			if msg.Streamed {
+				payloadID = &msg.PayloadID
+			}
+
+			_, err := tx.Exec(ctx, `insert into secrt.message (server, peer, message, received, expiry, burn, metadata, payload, claims, streamed, payload_id, payload_key)
+					values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+				msg.Server, msg.Peer, msg.Message, msg.Received, msg.Expiry, msg.Burn, msg.Metadata, msg.Payload, msg.Claims, msg.Streamed, payloadID, msg.PayloadKey)
+			if err != nil {
+				return fmt.Errorf("unable to insert message: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *PostgresStore) GetInbox(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]*Message, error) {
+	rows, err := s.pool.Query(ctx,
+		`select message, received, expiry, burn, metadata, claims, streamed, coalesce(payload_id, message), payload_key from secrt.message
+				where message.server=$1 and message.peer=$2 and expiry > current_timestamp and claimed is null order by received`, server, peer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query inbox: %w", err)
+	}
+
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg := &Message{
+			Server: server,
+			Peer:   peer,
+		}
+
+		if err := rows.Scan(&msg.Message, &msg.Received, &msg.Expiry, &msg.Burn, &msg.Metadata, &msg.Claims, &msg.Streamed, &msg.PayloadID, &msg.PayloadKey); err != nil {
+			return nil, fmt.Errorf("unable to read inbox: %w", err)
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *PostgresStore) FindMessages(ctx context.Context, server uuid.UUID, peer uuid.UUID, lower, upper uuid.UUID) ([]*Message, error) {
+	rows, err := s.pool.Query(ctx,
+		`select message, received, expiry, burn, metadata, payload, claims, streamed, coalesce(payload_id, message), payload_key from secrt.message
+				where message.server=$1 and message.peer=$2 and message between $3 and $4 and expiry > current_timestamp and claimed is null`, server, peer, lower, upper)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch messages: %w", err)
+	}
+
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg := &Message{
+			Server: server,
+			Peer:   peer,
+		}
+
+		if err := rows.Scan(&msg.Message, &msg.Received, &msg.Expiry, &msg.Burn, &msg.Metadata, &msg.Payload, &msg.Claims, &msg.Streamed, &msg.PayloadID, &msg.PayloadKey); err != nil {
+			return nil, fmt.Errorf("unable to read message: %w", err)
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *PostgresStore) Watch(ctx context.Context, server uuid.UUID, peer uuid.UUID) (<-chan uuid.UUID, error) {
+	return s.broker.subscribe(ctx, peer), nil
+}
+
+func (s *PostgresStore) DeleteMessage(ctx context.Context, server uuid.UUID, message uuid.UUID) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return deleteMessage(ctx, tx, server, message)
+	})
+}
+
+// deleteMessage deletes a message and its payload as part of a transaction.
+func deleteMessage(ctx context.Context, tx pgx.Tx, server uuid.UUID, message uuid.UUID) error {
+	var payloadID uuid.UUID
+	row := tx.QueryRow(ctx, "delete from secrt.message where server=$1 and message=$2 returning coalesce(payload_id, message)", server, message)
+	if err := row.Scan(&payloadID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUnknownMessageID
+		}
+		return fmt.Errorf("unable to delete message: %w", err)
+	}
+
+	// Concurrent deletes might both see the other's message, in which case the payload is purged when it expires.
+	_, err := tx.Exec(ctx, `delete from secrt.payload where server=$1 and payload_id=$2
+			and not exists (select 1 from secrt.message where server=$1 and payload_id=$2)`, server, payloadID)
+	if err != nil {
+		return fmt.Errorf("unable to delete payload: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) AddPayload(ctx context.Context, server uuid.UUID, payload uuid.UUID, expiry time.Time, r io.Reader) (int64, error) {
+	var size int64
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		chunk := make([]byte, payloadChunkSize)
+		for seq := 0; ; seq++ {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				if _, err := tx.Exec(ctx, "insert into secrt.payload (server, payload_id, seq, expiry, data) values ($1, $2, $3, $4, $5)",
+					server, payload, seq, expiry, chunk[:n]); err != nil {
+					return fmt.Errorf("unable to insert payload: %w", err)
+				}
+				size += int64(n)
+			}
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+
+			if err != nil {
+				return fmt.Errorf("unable to read payload: %w", err)
+			}
+		}
+	})
+
+	return size, err
+}
+
+func (s *PostgresStore) GetPayload(ctx context.Context, server uuid.UUID, message uuid.UUID, burn bool, w io.Writer) error {
+	// Burn-after-read messages are claimed before the payload is written, so only one caller can read
+	// them, without holding a transaction open while the payload is written to a slow reader.
+	query := "select coalesce(payload_id, message) from secrt.message where server=$1 and message=$2 and expiry > current_timestamp and claimed is null"
+	if burn {
+		query = `update secrt.message set claimed=current_timestamp
+				where server=$1 and message=$2 and expiry > current_timestamp and claimed is null
+				returning coalesce(payload_id, message)`
+	}
+
+	var payloadID uuid.UUID
+	if err := s.pool.QueryRow(ctx, query, server, message).Scan(&payloadID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUnknownMessageID
+		}
+		return fmt.Errorf("unable to find message: %w", err)
+	}
+
+	if err := s.writePayload(ctx, server, payloadID, w); err != nil {
+		if burn {
+			// Release the claim, so the message isn't lost. The request may have been cancelled.
+			_, release := s.pool.Exec(context.WithoutCancel(ctx), "update secrt.message set claimed=null where server=$1 and message=$2", server, message)
+			if release != nil {
+				log.Printf("unable to release message %s: %v", message, release)
+			}
+		}
+		return err
+	}
+
+	if !burn {
+		return nil
+	}
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return deleteMessage(ctx, tx, server, message)
+	})
+
+	// The message might have been deleted while it was being read, which is fine.
+	if errors.Is(err, ErrUnknownMessageID) {
+		return nil
+	}
+
+	return err
+}
+
+// writePayload writes a payload to w, fetching one chunk at a time, so that no query is left open
+// while w is written.
+func (s *PostgresStore) writePayload(ctx context.Context, server uuid.UUID, payloadID uuid.UUID, w io.Writer) error {
+	for seq := 0; ; seq++ {
+		var data []byte
+		row := s.pool.QueryRow(ctx, "select data from secrt.payload where server=$1 and payload_id=$2 and seq=$3", server, payloadID, seq)
+		if err := row.Scan(&data); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("unable to read payload: %w", err)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *PostgresStore) PurgeExpired(ctx context.Context) (int64, int64, error) {
+	messages, err := s.pool.Exec(ctx, "delete from secrt.message where expiry <= current_timestamp")
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to purge messages: %w", err)
+	}
+
+	if _, err = s.pool.Exec(ctx, "delete from secrt.payload where expiry <= current_timestamp"); err != nil {
+		return messages.RowsAffected(), 0, fmt.Errorf("unable to purge payloads: %w", err)
+	}
+
+	activations, err := s.pool.Exec(ctx, "delete from secrt.activation where expiry <= current_timestamp")
+	if err != nil {
+		return messages.RowsAffected(), 0, fmt.Errorf("unable to purge activations: %w", err)
+	}
+
+	if _, err = s.pool.Exec(ctx, "delete from secrt.invite where expiry <= current_timestamp"); err != nil {
+		return messages.RowsAffected(), activations.RowsAffected(), fmt.Errorf("unable to purge invites: %w", err)
+	}
+
+	return messages.RowsAffected(), activations.RowsAffected(), nil
+}
+
+func (s *PostgresStore) AddInvite(ctx context.Context, server uuid.UUID, inviter uuid.UUID, inviteeHash []byte, expiry time.Time, limit int) (bool, error) {
+	var pending bool
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		// Lock the inviter, so that concurrent invites are counted one at a time.
+		if _, err := tx.Exec(ctx, "select 1 from secrt.peer where server=$1 and peer=$2 for update", server, inviter); err != nil {
+			return fmt.Errorf("unable to lock inviter: %w", err)
+		}
+
+		var used int
+		row := tx.QueryRow(ctx, `select
+				(select coalesce(sum(invites), 0) from secrt.usage where server=$1 and peer=$2) +
+				(select count(*) from secrt.invite where server=$1 and inviter=$2 and expiry > current_timestamp),
+				exists (select 1 from secrt.invite where server=$1 and inviter=$2 and invitee_hash=$3 and expiry > current_timestamp)`,
+			server, inviter, inviteeHash)
+		if err := row.Scan(&used, &pending); err != nil {
+			return fmt.Errorf("unable to count invites: %w", err)
+		}
+
+		if !pending && limit > 0 && used >= limit {
+			return ErrQuotaExceeded
+		}
+
+		_, err := tx.Exec(ctx, `insert into secrt.invite (server, inviter, invitee_hash, expiry) values ($1, $2, $3, $4)
+			on conflict (server, inviter, invitee_hash) do update set expiry = excluded.expiry`,
+			server, inviter, inviteeHash, expiry)
+		if err != nil {
+			return fmt.Errorf("unable to add invite: %w", err)
+		}
+
+		return nil
+	})
+
+	return !pending && err == nil, err
+}
+
+func (s *PostgresStore) AcceptInvites(ctx context.Context, server uuid.UUID, inviteeHash []byte, day time.Time) ([]uuid.UUID, error) {
+	var inviters []uuid.UUID
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `with accepted as (
+				delete from secrt.invite where server=$1 and invitee_hash=$2 returning inviter, created, expiry
+			)
+			select inviter from accepted where expiry > current_timestamp order by created`, server, inviteeHash)
+		if err != nil {
+			return fmt.Errorf("unable to accept invites: %w", err)
+		}
+
+		for rows.Next() {
+			var inviter uuid.UUID
+			if err = rows.Scan(&inviter); err != nil {
+				rows.Close()
+				return fmt.Errorf("unable to scan invite: %w", err)
+			}
+			inviters = append(inviters, inviter)
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil || len(inviters) == 0 {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `insert into secrt.usage (server, peer, day, invites) values ($1, $2, $3, 1)
+			on conflict (server, peer, day) do update set invites = usage.invites + 1`, server, inviters[0], day)
+		if err != nil {
+			return fmt.Errorf("unable to update usage: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return inviters, nil
+}
+
+func (s *PostgresStore) AddTeam(ctx context.Context, team *Team, owner *TeamMember) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `insert into secrt.team (server, team, owner) values ($1, $2, $3)
+			on conflict (server, team) do nothing`, team.Server, team.Name, team.Owner)
+		if err != nil {
+			return fmt.Errorf("unable to add team: %w", err)
+		}
+
+		if tag.RowsAffected() == 0 {
+			return ErrTeamExists
+		}
+
+		if _, err = tx.Exec(ctx, "insert into secrt.team_member (server, team, peer, alias, team_key, joined) values ($1, $2, $3, $4, $5, true)",
+			team.Server, team.Name, team.Owner, owner.Alias, owner.TeamKey); err != nil {
+			return fmt.Errorf("unable to add team owner: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *PostgresStore) GetTeam(ctx context.Context, server uuid.UUID, name string) (*Team, error) {
+	team := &Team{Server: server, Name: name}
+
+	row := s.pool.QueryRow(ctx, "select owner from secrt.team where server=$1 and team=$2", server, name)
+	if err := row.Scan(&team.Owner); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownTeam
+		}
+		return nil, fmt.Errorf("unable to get team: %w", err)
+	}
+
+	rows, err := s.pool.Query(ctx, `select member.peer, member.alias, member.team_key, peer.alias_hash, peer.public_box_key, member.joined
+		from secrt.team_member member join secrt.peer peer using (server, peer)
+		where member.server=$1 and member.team=$2 order by member.added`, server, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query team members: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member TeamMember
+		if err = rows.Scan(&member.Peer, &member.Alias, &member.TeamKey, &member.AliasHash, &member.PublicKey, &member.Joined); err != nil {
+			return nil, fmt.Errorf("unable to scan team member: %w", err)
+		}
+		team.Members = append(team.Members, &member)
+	}
+
+	return team, rows.Err()
+}
+
+func (s *PostgresStore) GetTeams(ctx context.Context, server uuid.UUID, peer uuid.UUID) ([]string, []string, error) {
+	rows, err := s.pool.Query(ctx, `select team, bool_or(joined) from (
+		select team, true as joined from secrt.team where server=$1 and owner=$2
+		union all select team, joined from secrt.team_member where server=$1 and peer=$2
+	) teams group by team order by team`, server, peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to query teams: %w", err)
+	}
+	defer rows.Close()
+
+	var names, invitations []string
+	for rows.Next() {
+		var name string
+		var joined bool
+		if err = rows.Scan(&name, &joined); err != nil {
+			return nil, nil, fmt.Errorf("unable to scan team: %w", err)
+		}
+
+		if joined {
+			names = append(names, name)
+		} else {
+			invitations = append(invitations, name)
+		}
+	}
+
+	return names, invitations, rows.Err()
+}
+
+func (s *PostgresStore) AddTeamMember(ctx context.Context, server uuid.UUID, name string, member *TeamMember) error {
+	tag, err := s.pool.Exec(ctx, `insert into secrt.team_member (server, team, peer, alias, team_key)
+		select server, team, $3, $4, $5 from secrt.team where server=$1 and team=$2
+		on conflict (server, team, peer) do update set alias = excluded.alias, team_key = excluded.team_key`,
+		server, name, member.Peer, member.Alias, member.TeamKey)
+	if err != nil {
+		return fmt.Errorf("unable to add team member: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownTeam
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) SetTeamKeys(ctx context.Context, server uuid.UUID, peer uuid.UUID, keys map[string][]byte) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		for name, key := range keys {
+			if _, err := tx.Exec(ctx, "update secrt.team_member set team_key=$4 where server=$1 and team=$2 and peer=$3",
+				server, name, peer, key); err != nil {
+				return fmt.Errorf("unable to set team key: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStore) JoinTeam(ctx context.Context, server uuid.UUID, name string, peer uuid.UUID) error {
+	tag, err := s.pool.Exec(ctx, "update secrt.team_member set joined = true where server=$1 and team=$2 and peer=$3", server, name, peer)
+	if err != nil {
+		return fmt.Errorf("unable to join team: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownPeer
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) RemoveTeamMember(ctx context.Context, server uuid.UUID, name string, peer uuid.UUID) error {
+	tag, err := s.pool.Exec(ctx, "delete from secrt.team_member where server=$1 and team=$2 and peer=$3", server, name, peer)
+	if err != nil {
+		return fmt.Errorf("unable to remove team member: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownPeer
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) DeleteTeam(ctx context.Context, server uuid.UUID, name string) error {
+	tag, err := s.pool.Exec(ctx, "delete from secrt.team where server=$1 and team=$2", server, name)
+	if err != nil {
+		return fmt.Errorf("unable to delete team: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownTeam
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetPolicy(ctx context.Context, server uuid.UUID, peer uuid.UUID) (*Policy, error) {
+	var policy *Policy
+
+	row := s.pool.QueryRow(ctx, `select coalesce(peer.policy, server.policy) from secrt.peer
+		join secrt.server using (server) where peer.server=$1 and peer.peer=$2`, server, peer)
+	if err := row.Scan(&policy); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownPeer
+		}
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (s *PostgresStore) SetServerPolicy(ctx context.Context, server uuid.UUID, policy *Policy) error {
+	tag, err := s.pool.Exec(ctx, "update secrt.server set policy=$2 where server=$1", server, policy)
+	if err != nil {
+		return fmt.Errorf("unable to set server policy: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownServer
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) SetPeerPolicy(ctx context.Context, server uuid.UUID, peer uuid.UUID, policy *Policy) error {
+	tag, err := s.pool.Exec(ctx, "update secrt.peer set policy=$3 where server=$1 and peer=$2", server, peer, policy)
+	if err != nil {
+		return fmt.Errorf("unable to set peer policy: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownPeer
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetUsage(ctx context.Context, server uuid.UUID, peer uuid.UUID, day time.Time) (*Usage, error) {
+	var usage Usage
+
+	row := s.pool.QueryRow(ctx, `select coalesce(sum(messages) filter (where day=$3), 0), coalesce(sum(invites), 0),
+			(select count(*) from secrt.invite where server=$1 and inviter=$2 and expiry > current_timestamp)
+		from secrt.usage where server=$1 and peer=$2`, server, peer, day)
+	if err := row.Scan(&usage.Messages, &usage.Invites, &usage.PendingInvites); err != nil {
+		return nil, fmt.Errorf("unable to read usage: %w", err)
+	}
+
+	return &usage, nil
+}
+
+func (s *PostgresStore) UseMessages(ctx context.Context, server uuid.UUID, peer uuid.UUID, day time.Time, count int, limit int) error {
+	// The row is only inserted or updated if the new total is within the limit.
+	var messages int
+	row := s.pool.QueryRow(ctx, `insert into secrt.usage (server, peer, day, messages)
+			select $1, $2, $3, $4::integer where $5::integer = 0 or $4::integer <= $5::integer
+		on conflict (server, peer, day) do update
+			set messages = usage.messages + excluded.messages
+			where $5::integer = 0 or usage.messages + excluded.messages <= $5::integer
+		returning messages`, server, peer, day, count, limit)
+	if err := row.Scan(&messages); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrQuotaExceeded
+		}
+		return fmt.Errorf("unable to update usage: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+)
+
+// teamName matches the names of teams. A team's alias is its name with secrt.TeamPrefix.
+var teamName = regexp.MustCompile(`^[a-z0-9][-_.a-z0-9]{0,62}$`)
+
+// Team is a team of peers, which is managed by its owner, who is also a member. The server never
+// stores aliases, and can't read the members' aliases: they're encrypted with the team key, which
+// only the members have (see secrt.TeamKey).
+type Team struct {
+	Server  uuid.UUID
+	Name    string
+	Owner   uuid.UUID
+	Members []*TeamMember
+}
+
+// TeamMember is a member of a team, or a peer who has been invited to join it. Invited peers
+// aren't sent the team's messages, and can't see its members, until they've joined.
+type TeamMember struct {
+	Peer      uuid.UUID
+	Alias     []byte // encrypted with the team key
+	TeamKey   []byte // the team key, sealed for the member
+	AliasHash []byte // the member's alias hash, so clients can check the alias
+	PublicKey []byte // the member's current public key
+	Joined    bool   // false until the peer accepts the invitation
+}
+
+// IsMember returns true if the peer has joined the team.
+func (team *Team) IsMember(peer uuid.UUID) bool {
+	return slices.ContainsFunc(team.Members, func(member *TeamMember) bool { return member.Peer == peer && member.Joined })
+}
+
+// String returns the team's alias.
+func (team *Team) String() string {
+	return secrt.TeamPrefix + team.Name
+}
+
+// teamPath returns the name of the team in the request path, which can be given with or without
+// the team prefix.
+func teamPath(r *http.Request) (string, error) {
+	name := strings.TrimPrefix(r.PathValue("team"), secrt.TeamPrefix)
+	if !teamName.MatchString(name) {
+		return "", jtp.BadRequestError(jtp.Errorf("invalid team name %q", name))
+	}
+
+	return name, nil
+}
+
+// getTeam returns the team named in the request path.
+func (server *SecretServer) getTeam(r *http.Request) (*Team, error) {
+	name, err := teamPath(r)
+	if err != nil {
+		return nil, err
+	}
+
+	team, err := Storage.GetTeam(r.Context(), server.Server, name)
+	if errors.Is(err, ErrUnknownTeam) {
+		return nil, jtp.NotFoundError(jtp.Errorf("team %s not found", name)).WithCode(secrt.ErrorUnknownTeam)
+	}
+
+	if err != nil {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to get team %s: %w", name, err))
+	}
+
+	return team, nil
+}
+
+// teamResponse returns the team's owner and members, with their current keys, and the peers who
+// have been invited to join. The team key is the one sealed for the peer.
+func (server *SecretServer) teamResponse(team *Team, peer *Peer) *secrt.Team {
+	response := &secrt.Team{Team: team.String(), Members: []secrt.TeamMember{}}
+	for _, member := range team.Members {
+		tm := secrt.TeamMember{Alias: member.Alias, AliasHash: member.AliasHash, PublicKey: member.PublicKey}
+
+		switch {
+		case member.Peer == team.Owner:
+			response.Owner = tm
+			response.Members = append(response.Members, tm)
+		case member.Joined:
+			response.Members = append(response.Members, tm)
+		default:
+			response.Invited = append(response.Invited, tm)
+		}
+
+		if member.Peer == peer.Peer {
+			response.TeamKey = member.TeamKey
+		}
+	}
+
+	return response
+}
+
+// handleGetTeams lists the teams that the authenticated peer owns or belongs to, and the teams
+// they've been invited to join.
+func (server *SecretServer) handleGetTeams(r *http.Request, _ *jtp.None) (*secrt.TeamList, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	names, invitations, err := Storage.GetTeams(r.Context(), server.Server, peer.Peer)
+	if err != nil {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to get teams for %s: %w", peer, err))
+	}
+
+	response := &secrt.TeamList{Teams: []string{}}
+	for _, name := range names {
+		response.Teams = append(response.Teams, secrt.TeamPrefix+name)
+	}
+
+	for _, name := range invitations {
+		response.Invitations = append(response.Invitations, secrt.TeamPrefix+name)
+	}
+
+	return response, nil
+}
+
+// handleGetTeam returns the members of a team. Only the owner and members can see who's in it, and
+// so only they can send to it. Membership isn't cached by clients, so senders always see the current
+// members.
+func (server *SecretServer) handleGetTeam(r *http.Request, _ *jtp.None) (*secrt.Team, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	team, err := server.getTeam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if team.Owner != peer.Peer && !team.IsMember(peer.Peer) {
+		return nil, jtp.ForbiddenError(jtp.Errorf("only the owner and members of %s can see it", team))
+	}
+
+	return server.teamResponse(team, peer), nil
+}
+
+// handlePostTeamJoin accepts the authenticated peer's invitation to join a team.
+func (server *SecretServer) handlePostTeamJoin(r *http.Request, _ *jtp.None) (*secrt.Team, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	team, err := server.getTeam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Storage.JoinTeam(r.Context(), server.Server, team.Name, peer.Peer); err != nil {
+		if errors.Is(err, ErrUnknownPeer) {
+			return nil, jtp.ForbiddenError(jtp.Errorf("%s hasn't been invited to join %s", peer.Alias, team))
+		}
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to add %s to %s: %w", peer, team, err))
+	}
+
+	log.Printf("%s joined %s", peer, team)
+
+	if team, err = server.getTeam(r); err != nil {
+		return nil, err
+	}
+
+	return server.teamResponse(team, peer), nil
+}
+
+// handlePostTeam invites peers to a team. If the team doesn't exist, it's created, and the
+// authenticated peer becomes its owner. Only the owner can invite peers, and they aren't members
+// until they've joined the team.
+func (server *SecretServer) handlePostTeam(r *http.Request, req *secrt.TeamRequest) (*secrt.Team, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	name, err := teamPath(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check all the members before any are added.
+	members := make([]*TeamMember, len(req.Members))
+	for i, invite := range req.Members {
+		member, ok := server.GetPeer(invite.Peer)
+		if !ok {
+			return nil, jtp.NotFoundError(jtp.Errorf("peer %s not found", invite.Peer)).WithCode(secrt.ErrorUnknownPeer)
+		}
+
+		if len(invite.Alias) == 0 || len(invite.TeamKey) == 0 {
+			return nil, jtp.BadRequestError(jtp.Errorf("the invitation for %s has no alias or team key", invite.Peer))
+		}
+
+		members[i] = &TeamMember{Peer: member.Peer, Alias: invite.Alias, TeamKey: invite.TeamKey}
+	}
+
+	team, err := Storage.GetTeam(r.Context(), server.Server, name)
+	switch {
+	case errors.Is(err, ErrUnknownTeam):
+		if team, err = server.addTeam(r.Context(), peer, name, members); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to get team %s: %w", name, err))
+	}
+
+	if team.Owner != peer.Peer {
+		return nil, jtp.ForbiddenError(jtp.Errorf("only the owner of %s can add members", team))
+	}
+
+	for _, member := range members {
+		if err = Storage.AddTeamMember(r.Context(), server.Server, team.Name, member); err != nil {
+			return nil, jtp.InternalServerError(fmt.Errorf("unable to add %s to %s: %w", member.Peer, team, err))
+		}
+	}
+
+	log.Printf("invited %d peers to %s", len(members), team)
+
+	if team, err = server.getTeam(r); err != nil {
+		return nil, err
+	}
+
+	return server.teamResponse(team, peer), nil
+}
+
+// addTeam creates a team owned by the peer. The owner has to be one of the members, so that they
+// have a copy of the team key.
+func (server *SecretServer) addTeam(ctx context.Context, owner *Peer, name string, members []*TeamMember) (*Team, error) {
+	i := slices.IndexFunc(members, func(member *TeamMember) bool { return member.Peer == owner.Peer })
+	if i < 0 {
+		return nil, jtp.BadRequestError(jtp.Errorf("the owner of a new team has to be one of its members"))
+	}
+
+	team := &Team{Server: server.Server, Name: name, Owner: owner.Peer}
+	if err := Storage.AddTeam(ctx, team, members[i]); err != nil {
+		if errors.Is(err, ErrTeamExists) {
+			return nil, jtp.ConflictError(jtp.Errorf("%s already exists", team))
+		}
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to add %s: %w", team, err))
+	}
+
+	log.Printf("%s created %s", owner, team)
+	return team, nil
+}
+
+// handleDeleteTeam deletes a team. Only the owner can delete it.
+func (server *SecretServer) handleDeleteTeam(r *http.Request, _ *jtp.None) (*jtp.None, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	team, err := server.getTeam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if team.Owner != peer.Peer {
+		return nil, jtp.ForbiddenError(jtp.Errorf("only the owner of %s can delete it", team))
+	}
+
+	if err = Storage.DeleteTeam(r.Context(), server.Server, team.Name); err != nil && !errors.Is(err, ErrUnknownTeam) {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to delete %s: %w", team, err))
+	}
+
+	log.Printf("%s deleted %s", peer, team)
+	return nil, nil
+}
+
+// handleDeleteTeamMember removes a member from a team, or withdraws an invitation. The owner can
+// remove anyone, and members can remove themselves, or decline an invitation.
+func (server *SecretServer) handleDeleteTeamMember(r *http.Request, _ *jtp.None) (*secrt.Team, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	team, err := server.getTeam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	alias := r.PathValue("alias")
+	member, ok := server.GetPeer(alias)
+	if !ok {
+		return nil, jtp.NotFoundError(jtp.Errorf("peer %s not found", alias)).WithCode(secrt.ErrorUnknownPeer)
+	}
+
+	if team.Owner != peer.Peer && !bytes.Equal(member.AliasHash, peer.AliasHash) {
+		return nil, jtp.ForbiddenError(jtp.Errorf("only the owner of %s can remove other members", team))
+	}
+
+	if err = Storage.RemoveTeamMember(r.Context(), server.Server, team.Name, member.Peer); err != nil {
+		if errors.Is(err, ErrUnknownPeer) {
+			return nil, jtp.NotFoundError(jtp.Errorf("%s isn't a member of %s", alias, team)).WithCode(secrt.ErrorUnknownPeer)
+		}
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to remove %s from %s: %w", alias, team, err))
+	}
+
+	log.Printf("removed %s from %s", member, team)
+
+	if team, err = server.getTeam(r); err != nil {
+		return nil, err
+	}
+
+	return server.teamResponse(team, peer), nil
+}
+
+// checkTeam returns an error if a message was sent to the recipient as a member of a team, and
+// they're no longer a member. The client can then fetch the team's current members and try again.
+// teams caches the teams that have already been read.
+func (server *SecretServer) checkTeam(ctx context.Context, teams map[string]*Team, alias string, recipient *Peer) error {
+	if alias == "" {
+		return nil
+	}
+
+	name := strings.TrimPrefix(alias, secrt.TeamPrefix)
+	team, ok := teams[name]
+	if !ok {
+		var err error
+		team, err = Storage.GetTeam(ctx, server.Server, name)
+		if err != nil && !errors.Is(err, ErrUnknownTeam) {
+			return jtp.InternalServerError(fmt.Errorf("unable to get team %s: %w", name, err))
+		}
+		teams[name] = team
+	}
+
+	if team == nil || !team.IsMember(recipient.Peer) {
+		return jtp.ConflictError(jtp.Errorf("%s isn't a member of %s", recipient.Alias, alias)).WithCode(secrt.ErrorTeamMember)
+	}
+
+	return nil
+}
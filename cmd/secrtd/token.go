@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+)
+
+// tokenExpiry returns the expiry time of a token issued now, or zero if tokens don't expire.
+func tokenExpiry() int64 {
+	if Config.MaxTokenAge == 0 {
+		return 0
+	}
+
+	return time.Now().Add(Config.MaxTokenAge).Unix()
+}
+
+// handlePostToken issues a new token to an authenticated peer, so that long-lived clients can
+// rotate their token before it reaches SECRT_MAX_TOKEN_AGE.
+func (server *SecretServer) handlePostToken(r *http.Request, _ *jtp.None) (*secrt.TokenResponse, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	token, err := server.NewAuthenticationToken(peer)
+	if err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	return &secrt.TokenResponse{
+		Token:  token,
+		Expiry: tokenExpiry(),
+	}, nil
+}
+
+// handlePostLogout revokes every token issued to the peer, including the one used to make the request.
+// A new token is returned to the caller, so the device that logged out the others can continue to work.
+func (server *SecretServer) handlePostLogout(r *http.Request, _ *jtp.None) (*secrt.TokenResponse, error) {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	// Tokens only record the second they were issued, so revoke everything up to the end of the
+	// current second. The new token is issued at that time.
+	peer.TokensAfter = time.Now().Truncate(time.Second).Add(time.Second)
+	if err := Storage.RevokeTokens(r.Context(), server.Server, peer.Peer, peer.TokensAfter); err != nil {
+		return nil, jtp.InternalServerError(fmt.Errorf("unable to revoke tokens for %s: %w", peer, err))
+	}
+
+	log.Printf("revoked all tokens for %s", peer)
+
+	token, err := server.NewAuthenticationToken(peer)
+	if err != nil {
+		return nil, jtp.InternalServerError(err)
+	}
+
+	return &secrt.TokenResponse{
+		Token:  token,
+		Expiry: tokenExpiry(),
+	}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/commandquery/secrt"
+	"github.com/commandquery/secrt/jtp"
+	"github.com/google/uuid"
+)
+
+// watchKeepalive is how often an idle watch sends a comment, so proxies don't close the connection.
+const watchKeepalive = 30 * time.Second
+
+// broker delivers the IDs of new messages to the peers that are watching their inbox. The memory
+// store publishes messages as they're added. The Postgres store publishes the notifications sent
+// by the secrt.message trigger, so every server process sees every message.
+type broker struct {
+	lock     sync.Mutex
+	watchers map[uuid.UUID][]chan uuid.UUID // peer -> watchers
+}
+
+func newBroker() *broker {
+	return &broker{watchers: make(map[uuid.UUID][]chan uuid.UUID)}
+}
+
+// subscribe returns a channel that receives the IDs of the peer's new messages. The channel is
+// closed when the context is done.
+func (b *broker) subscribe(ctx context.Context, peer uuid.UUID) <-chan uuid.UUID {
+	ch := make(chan uuid.UUID, 16)
+
+	b.lock.Lock()
+	b.watchers[peer] = append(b.watchers[peer], ch)
+	b.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		b.watchers[peer] = slices.DeleteFunc(b.watchers[peer], func(c chan uuid.UUID) bool { return c == ch })
+		if len(b.watchers[peer]) == 0 {
+			delete(b.watchers, peer)
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// publish tells the peer's watchers about a new message. Watchers that aren't keeping up miss out;
+// they can still find the message in the inbox.
+func (b *broker) publish(peer uuid.UUID, message uuid.UUID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, ch := range b.watchers[peer] {
+		select {
+		case ch <- message:
+		default:
+		}
+	}
+}
+
+// handleGetWatch streams the peer's new messages as Server-Sent Events until SECRT_WATCH_TIMEOUT
+// passes, when a "timeout" event is sent and the client has to reconnect. Messages that are
+// already in the inbox aren't sent, so a client that reconnects lists the inbox once the stream
+// has started, to find messages that arrived while it was disconnected.
+func (server *SecretServer) handleGetWatch(w http.ResponseWriter, r *http.Request) error {
+	peer, aerr := server.Authenticate(r)
+	if aerr != nil {
+		return aerr
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), Config.WatchTimeout)
+	defer cancel()
+
+	// Subscribe before the response starts, so that the client can't miss messages once it
+	// has the response.
+	messages, err := Storage.Watch(ctx, server.Server, peer.Peer)
+	if err != nil {
+		return jtp.InternalServerError(fmt.Errorf("unable to watch inbox for %s: %w", peer, err))
+	}
+
+	stream, err := jtp.NewEventStream(w)
+	if err != nil {
+		return nil
+	}
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case id, ok := <-messages:
+			if !ok {
+				if r.Context().Err() == nil {
+					_ = stream.Send(secrt.WatchTimeout, "", jtp.None{})
+				}
+				return nil
+			}
+
+			// The message might have been read already.
+			found, err := Storage.FindMessages(ctx, server.Server, peer.Peer, id, id)
+			if err != nil {
+				log.Printf("unable to find message %s for %s: %v", id, peer, err)
+				continue
+			}
+
+			for _, msg := range found {
+				if err = stream.Send(secrt.WatchMessage, msg.Message.String(), inboxMessage(msg)); err != nil {
+					return nil
+				}
+			}
+
+		case <-keepalive.C:
+			if err = stream.Comment("keepalive"); err != nil {
+				return nil
+			}
+		}
+	}
+}
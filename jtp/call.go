@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,6 +28,12 @@ var client = &http.Client{
 	},
 }
 
+// streamClient is used for uploads and downloads. It has no overall timeout, since large
+// streams can take a while, but it shares the client's transport.
+var streamClient = &http.Client{
+	Transport: client.Transport,
+}
+
 // Request represents a HTTP call to a server, and contains the types being sent and received.
 type Request[S any, R any] struct {
 	Ctx     context.Context
@@ -77,13 +85,7 @@ func DoRequest[S any, R any](r *Request[S, R]) error {
 
 	req.Header.Set("Accept", "application/json")
 
-	if r.Headers != nil {
-		for k, v := range r.Headers {
-			for _, val := range v {
-				req.Header.Add(k, val)
-			}
-		}
-	}
+	addHeaders(req, r.Headers)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -92,10 +94,93 @@ func DoRequest[S any, R any](r *Request[S, R]) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return &HTTPError{StatusCode: resp.StatusCode}
+		return responseError(resp)
+	}
+
+	return readResponse(resp, r.Recv)
+}
+
+// Upload sends the body as a raw stream, and receives a JSON response. The body is sent with
+// chunked encoding, so its size doesn't need to be known in advance.
+func Upload[R any](method string, uri string, headers http.Header, body io.Reader, r *R) error {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Accept", "application/json")
+	addHeaders(req, headers)
+
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	return readResponse(resp, r)
+}
+
+// Download sends a request, and returns the raw response body, which must be closed by the caller.
+// Errors are decoded in the same way as Call.
+func Download(method string, uri string, headers http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, uri, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	addHeaders(req, headers)
+
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
 	}
 
-	if r.Recv == nil {
+	return resp.Body, nil
+}
+
+func addHeaders(req *http.Request, headers http.Header) {
+	for k, v := range headers {
+		for _, val := range v {
+			req.Header.Add(k, val)
+		}
+	}
+}
+
+// responseError returns a HTTPError for an unsuccessful response.
+func responseError(resp *http.Response) *HTTPError {
+	httpErr := &HTTPError{StatusCode: resp.StatusCode}
+
+	// Errors from a jtp server include an ErrorResponse that explains the problem.
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var response ErrorResponse
+		body, err := io.ReadAll(resp.Body)
+		if err == nil && json.Unmarshal(body, &response) == nil {
+			httpErr.Code = response.Code
+			if response.Message != "" {
+				httpErr.Err = errors.New(response.Message)
+			}
+			if len(response.Detail) > 0 {
+				httpErr.Body = response.Detail
+			}
+		}
+	}
+
+	return httpErr
+}
+
+// readResponse unmarshals the JSON response into recv, unless recv is nil.
+func readResponse[R any](resp *http.Response, recv *R) error {
+	if recv == nil {
 		return nil
 	}
 
@@ -104,7 +189,7 @@ func DoRequest[S any, R any](r *Request[S, R]) error {
 		return fmt.Errorf("unable to read response body: %w", err)
 	}
 
-	if err = json.Unmarshal(body, r.Recv); err != nil {
+	if err = json.Unmarshal(body, recv); err != nil {
 		return fmt.Errorf("unable to unmarshal response: %w", err)
 	}
 
@@ -1,8 +1,11 @@
 package jtp
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 var (
@@ -12,12 +15,58 @@ var (
 	ErrForbidden           = ForbiddenError(nil)
 	ErrUnauthorized        = UnauthorizedError(nil)
 	ErrConflict            = ConflictError(nil)
+	ErrServiceUnavailable  = ServiceUnavailableError(nil)
 	ErrNoContent           = NoContentError()
 )
 
 type HTTPError struct {
 	StatusCode int
 	Err        error
+
+	// Code is a machine-readable error code that's sent to the client. If it's empty, a code
+	// is derived from the status, e.g. "not_found".
+	Code string
+
+	// Body is an optional value that's sent to the client as JSON, as the detail of the ErrorResponse.
+	// On the client side, Body contains the raw JSON detail (json.RawMessage) returned by the server, if any.
+	Body any
+}
+
+// PublicError is an error whose message can be sent to the client. The text of other errors is
+// only logged, because it can include internal details, such as the database errors they wrap.
+type PublicError struct {
+	Message string // sent to the client
+	Err     error  // optional; only logged
+}
+
+// Errorf returns a PublicError with the formatted message. Errors can't be wrapped with %w: use
+// Wrapf to include an error that's only logged.
+func Errorf(format string, args ...any) error {
+	return &PublicError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrapf returns a PublicError with the formatted message, which wraps err. The client only sees
+// the message.
+func Wrapf(err error, format string, args ...any) error {
+	return &PublicError{Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+func (e *PublicError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *PublicError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorResponse is the JSON body of an error response.
+type ErrorResponse struct {
+	Code    string          `json:"code"`             // machine-readable error code
+	Message string          `json:"message"`          // human-readable explanation
+	Detail  json.RawMessage `json:"detail,omitempty"` // optional, error-specific detail
 }
 
 func (e *HTTPError) Error() string {
@@ -34,6 +83,45 @@ func (e *HTTPError) Unwrap() error {
 	return e.Err
 }
 
+// WithCode sets the machine-readable code of the error, and returns the error.
+func (e *HTTPError) WithCode(code string) *HTTPError {
+	e.Code = code
+	return e
+}
+
+// ErrorCode returns the machine-readable code for the error. If no code was set, the code
+// is derived from the status text.
+func (e *HTTPError) ErrorCode() string {
+	if e.Code != "" {
+		return e.Code
+	}
+
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(e.StatusCode)), " ", "_")
+}
+
+// Response returns the ErrorResponse sent to the client. The message is the status text, unless
+// the error includes a PublicError, in which case its message is sent. The details of internal
+// server errors are never sent, because they're only useful to the server operator.
+func (e *HTTPError) Response() *ErrorResponse {
+	response := &ErrorResponse{
+		Code:    e.ErrorCode(),
+		Message: http.StatusText(e.StatusCode),
+	}
+
+	var public *PublicError
+	if e.StatusCode < 500 && errors.As(e.Err, &public) {
+		response.Message = public.Message
+	}
+
+	if e.Body != nil {
+		if detail, err := json.Marshal(e.Body); err == nil {
+			response.Detail = detail
+		}
+	}
+
+	return response
+}
+
 // Is enables us to look for http errors by status code.
 // For example, you can do: errors.Is(err, *HTTPError{StatusCode: http.StatusNotFound})
 // Some error codes are predefined: errors.Is(err, NotFoundError) will also work.
@@ -44,6 +132,22 @@ func (e *HTTPError) Is(target error) bool {
 	return false
 }
 
+// DecodeBody unmarshals the JSON detail of an error response into v. Returns false if the error
+// isn't a HTTPError, or if it doesn't have a JSON body of the right type.
+func DecodeBody(err error, v any) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+
+	body, ok := httpErr.Body.(json.RawMessage)
+	if !ok {
+		return false
+	}
+
+	return json.Unmarshal(body, v) == nil
+}
+
 func BadRequestError(err error) *HTTPError {
 	return &HTTPError{
 		StatusCode: http.StatusBadRequest,
@@ -86,6 +190,27 @@ func ConflictError(err error) *HTTPError {
 	}
 }
 
+func TooManyRequestsError(err error) *HTTPError {
+	return &HTTPError{
+		StatusCode: http.StatusTooManyRequests,
+		Err:        err,
+	}
+}
+
+func RequestEntityTooLargeError(err error) *HTTPError {
+	return &HTTPError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Err:        err,
+	}
+}
+
+func ServiceUnavailableError(err error) *HTTPError {
+	return &HTTPError{
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        err,
+	}
+}
+
 func NoContentError() *HTTPError {
 	return &HTTPError{
 		StatusCode: http.StatusConflict,
@@ -0,0 +1,111 @@
+package jtp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxEventSize is the largest event that ReadEvents will accept.
+const maxEventSize = 16 * 1024 * 1024
+
+// Event is a Server-Sent Event. The data is JSON.
+type Event struct {
+	Event string
+	ID    string
+	Data  []byte
+}
+
+// EventStream sends Server-Sent Events to a client. Each event is flushed as soon as it's sent.
+type EventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// NewEventStream writes the response headers for an event stream. Once it's been called,
+// errors can no longer be sent to the client with WriteError.
+func NewEventStream(w http.ResponseWriter) (*EventStream, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &EventStream{w: w, rc: http.NewResponseController(w)}
+	return stream, stream.rc.Flush()
+}
+
+// Send marshals v as JSON, and sends it as an event of the given type. The id is optional.
+func (s *EventStream) Send(event string, id string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to marshal event: %w", err)
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	fmt.Fprintf(&buf, "data: %s\n\n", data)
+
+	if _, err = io.WriteString(s.w, buf.String()); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+// Comment sends a comment, which clients ignore. It's used to keep idle connections open.
+func (s *EventStream) Comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+// ReadEvents reads Server-Sent Events from r, calling fn for each one, until r is exhausted or fn
+// returns an error. Comments and unknown fields are ignored.
+func ReadEvents(r io.Reader, fn func(*Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	event := &Event{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if event.Event != "" || len(event.Data) > 0 {
+				if event.Event == "" {
+					event.Event = "message"
+				}
+
+				if err := fn(event); err != nil {
+					return err
+				}
+			}
+
+			event = &Event{}
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.Event = value
+		case "id":
+			event.ID = value
+		case "data":
+			if len(event.Data) > 0 {
+				event.Data = append(event.Data, '\n')
+			}
+			event.Data = append(event.Data, value...)
+		}
+	}
+
+	return scanner.Err()
+}
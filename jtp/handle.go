@@ -9,13 +9,42 @@ import (
 
 type JSFunc[IN any, OUT any] func(http.ResponseWriter, *http.Request, *IN) (*OUT, error)
 
+// LimitFunc returns the maximum size of a request body, in bytes. A limit of zero or less means
+// there's no limit. If the function returns an error, it's sent to the client and the handler isn't called.
+type LimitFunc func(*http.Request) (int64, error)
+
+// Option configures the behaviour of Handle.
+type Option func(*options)
+
+type options struct {
+	limit LimitFunc
+}
+
+// MaxBytes limits the size of request bodies. Requests that are too large are rejected with
+// http.StatusRequestEntityTooLarge.
+func MaxBytes(limit LimitFunc) Option {
+	return func(o *options) {
+		o.limit = limit
+	}
+}
+
+// LogError logs the error and sends it to the client as a JSON ErrorResponse.
 func LogError(w http.ResponseWriter, status int, err error) {
-	if err != nil {
-		log.Printf("%v (http %d)", err, status)
-	} else if status >= 400 {
-		log.Printf("http %d", status)
+	WriteError(w, &HTTPError{StatusCode: status, Err: err})
+}
+
+// WriteError logs the error and sends it to the client as a JSON ErrorResponse.
+func WriteError(w http.ResponseWriter, err *HTTPError) {
+	if err.Err != nil {
+		log.Printf("%v (http %d)", err.Err, err.StatusCode)
+	} else if err.StatusCode >= 400 {
+		log.Printf("http %d", err.StatusCode)
 	}
-	http.Error(w, http.StatusText(status), status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(err.StatusCode)
+	_ = json.NewEncoder(w).Encode(err.Response())
 }
 
 // Handle returns a http.ServeFunc that automatically marshals and unmarshals the parameter and return type.
@@ -26,14 +55,39 @@ func LogError(w http.ResponseWriter, status int, err error) {
 // The function can return an error. nil returns http.StatusOK to the client. If the error contains a value
 // of type HTTPError, the associated status is returned. Otherwise, we return InternalServerError.
 // Errors are logged using standard logging.
-func Handle[IN any, OUT any](handler JSFunc[IN, OUT]) http.HandlerFunc {
+//
+// Use the MaxBytes option to limit the size of the request body.
+func Handle[IN any, OUT any](handler JSFunc[IN, OUT], opts ...Option) http.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		if o.limit != nil {
+			limit, err := o.limit(r)
+			if err != nil {
+				SendError(w, err)
+				return
+			}
+
+			if limit > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+		}
+
 		// If the request type (IN) is not the type None, read the body.
 		var in IN
 		if _, ok := any(in).(None); !ok {
 			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-				LogError(w, http.StatusBadRequest, err)
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					WriteError(w, RequestEntityTooLargeError(Errorf("request body is larger than the limit of %d bytes", maxBytesErr.Limit)))
+					return
+				}
+
+				WriteError(w, BadRequestError(Wrapf(err, "invalid request body")))
 				return
 			}
 		}
@@ -41,15 +95,8 @@ func Handle[IN any, OUT any](handler JSFunc[IN, OUT]) http.HandlerFunc {
 		out, err := handler(w, r, &in)
 
 		if err != nil {
-			var httpErr *HTTPError
-			ok := errors.As(err, &httpErr)
-			if ok {
-				LogError(w, httpErr.StatusCode, httpErr.Err)
-				return
-			} else {
-				LogError(w, http.StatusInternalServerError, err)
-				return
-			}
+			SendError(w, err)
+			return
 		}
 
 		if out != nil {
@@ -62,3 +109,15 @@ func Handle[IN any, OUT any](handler JSFunc[IN, OUT]) http.HandlerFunc {
 		}
 	}
 }
+
+// SendError sends an error to the client. If the error contains a HTTPError, the associated status is returned.
+// Otherwise, we return InternalServerError.
+func SendError(w http.ResponseWriter, err error) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		WriteError(w, httpErr)
+		return
+	}
+
+	LogError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,362 @@
+package secrt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+// Version 1 ciphertext is designed to be encrypted and decrypted as a stream. Each message
+// has its own symmetric key, which is sealed for the recipient using box. The plaintext is
+// split into chunks, each of which is sealed with secretbox using that key:
+//
+//   1 || nonce(24) || box(key) (48) || prefix(16) || chunk || chunk ...
+//
+// Each chunk holds up to StreamChunkSize bytes of plaintext. Chunk nonces are made up of the
+// random prefix, a chunk counter and a flag that marks the final chunk, so chunks can't be
+// reordered, and a stream that's been truncated at a chunk boundary is detected.
+//
+// Version 2 ciphertext is the same, except that the key isn't part of the stream. This lets a
+// single stream be shared by several recipients: the key is wrapped for each recipient using
+// StreamKey.Seal, and sent alongside the stream.
+//
+//   2 || prefix(16) || chunk || chunk ...
+//
+// Note that anyone who can unwrap the key could also have produced the stream, so recipients
+// of a shared stream rely on the server's claims to know that it came from the sender.
+//
+
+// StreamVersion is the ciphertext version written by NewStreamWriter.
+const StreamVersion = 1
+
+// SharedStreamVersion is the ciphertext version written by NewSharedStreamWriter.
+const SharedStreamVersion = 2
+
+// StreamChunkSize is the amount of plaintext sealed in each chunk of a stream.
+const StreamChunkSize = 64 * 1024
+
+const (
+	streamPrefixSize = 16
+	streamHeaderSize = 1 + 24 + 32 + box.Overhead + streamPrefixSize
+	sharedHeaderSize = 1 + streamPrefixSize
+	streamSealedSize = StreamChunkSize + secretbox.Overhead
+)
+
+var ErrStreamTruncated = errors.New("encrypted stream is truncated")
+var ErrStreamAuthentication = errors.New("unable to authenticate message")
+
+// StreamWriter encrypts a stream of plaintext. Close must be called to write the final chunk.
+type StreamWriter struct {
+	w       io.Writer
+	key     StreamKey
+	prefix  [streamPrefixSize]byte
+	counter uint64
+	buf     []byte // plaintext waiting to be sealed
+	sealed  []byte
+	closed  bool
+}
+
+// StreamKey is the symmetric key used to encrypt a stream.
+type StreamKey [32]byte
+
+// NewStreamKey returns a random stream key.
+func NewStreamKey() (*StreamKey, error) {
+	var key StreamKey
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// Seal wraps the key for the given peer, so it can be sent alongside a shared stream.
+func (key *StreamKey) Seal(peerKey []byte, privateKey []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return box.Seal(nonce[:], key[:], &nonce, To32(peerKey), To32(privateKey)), nil
+}
+
+// OpenStreamKey unwraps a key that was sealed by the given peer.
+func OpenStreamKey(sealed []byte, peerKey []byte, privateKey []byte) (*StreamKey, error) {
+	if len(sealed) != 24+32+box.Overhead {
+		return nil, ErrStreamAuthentication
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+
+	opened, ok := box.Open(nil, sealed[24:], &nonce, To32(peerKey), To32(privateKey))
+	if !ok {
+		return nil, ErrStreamAuthentication
+	}
+
+	var key StreamKey
+	copy(key[:], opened)
+	return &key, nil
+}
+
+// NewStreamWriter returns a writer that encrypts plaintext for peerKey, and writes the
+// ciphertext to w. The header is written immediately.
+func NewStreamWriter(w io.Writer, peerKey []byte, privateKey []byte) (*StreamWriter, error) {
+	key, err := NewStreamKey()
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := key.Seal(peerKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamWriter(w, key, append([]byte{StreamVersion}, sealedKey...))
+}
+
+// NewSharedStreamWriter returns a writer that encrypts plaintext with the given key, and writes
+// the ciphertext to w. The key must be sealed for each recipient. The header is written immediately.
+func NewSharedStreamWriter(w io.Writer, key *StreamKey) (*StreamWriter, error) {
+	return newStreamWriter(w, key, []byte{SharedStreamVersion})
+}
+
+// newStreamWriter writes the header, followed by a random nonce prefix.
+func newStreamWriter(w io.Writer, key *StreamKey, header []byte) (*StreamWriter, error) {
+	sw := &StreamWriter{
+		w:      w,
+		key:    *key,
+		buf:    make([]byte, 0, StreamChunkSize),
+		sealed: make([]byte, 0, streamSealedSize),
+	}
+
+	if _, err := rand.Read(sw.prefix[:]); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	if _, err := w.Write(append(header, sw.prefix[:]...)); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// Write encrypts p. Complete chunks are written as soon as more plaintext arrives, since the
+// last chunk can only be sealed once the writer is closed.
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, fmt.Errorf("write to closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(sw.buf) == StreamChunkSize {
+			if err := sw.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(sw.buf[len(sw.buf):StreamChunkSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the final chunk. It doesn't close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+
+	sw.closed = true
+	return sw.flush(true)
+}
+
+// flush seals the buffered plaintext as the next chunk.
+func (sw *StreamWriter) flush(final bool) error {
+	nonce := streamNonce(&sw.prefix, sw.counter, final)
+	sw.sealed = secretbox.Seal(sw.sealed[:0], sw.buf, nonce, (*[32]byte)(&sw.key))
+	sw.buf = sw.buf[:0]
+	sw.counter++
+
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+// StreamReader decrypts a stream written by StreamWriter.
+type StreamReader struct {
+	r       *bufio.Reader
+	key     StreamKey
+	prefix  [streamPrefixSize]byte
+	counter uint64
+	sealed  []byte
+	opened  []byte
+	buf     []byte // decrypted plaintext that hasn't been read yet
+	done    bool
+}
+
+// NewStreamReader reads the stream header from r, and returns a reader that decrypts
+// the rest of the stream. The peerKey is the public key of the sender.
+func NewStreamReader(r io.Reader, peerKey []byte, privateKey []byte) (*StreamReader, error) {
+	br := bufio.NewReaderSize(r, streamSealedSize+1)
+
+	header := make([]byte, 1+24+32+box.Overhead)
+	if err := readHeader(br, header, StreamVersion); err != nil {
+		return nil, err
+	}
+
+	key, err := OpenStreamKey(header[1:], peerKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(br, key)
+}
+
+// NewSharedStreamReader returns a reader that decrypts a shared stream, using a key that was
+// unwrapped with OpenStreamKey.
+func NewSharedStreamReader(r io.Reader, key *StreamKey) (*StreamReader, error) {
+	br := bufio.NewReaderSize(r, streamSealedSize+1)
+
+	if err := readHeader(br, make([]byte, 1), SharedStreamVersion); err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(br, key)
+}
+
+// readHeader reads the header of a stream, and checks its version.
+func readHeader(r io.Reader, header []byte, version byte) error {
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+
+	if header[0] != version {
+		return fmt.Errorf("ciphertext version (%d) is not supported", header[0])
+	}
+
+	return nil
+}
+
+// newStreamReader reads the nonce prefix, which follows the header.
+func newStreamReader(r *bufio.Reader, key *StreamKey) (*StreamReader, error) {
+	sr := &StreamReader{
+		r:      r,
+		key:    *key,
+		sealed: make([]byte, streamSealedSize),
+		opened: make([]byte, 0, StreamChunkSize),
+	}
+
+	if _, err := io.ReadFull(r, sr.prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrStreamTruncated
+		}
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// Read returns decrypted plaintext. Plaintext is only returned once the chunk containing it
+// has been authenticated.
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+
+		if err := sr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk.
+func (sr *StreamReader) next() error {
+	n, err := io.ReadFull(sr.r, sr.sealed)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+
+	// Only the final chunk can be short, but a full chunk is also final if nothing follows it.
+	final := n < len(sr.sealed)
+	if !final {
+		if _, err = sr.r.Peek(1); err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			final = true
+		}
+	}
+
+	nonce := streamNonce(&sr.prefix, sr.counter, final)
+	plaintext, ok := secretbox.Open(sr.opened[:0], sr.sealed[:n], nonce, (*[32]byte)(&sr.key))
+	if !ok {
+		if final {
+			// The chunk might have been sealed as a non-final chunk, which means the stream
+			// was cut short.
+			if _, ok = secretbox.Open(nil, sr.sealed[:n], streamNonce(&sr.prefix, sr.counter, false), (*[32]byte)(&sr.key)); ok {
+				return ErrStreamTruncated
+			}
+		}
+		return ErrStreamAuthentication
+	}
+
+	sr.buf = plaintext
+	sr.counter++
+	sr.done = final
+	return nil
+}
+
+// streamNonce returns the nonce for the given chunk.
+func streamNonce(prefix *[streamPrefixSize]byte, counter uint64, final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+
+	// The counter won't reach 2^56 chunks, so it's stored in 7 bytes, and the last byte of
+	// the nonce marks the final chunk.
+	var count [8]byte
+	binary.BigEndian.PutUint64(count[:], counter)
+	copy(nonce[streamPrefixSize:23], count[1:])
+
+	if final {
+		nonce[23] = 1
+	}
+
+	return &nonce
+}
+
+// StreamSize returns the size of the ciphertext for a plaintext of the given size.
+func StreamSize(size int64) int64 {
+	return streamHeaderSize + chunkedSize(size)
+}
+
+// SharedStreamSize returns the size of a shared stream for a plaintext of the given size.
+func SharedStreamSize(size int64) int64 {
+	return sharedHeaderSize + chunkedSize(size)
+}
+
+// chunkedSize returns the size of the sealed chunks for a plaintext of the given size.
+func chunkedSize(size int64) int64 {
+	chunks := max((size+StreamChunkSize-1)/StreamChunkSize, 1)
+	return size + chunks*secretbox.Overhead
+}
@@ -0,0 +1,163 @@
+package secrt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func sealStream(t *testing.T, plaintext []byte, peerKey, privateKey *[32]byte) []byte {
+	var ciphertext bytes.Buffer
+	sw, err := NewStreamWriter(&ciphertext, peerKey[:], privateKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write in odd-sized pieces to exercise chunk boundaries.
+	for len(plaintext) > 0 {
+		n := min(len(plaintext), 1000)
+		if _, err = sw.Write(plaintext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+
+	if err = sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ciphertext.Bytes()
+}
+
+func openStream(ciphertext []byte, peerKey, privateKey *[32]byte) ([]byte, error) {
+	sr, err := NewStreamReader(bytes.NewReader(ciphertext), peerKey[:], privateKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(sr)
+}
+
+func TestStream(t *testing.T) {
+	alicePublic, alicePrivate, _ := box.GenerateKey(rand.Reader)
+	bobPublic, bobPrivate, _ := box.GenerateKey(rand.Reader)
+
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 100} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := sealStream(t, plaintext, bobPublic, alicePrivate)
+		if int64(len(ciphertext)) != StreamSize(int64(size)) {
+			t.Errorf("size %d: expected %d bytes of ciphertext, got %d", size, StreamSize(int64(size)), len(ciphertext))
+		}
+
+		opened, err := openStream(ciphertext, alicePublic, bobPrivate)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatalf("size %d: plaintext doesn't match", size)
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	alicePublic, alicePrivate, _ := box.GenerateKey(rand.Reader)
+	bobPublic, bobPrivate, _ := box.GenerateKey(rand.Reader)
+	_, evePrivate, _ := box.GenerateKey(rand.Reader)
+
+	plaintext := make([]byte, 2*StreamChunkSize+10)
+	rand.Read(plaintext)
+	ciphertext := sealStream(t, plaintext, bobPublic, alicePrivate)
+
+	// Truncated at a chunk boundary.
+	truncated := ciphertext[:streamHeaderSize+streamSealedSize]
+	if _, err := openStream(truncated, alicePublic, bobPrivate); !errors.Is(err, ErrStreamTruncated) {
+		t.Errorf("expected truncation error, got %v", err)
+	}
+
+	// Truncated in the middle of a chunk.
+	if _, err := openStream(ciphertext[:len(ciphertext)-5], alicePublic, bobPrivate); !errors.Is(err, ErrStreamAuthentication) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+
+	// Modified chunk.
+	modified := bytes.Clone(ciphertext)
+	modified[streamHeaderSize+100] ^= 1
+	if _, err := openStream(modified, alicePublic, bobPrivate); !errors.Is(err, ErrStreamAuthentication) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+
+	// Chunks out of order.
+	reordered := bytes.Clone(ciphertext)
+	first := reordered[streamHeaderSize : streamHeaderSize+streamSealedSize]
+	second := bytes.Clone(reordered[streamHeaderSize+streamSealedSize : streamHeaderSize+2*streamSealedSize])
+	copy(reordered[streamHeaderSize+streamSealedSize:], first)
+	copy(reordered[streamHeaderSize:], second)
+	if _, err := openStream(reordered, alicePublic, bobPrivate); !errors.Is(err, ErrStreamAuthentication) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+
+	// Wrong recipient.
+	if _, err := openStream(ciphertext, alicePublic, evePrivate); !errors.Is(err, ErrStreamAuthentication) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
+
+func TestSharedStream(t *testing.T) {
+	alicePublic, alicePrivate, _ := box.GenerateKey(rand.Reader)
+	bobPublic, bobPrivate, _ := box.GenerateKey(rand.Reader)
+	carolPublic, carolPrivate, _ := box.GenerateKey(rand.Reader)
+
+	key, err := NewStreamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := make([]byte, StreamChunkSize+10)
+	rand.Read(plaintext)
+
+	var ciphertext bytes.Buffer
+	sw, err := NewSharedStreamWriter(&ciphertext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.Write(plaintext)
+	sw.Close()
+
+	if int64(ciphertext.Len()) != SharedStreamSize(int64(len(plaintext))) {
+		t.Errorf("expected %d bytes of ciphertext, got %d", SharedStreamSize(int64(len(plaintext))), ciphertext.Len())
+	}
+
+	for _, recipient := range []struct{ public, private *[32]byte }{{bobPublic, bobPrivate}, {carolPublic, carolPrivate}} {
+		sealed, err := key.Seal(recipient.public[:], alicePrivate[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opened, err := OpenStreamKey(sealed, alicePublic[:], recipient.private[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr, err := NewSharedStreamReader(bytes.NewReader(ciphertext.Bytes()), opened)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result, err := io.ReadAll(sr); err != nil || !bytes.Equal(result, plaintext) {
+			t.Fatalf("unable to read shared stream: %v", err)
+		}
+	}
+
+	// Only the intended recipient can unwrap the key.
+	sealed, _ := key.Seal(bobPublic[:], alicePrivate[:])
+	if _, err = OpenStreamKey(sealed, alicePublic[:], carolPrivate[:]); !errors.Is(err, ErrStreamAuthentication) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
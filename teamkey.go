@@ -0,0 +1,79 @@
+package secrt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+// The aliases of a team's owner and members are encrypted with the team key, which is created by
+// the owner's client. Each member has a copy of the key, sealed for their public key, so only
+// members can read the aliases; the server only stores the ciphertext, along with each member's
+// alias hash. Clients check the decrypted aliases against the hashes, so the owner can't give a
+// member the wrong alias.
+//
+// Encrypted aliases are nonce(24) || secretbox(alias). Sealed keys are box.SealAnonymous(key).
+//
+
+var ErrTeamKey = errors.New("unable to open team key")
+
+// TeamKey is the symmetric key that a team's aliases are encrypted with.
+type TeamKey [32]byte
+
+// NewTeamKey returns a random team key.
+func NewTeamKey() (*TeamKey, error) {
+	var key TeamKey
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// Seal wraps the key for the peer with the given public key.
+func (key *TeamKey) Seal(peerKey []byte) ([]byte, error) {
+	return box.SealAnonymous(nil, key[:], To32(peerKey), rand.Reader)
+}
+
+// OpenTeamKey unwraps a key that was sealed for the given key pair.
+func OpenTeamKey(sealed []byte, publicKey []byte, privateKey []byte) (*TeamKey, error) {
+	opened, ok := box.OpenAnonymous(nil, sealed, To32(publicKey), To32(privateKey))
+	if !ok || len(opened) != len(TeamKey{}) {
+		return nil, ErrTeamKey
+	}
+
+	var key TeamKey
+	copy(key[:], opened)
+	return &key, nil
+}
+
+// EncryptAlias encrypts an alias with the team key.
+func (key *TeamKey) EncryptAlias(alias string) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return secretbox.Seal(nonce[:], []byte(alias), &nonce, (*[32]byte)(key)), nil
+}
+
+// DecryptAlias decrypts an alias that was encrypted with the team key.
+func (key *TeamKey) DecryptAlias(encrypted []byte) (string, error) {
+	if len(encrypted) < 24+secretbox.Overhead {
+		return "", errors.New("encrypted alias is too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], encrypted[:24])
+
+	alias, ok := secretbox.Open(nil, encrypted[24:], &nonce, (*[32]byte)(key))
+	if !ok {
+		return "", errors.New("unable to decrypt alias")
+	}
+
+	return string(alias), nil
+}
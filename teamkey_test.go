@@ -0,0 +1,73 @@
+package secrt
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestTeamKey(t *testing.T) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewTeamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := key.Seal(public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenTeamKey(sealed, public[:], private[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *opened != *key {
+		t.Fatal("opened key doesn't match")
+	}
+
+	// Only the peer it was sealed for can open it.
+	otherPublic, otherPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OpenTeamKey(sealed, otherPublic[:], otherPrivate[:]); !errors.Is(err, ErrTeamKey) {
+		t.Fatalf("expected the key not to open, got %v", err)
+	}
+
+	encrypted, err := key.EncryptAlias("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, err := opened.DecryptAlias(encrypted)
+	if err != nil || alias != "alice@example.com" {
+		t.Fatalf("unexpected alias %q: %v", alias, err)
+	}
+
+	otherKey, err := NewTeamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = otherKey.DecryptAlias(encrypted); err == nil {
+		t.Error("expected the alias not to decrypt with another key")
+	}
+
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err = key.DecryptAlias(encrypted); err == nil {
+		t.Error("expected a modified alias to be rejected")
+	}
+
+	if _, err = key.DecryptAlias(encrypted[:10]); err == nil {
+		t.Error("expected a short alias to be rejected")
+	}
+}
@@ -34,14 +34,17 @@ trap cleanup EXIT
 PATH=.:$PATH
 go build -o secrt ../cmd/secrt
 go build -o secrtd ../cmd/secrtd
-go test ..
+go test ../...
 
 # Use a small challenge size to keep tests snappy.
 export SECRT_CHALLENGE_SIZE=10
 export SECRT_ENROL_ACTION=file
 export SECRT_ENROL_FILE=token.txt
+export SECRT_MAILER=mbox
+export SECRT_MBOX_FILE=secrt.mbox
+export SECRT_NOTIFY_DELAY=1s
 
-rm -f *.json $SECRT_ENROL_FILE
+rm -f *.json $SECRT_ENROL_FILE $SECRT_MBOX_FILE
 
 secrtd add http://localhost:8080
 
@@ -246,11 +249,252 @@ if secrt -c alice.json send ./TEST.md bob@example.com charlie@example.com denise
   exit 1
 fi
 
+#
+# Burn after reading
+#
+echo "--- secrt send --burn"
+MSGID=$(echo "burn" | secrt -c alice.json send --burn --ttl 1h bob@example.com)
+MSG=$(secrt -c bob.json get $MSGID)
+if [ "$MSG" != "burn" ]; then
+  echo "expected burn" 1>&2
+  exit 1
+fi
+
+if secrt -c bob.json get $MSGID 2> /dev/null; then
+  echo "secrt get should have failed (message was burnt!)" 1>&2
+  exit 1
+fi
+
 #
 # Test sending an invite
 #
 echo "--- secrt invite user"
 secrt -c alice.json invite fred@example.com
+enrol fred.json fred@example.com clear
+MSGID=$(echo "hello fred" | secrt -c alice.json send fred@example.com)
+if secrt -c fred.json get $MSGID 2>&1 | grep -q "added new peer"; then
+  echo "fred was warned about alice, who invited him" 1>&2
+  exit 1
+fi
+
+#
+# Test notification emails. A burst of messages produces one email, which doesn't contain the secret.
+#
+echo "--- secrt set notify=email"
+secrt -c fred.json set notify=email
+echo "notify one" | secrt -c alice.json send fred@example.com > /dev/null
+echo "notify two" | secrt -c alice.json send fred@example.com > /dev/null
+for _ in {1..30}; do grep -q "2 new secrets" $SECRT_MBOX_FILE 2> /dev/null && break || sleep 0.1; done
+if ! grep -q "Subject: you have 2 new secrets" $SECRT_MBOX_FILE || grep -q "notify one" $SECRT_MBOX_FILE; then
+  echo "expected a single notification for fred" 1>&2
+  exit 1
+fi
+secrt -c fred.json set notify=none
+
+#
+# Test that "secrt watch" sees new messages as they arrive.
+#
+echo "--- secrt watch --once --exec"
+secrt -c bob.json watch --once --exec 'echo "$SECRT_SENDER" > WATCH.out' &
+WATCHPID=$!
+sleep 0.5
+echo "watch this" | secrt -c alice.json send bob@example.com > /dev/null
+wait $WATCHPID
+if [ "$(cat WATCH.out)" != "alice@example.com" ]; then
+  echo "secrt watch didn't see the message from alice" 1>&2
+  exit 1
+fi
+rm -f WATCH.out
+
+#
+# Test that "secrt run" passes secrets to a command in its environment.
+#
+echo "--- secrt run"
+MSGID=$(printf 'export DB_USER=admin\nDB_PASSWORD="correct horse"\n' | secrt -c alice.json send bob@example.com)
+if secrt -c bob.json run --from $MSGID --rm -- false; then
+  echo "secrt run should have failed" 1>&2
+  exit 1
+fi
+OUTPUT=$(secrt -c bob.json run --from $MSGID --rm -- sh -c 'echo "$DB_USER:$DB_PASSWORD"')
+if [ "$OUTPUT" != "admin:correct horse" ]; then
+  echo "secrt run didn't set the environment: $OUTPUT" 1>&2
+  exit 1
+fi
+if secrt -c bob.json get $MSGID > /dev/null 2>&1; then
+  echo "secrt run --rm should have deleted the message" 1>&2
+  exit 1
+fi
+MSGID=$(echo '{"API_KEY": "abc123", "RETRIES": 3}' | secrt -c alice.json send bob@example.com)
+if ! secrt -c bob.json run --from $MSGID --format json -- sh -c 'test "$API_KEY" = abc123 -a "$RETRIES" = 3'; then
+  echo "secrt run --format json didn't set the environment" 1>&2
+  exit 1
+fi
+
+#
+# Test key/value secrets.
+#
+echo "--- secrt send --kv / get --format"
+MSGID=$(secrt -c alice.json send --kv DB_USER=admin --kv "DB_PASSWORD=it's secret" bob@example.com)
+if [ "$(secrt -c bob.json get --key DB_PASSWORD $MSGID)" != "it's secret" ]; then
+  echo "secrt get --key didn't return the value" 1>&2
+  exit 1
+fi
+eval "$(secrt -c bob.json get --format export $MSGID)"
+if [ "$DB_USER:$DB_PASSWORD" != "admin:it's secret" ]; then
+  echo "secrt get --format export didn't set the variables" 1>&2
+  exit 1
+fi
+if ! secrt -c bob.json get --format k8s --name db $MSGID | grep -q "DB_USER: YWRtaW4="; then
+  echo "secrt get --format k8s didn't produce a secret" 1>&2
+  exit 1
+fi
+unset DB_USER DB_PASSWORD
+
+#
+# Test groups.
+#
+echo "--- secrt group / send @group"
+secrt -c alice.json group add oncall bob@example.com charlie@example.com
+secrt -c alice.json group ls
+IDS=($(echo "paged" | secrt -c alice.json send @oncall bob@example.com))
+if [ ${#IDS[@]} != 2 ]; then
+  echo "secrt send @oncall didn't send one message to each member" 1>&2
+  exit 1
+fi
+if [ "$(secrt -c bob.json get ${IDS[0]})" != "paged" ]; then
+  echo "secrt send @oncall didn't send to bob" 1>&2
+  exit 1
+fi
+if secrt -c charlie.json group add team alice@example.com 2> /dev/null; then
+  echo "secrt group add should have failed (acceptPeers=false)" 1>&2
+  exit 1
+fi
+secrt -c alice.json group rm oncall
+if secrt -c alice.json send TEST.md @oncall 2> /dev/null; then
+  echo "secrt send to a removed group should have failed" 1>&2
+  exit 1
+fi
+
+#
+# Test teams.
+#
+echo "--- secrt team / send team:name"
+secrt -c alice.json team add sre bob@example.com charlie@example.com
+if ! secrt -c bob.json team ls | grep -q "^team:sre (invited"; then
+  echo "secrt team ls didn't list bob's invitation" 1>&2
+  exit 1
+fi
+if secrt -c bob.json team ls sre 2> /dev/null; then
+  echo "secrt team ls should have failed (not a member yet)" 1>&2
+  exit 1
+fi
+secrt -c bob.json team join sre
+secrt -c charlie.json team join sre
+if ! secrt -c bob.json team ls | grep -q "^team:sre$"; then
+  echo "secrt team ls didn't list bob's team" 1>&2
+  exit 1
+fi
+if echo "paged" | secrt -c bob.json send team:sre 2> /dev/null; then
+  echo "secrt send team:sre should have failed (members not confirmed)" 1>&2
+  exit 1
+fi
+secrt -c bob.json team confirm sre
+IDS=($(echo "paged" | secrt -c bob.json send team:sre))
+if [ ${#IDS[@]} != 2 ]; then
+  echo "secrt send team:sre didn't send to the other members" 1>&2
+  exit 1
+fi
+if [ "$(secrt -c alice.json get ${IDS[0]})" != "paged" ]; then
+  echo "secrt send team:sre didn't send to alice" 1>&2
+  exit 1
+fi
+if secrt -c bob.json team rm sre charlie@example.com 2> /dev/null; then
+  echo "secrt team rm should have failed (not the owner)" 1>&2
+  exit 1
+fi
+secrt -c alice.json team rm sre charlie@example.com
+IDS=($(echo "paged" | secrt -c alice.json send team:sre))
+if [ ${#IDS[@]} != 1 ]; then
+  echo "secrt send team:sre sent to a removed member" 1>&2
+  exit 1
+fi
+secrt -c alice.json team rm sre
+if secrt -c alice.json send TEST.md team:sre 2> /dev/null; then
+  echo "secrt send to a deleted team should have failed" 1>&2
+  exit 1
+fi
+
+#
+# Test requests and replies.
+#
+echo "--- secrt request / reply"
+REQID=$(secrt -c alice.json request bob@example.com -d "staging db password")
+if ! secrt -c alice.json ls | grep "^${REQID:0:8}" | grep -q pending; then
+  echo "secrt ls didn't show the pending request" 1>&2
+  exit 1
+fi
+if ! secrt -c bob.json ls | grep "^${REQID:0:8}" | grep -q "\[request\]"; then
+  echo "secrt ls didn't show the request to the recipient" 1>&2
+  exit 1
+fi
+REPLYID=$(echo "hunter2" | secrt -c bob.json reply $REQID)
+if ! secrt -c alice.json ls | grep "^${REQID:0:8}" | grep -q "replied ${REPLYID:0:8}"; then
+  echo "secrt ls didn't show the request as fulfilled" 1>&2
+  exit 1
+fi
+if ! secrt -c alice.json ls --json | jq -e --arg id "$REQID" '.Requests | any(.message == $id and .reply != null)' > /dev/null; then
+  echo "secrt ls --json didn't include the fulfilled request" 1>&2
+  exit 1
+fi
+if [ "$(secrt -c alice.json get $REPLYID)" != "hunter2" ]; then
+  echo "secrt get didn't return the reply" 1>&2
+  exit 1
+fi
+secrt -c alice.json rm $REPLYID
+secrt -c bob.json rm $REQID
+secrt -c alice.json ls > /dev/null
+if jq -e '.endpoints[0].requests | length > 0' alice.json > /dev/null; then
+  echo "secrt ls didn't forget the fulfilled request" 1>&2
+  exit 1
+fi
+EXPIRED=$(secrt -c alice.json request --ttl 1s bob@example.com -d "expires")
+sleep 2
+secrt -c alice.json ls > /dev/null
+if jq -e '.endpoints[0].requests | length > 0' alice.json > /dev/null; then
+  echo "secrt ls didn't forget the expired request $EXPIRED" 1>&2
+  exit 1
+fi
+
+#
+# Test sending directories.
+#
+echo "--- secrt send dir / get -x"
+rm -rf certs extracted
+mkdir -p certs/private
+echo "cert" > certs/server.crt
+echo "key" > certs/private/server.key
+chmod 600 certs/private/server.key
+MSGID=$(secrt -c alice.json send certs bob@example.com)
+secrt -c bob.json get -x extracted $MSGID
+if ! diff -r certs extracted; then
+  echo "secrt get -x didn't extract the directory" 1>&2
+  exit 1
+fi
+if [ "$(stat -c %a extracted/private/server.key)" != 600 ]; then
+  echo "secrt get -x didn't preserve the file mode" 1>&2
+  exit 1
+fi
+if secrt -c bob.json get -x extracted $MSGID 2>/dev/null; then
+  echo "secrt get -x overwrote existing files" 1>&2
+  exit 1
+fi
+secrt -c bob.json get -x extracted --force $MSGID
+ln -s server.crt certs/link.crt
+if secrt -c alice.json send certs bob@example.com 2>/dev/null; then
+  echo "secrt send sent a symlink" 1>&2
+  exit 1
+fi
+rm -rf certs extracted
 
 #
 # Attempt to double enrol without --force
@@ -275,6 +519,119 @@ echo "--- use different enrolment"
 echo "hello" | secrt -c guy.json send alice@example.com
 secrt -c alice.json ls
 
+#
+# Test that plan limits are enforced
+#
+echo "--- secrt plan limits"
+enrol ivy.json ivy@example.com clear
+secrtd plan http://localhost:8080 free ivy@example.com
+if head -c 20000 /dev/urandom | secrt -c ivy.json send alice@example.com 2> /dev/null; then
+  echo "secrt send should have failed (free plan size limit)" 1>&2
+  exit 1
+fi
+
+#
+# Test that logging out revokes tokens on other devices
+#
+echo "--- secrt logout --all-devices"
+enrol judy.json judy@example.com clear
+cp judy.json judy-laptop.json
+secrt -c judy.json logout --all-devices
+if echo "hello" | secrt -c judy-laptop.json send alice@example.com 2> /dev/null; then
+  echo "secrt send should have failed (token was revoked)" 1>&2
+  exit 1
+fi
+echo "hello" | secrt -c judy.json send alice@example.com
+secrt -c judy.json refresh
+
+#
+# Test that peers follow a key rotation
+#
+echo "--- secrt rekey"
+enrol karl.json karl@example.com clear
+echo "before" | secrt -c alice.json send karl@example.com
+if secrt -c karl.json rekey 2> /dev/null; then
+  echo "secrt rekey should have failed (inbox isn't empty)" 1>&2
+  exit 1
+fi
+secrt -c karl.json rekey --force
+if echo "after" | secrt -c alice.json send karl@example.com bob@example.com > sent.txt 2> /dev/null; then
+  echo "secrt send should have failed (karl's key changed)" 1>&2
+  exit 1
+fi
+if [ $(wc -l < sent.txt) != 1 ]; then
+  echo "expected the message to be sent to bob" 1>&2
+  exit 1
+fi
+rm -f sent.txt
+secrt -c alice.json peer ls | grep key-rotated
+secrt -c alice.json peer accept-key karl@example.com
+MSGID=$(echo "after" | secrt -c alice.json send karl@example.com)
+MSG=$(secrt -c karl.json get $MSGID)
+if [ "$MSG" != "after" ]; then
+  echo "expected after" 1>&2
+  exit 1
+fi
+if secrt -c alice.json peer verify karl@example.com 123 > /dev/null 2>&1; then
+  echo "secrt peer verify should have failed (wrong number)" 1>&2
+  exit 1
+fi
+NUMBER=$(secrt -c karl.json peer verify alice@example.com | grep -E '^ +[0-9]')
+secrt -c alice.json peer verify karl@example.com "$NUMBER"
+secrt -c alice.json peer ls | grep "karl@example.com .* verified"
+
+#
+# Test the password vault
+#
+echo "--- secrt password vault"
+export SECRT_PASSPHRASE=correct-horse
+enrol lee.json lee@example.com password
+echo "hello" | secrt -c lee.json send alice@example.com
+if echo "hello" | SECRT_PASSPHRASE=wrong secrt -c lee.json send alice@example.com 2> /dev/null; then
+  echo "secrt send should have failed (wrong passphrase)" 1>&2
+  exit 1
+fi
+secrt -c lee.json vault migrate password clear
+secrt -c lee.json vault add password
+secrt -c lee.json vault ls
+unset SECRT_PASSPHRASE
+echo "hello" | secrt -c lee.json send alice@example.com
+
+#
+# Test that large secrets are streamed
+#
+echo "--- secrt send (streamed)"
+enrol mike.json mike@example.com clear
+secrtd plan http://localhost:8080 ops mike@example.com
+head -c 200000 /dev/urandom > LARGE.bin
+MSGID=$(secrt -c mike.json send LARGE.bin alice@example.com)
+secrt -c alice.json get -o LARGE.out $MSGID
+if ! cmp -s LARGE.bin LARGE.out; then
+  echo "LARGE.bin and LARGE.out are different!" 1>&2
+  exit 1
+fi
+MSGID=$(cat LARGE.bin | secrt -c mike.json send --burn alice@example.com bob@example.com | head -1)
+secrt -c alice.json get $MSGID | cmp -s - LARGE.bin
+rm -f LARGE.bin LARGE.out
+
+#
+# Test that new peers get a welcome message from the server
+#
+echo "--- secrt welcome message"
+enrol nora.json nora@example.com clear
+secrt -c nora.json set acceptPeers=false
+MSGID=$(secrt -c nora.json ls -l | awk 'NR == 2 { print $1 }')
+secrt -c nora.json get $MSGID | grep -q "Welcome to secrt"
+
+#
+# Test that the database doesn't contain any aliases
+#
+echo "--- secrt alias privacy"
+if pg_dump --data-only $PGDATABASE | grep -q "example.com"; then
+  echo "the database contains plaintext aliases!" 1>&2
+  exit 1
+fi
+
 #
 # Attempt to double enrol with --force
 # FIXME: this won't work until we have a reenrolment flow on the SECRTD side
@@ -1,6 +1,7 @@
 package secrt
 
 import (
+	"crypto/sha256"
 	_ "embed"
 	"fmt"
 	"os"
@@ -29,6 +30,20 @@ func To64(bytes []byte) *[64]byte {
 	return &result
 }
 
+// AliasHash returns the hash that a server uses to identify a peer, so that the server doesn't
+// need to store the peer's alias. The hash is salted with the server's public key, so hashes
+// can't be compared between servers. Clients use it to verify the sender of a message.
+//
+// The salt is public, so the hashes only keep aliases out of casual view: anyone with a copy of
+// the database can check whether a given email address is enrolled, or guess common addresses.
+// A keyed hash would prevent that, but clients couldn't compute it to check senders and invites.
+func AliasHash(serverKey []byte, alias string) []byte {
+	hash := sha256.New()
+	hash.Write(serverKey)
+	hash.Write([]byte(alias))
+	return hash.Sum(nil)
+}
+
 func Usage(msg ...any) {
 
 	_, _ = os.Stderr.WriteString(README)